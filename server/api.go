@@ -1,17 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
 	"golang.org/x/oauth2"
-	"google.golang.org/api/gmail/v1"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ServeHTTP allows the plugin to implement the http.Handler interface. Requests destined for the
@@ -28,6 +27,22 @@ func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Req
 		p.completeGmailConnection(w, r)
 	case "/command/disconnect":
 		p.disconnectGmail(w, r)
+	case "/command/reconnect":
+		p.reconnectGmail(w, r)
+	case "/action/message":
+		p.handleMessageAction(w, r)
+	case "/command/import":
+		p.importFromChooser(w, r)
+	case "/command/unfollow":
+		p.unfollowThreadFromList(w, r)
+	case "/command/cancelimport":
+		p.cancelImportFromPost(w, r)
+	case "/command/search":
+		p.handleSearchResultAction(w, r)
+	case "/command/forward":
+		p.confirmForwardThread(w, r)
+	case "/dialog/send":
+		p.submitSendDialog(w, r)
 	case "/webhook/gmail":
 		p.sendMailNotification(w, r)
 	default:
@@ -44,11 +59,26 @@ func (p *Plugin) connectGmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A channel admin may connect a shared mailbox to the channel
+	channelID := r.URL.Query().Get("channel_id")
+	if channelID != "" {
+		if errMessage := p.checkCanManageChannelMailbox(authedUserID, channelID); errMessage != "" {
+			http.Error(w, errMessage, http.StatusForbidden)
+			return
+		}
+	}
+
 	// Create a unique ID generated to protect against CSRF attack while auth.
 	antiCSRFToken := fmt.Sprintf("%v_%v", model.NewId()[0:15], authedUserID)
 
+	// The channel is kept along with the state, as the state is part of the key and keys are limited in length
+	storedState := antiCSRFToken
+	if channelID != "" {
+		storedState += "_" + channelID
+	}
+
 	// Store that uniqueState for later validations in redirect from oauth
-	if err := p.API.KVSet(antiCSRFToken, []byte(antiCSRFToken)); err != nil {
+	if err := p.API.KVSet(antiCSRFToken, []byte(storedState)); err != nil {
 		http.Error(w, "Failed to save state", http.StatusBadRequest)
 		return
 	}
@@ -93,13 +123,18 @@ func (p *Plugin) completeGmailConnection(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if string(antiCSRFTokenPassedEarlier) != antiCSRFTokenInURL || len(antiCSRFTokenInURL) == 0 {
+	storedState := strings.Split(string(antiCSRFTokenPassedEarlier), "_")
+	if len(storedState) < 2 || storedState[0]+"_"+storedState[1] != antiCSRFTokenInURL || len(antiCSRFTokenInURL) == 0 {
 		http.Error(w, "Cross-site request forgery", http.StatusForbidden)
 		return
 	}
 
 	// Extract user id from the state
-	userID := strings.Split(antiCSRFTokenInURL, "_")[1]
+	userID := storedState[1]
+	channelID := ""
+	if len(storedState) > 2 {
+		channelID = storedState[2]
+	}
 
 	// and then clear the KVStore off the CSRF token
 	p.API.KVDelete(antiCSRFTokenInURL)
@@ -125,14 +160,20 @@ func (p *Plugin) completeGmailConnection(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	tokenJSON, jsonErr := json.Marshal(token)
-	if jsonErr != nil {
-		http.Error(w, "Invalid token marshal", http.StatusBadRequest)
+	if channelID != "" {
+		if err := p.connectChannelMailbox(channelID, userID, token); err != nil {
+			p.API.LogError("Error occured - Could not connect the shared mailbox to the channel", "err", err.Error())
+			p.CreateBotDMPost(userID, "Error occured while connecting the shared Gmail account to the channel. Please try again later.")
+			http.Error(w, "Could not connect the shared mailbox to the channel", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, htmlMessage)
 		return
 	}
 
 	p.API.LogInfo("Starting to onboard user with user ID: " + userID)
-	onBoardErr := p.onboardUser(userID, tokenJSON)
+	onBoardErr := p.onboardUser(userID, token)
 	if onBoardErr != nil {
 		p.API.LogError("Error occured - Could not onboard user", "err", onBoardErr.Error())
 		p.CreateBotDMPost(userID, "Error occured while connecting to Gmail. Please try again later.")
@@ -162,15 +203,46 @@ func (p *Plugin) disconnectGmail(w http.ResponseWriter, r *http.Request) {
 
 	// Get the information from Body which contain the interactive Message Attachment we sent from /disconnect command
 	intergrationResponseFromCommand := model.PostActionIntegrationRequestFromJson(r.Body)
+	if intergrationResponseFromCommand == nil || intergrationResponseFromCommand.UserId != authUserID {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
 
 	userID := intergrationResponseFromCommand.UserId
-	actionToBeTaken := intergrationResponseFromCommand.Context["action"].(string)
+	actionToBeTaken, _ := intergrationResponseFromCommand.Context["action"].(string)
 	channelID := intergrationResponseFromCommand.ChannelId
 	originalPostID := intergrationResponseFromCommand.PostId
-	actionSecret := p.getConfiguration().EncryptionKey
-	actionSecretPassed := intergrationResponseFromCommand.Context["actionSecret"].(string)
+	signature, _ := intergrationResponseFromCommand.Context["signature"].(string)
+
+	// The buttons of a shared mailbox are signed along with its channel
+	mailboxChannelID, sharedMailbox := intergrationResponseFromCommand.Context["mailboxChannelId"].(string)
+	signed := p.verifyAction(signature, actionToBeTaken, userID)
+	if sharedMailbox {
+		signed = p.verifyAction(signature, actionToBeTaken, userID, mailboxChannelID)
+	}
+
+	// The shared mailbox of a channel is disconnected by a channel admin
+	if sharedMailbox && actionToBeTaken == ActionDisconnectPlugin && signed {
+		if errMessage := p.checkCanManageChannelMailbox(userID, mailboxChannelID); errMessage != "" {
+			http.Error(w, errMessage, http.StatusForbidden)
+			return
+		}
+		if err := p.offboardUser(channelMailboxOwnerID(mailboxChannelID)); err != nil {
+			p.API.LogError("Error occured while disconnecting the shared mailbox from the channel.", "err", err.Error())
+			p.API.DeleteEphemeralPost(userID, originalPostID)
+			p.sendMessageFromBot(channelID, userID, true, "Unable to disconnect the shared Gmail account. Please try again later.")
+			http.Error(w, "Error occured while disconnecting the shared mailbox.", http.StatusInternalServerError)
+			return
+		}
+
+		p.API.DeleteEphemeralPost(userID, originalPostID)
+		if user, appErr := p.API.GetUser(userID); appErr == nil {
+			p.sendMessageFromBot(mailboxChannelID, "", false, ":zzz: @"+user.Username+" disconnected the shared Gmail account from this channel.")
+		}
+		return
+	}
 
-	if actionToBeTaken == ActionDisconnectPlugin && actionSecret == actionSecretPassed {
+	if actionToBeTaken == ActionDisconnectPlugin && signed {
 		err := p.offboardUser(userID)
 
 		if err != nil {
@@ -194,7 +266,7 @@ func (p *Plugin) disconnectGmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if actionToBeTaken == ActionCancel && actionSecret == actionSecretPassed {
+	if actionToBeTaken == ActionCancel && signed {
 		p.API.UpdateEphemeralPost(userID, &model.Post{
 			Id:        originalPostID,
 			UserId:    p.gmailBotID,
@@ -209,110 +281,420 @@ func (p *Plugin) disconnectGmail(w http.ResponseWriter, r *http.Request) {
 	p.API.DeleteEphemeralPost(userID, originalPostID)
 }
 
-func (p *Plugin) sendMailNotification(w http.ResponseWriter, r *http.Request) {
-	// If the body isn't of type json, then reject
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		p.API.LogInfo("Body type not json: " + contentType)
-		http.Error(w, "Content types don't match", http.StatusBadRequest)
+func (p *Plugin) reconnectGmail(w http.ResponseWriter, r *http.Request) {
+	// Check if this was passed within Mattermost
+	authUserID := r.Header.Get("Mattermost-User-ID")
+	if authUserID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
 		return
 	}
 
-	p.API.LogInfo("Received Gmail Notification")
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		http.Error(w, "Site URL is not defined in the App", http.StatusInternalServerError)
+		return
+	}
+
+	response := &model.PostActionIntegrationResponse{
+		EphemeralText: fmt.Sprintf("[Click here to reconnect your Gmail account with Mattermost.](%s/plugins/%s/oauth/connect)", *siteURL, manifest.Id),
+	}
+
+	// The shared mailbox of a channel is reconnected by a channel admin
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request != nil {
+		if mailboxChannelID, ok := request.Context["mailboxChannelId"].(string); ok {
+			if errMessage := p.checkCanManageChannelMailbox(authUserID, mailboxChannelID); errMessage != "" {
+				response.EphemeralText = errMessage
+			} else {
+				response.EphemeralText = fmt.Sprintf("[Click here to reconnect the shared Gmail account with this channel.](%s/plugins/%s/oauth/connect?channel_id=%s)", *siteURL, manifest.Id, mailboxChannelID)
+			}
+		}
+	}
+	w.Write(response.ToJson())
+}
+
+// handleMessageAction runs the action of a button of the post of a mail in Gmail, and updates the post to show the new state of the mail
+func (p *Plugin) handleMessageAction(w http.ResponseWriter, r *http.Request) {
+	// Check if this was passed within Mattermost
+	authUserID := r.Header.Get("Mattermost-User-ID")
+	if authUserID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != authUserID {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	action, ownerID, messageID, ok := p.verifyMessageAction(request.Context)
+	if !ok {
+		http.Error(w, "Unauthorized or unknown message action detected", http.StatusForbidden)
+		return
+	}
+
+	post, appErr := p.API.GetPost(request.PostId)
+	if appErr != nil || post.GetProp(propGmailMessageID) != messageID || post.GetProp(propGmailOwnerID) != ownerID {
+		http.Error(w, "The post is not the one of the mail", http.StatusBadRequest)
+		return
+	}
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r.Body)
-	body := buf.String()
+	response := &model.PostActionIntegrationResponse{}
+	if errMessage := p.checkCanUseMailbox(authUserID, post.ChannelId, ownerID); errMessage != "" {
+		response.EphemeralText = errMessage
+		w.Write(response.ToJson())
+		return
+	}
 
-	var parsedBody map[string]interface{}
-	err := json.Unmarshal([]byte(body), &parsedBody)
+	selectedLabelID, _ := request.Context["selected_option"].(string)
+	labelIDs, err := p.modifyMessage(ownerID, messageID, action, selectedLabelID)
 	if err != nil {
-		http.Error(w, "Cannot unmarshal input json", http.StatusBadRequest)
+		p.API.LogError("Could not run the action on the mail", "action", action, "err", err.Error())
+		response.EphemeralText = "Unable to update the mail in Gmail: " + err.Error()
+		w.Write(response.ToJson())
 		return
 	}
 
-	requestMessage := parsedBody["message"].(map[string]interface{})
-	data := requestMessage["data"].(string)
-	decodedData, _ := p.decodeBase64URL(data)
+	if attachment := p.mailActionsAttachment(ownerID, messageID, labelIDs); attachment != nil {
+		post.SetProps(p.setMailAttachments(post.GetProps(), ownerID, labelIDs, attachment))
+		response.Update = post
+	}
 
-	var parsedData map[string]interface{}
-	json.Unmarshal([]byte(decodedData), &parsedData)
-	emailAddress := parsedData["emailAddress"].(string)
-	historyID := uint64(parsedData["historyId"].(float64))
-	userIDs, _ := p.getUsersForGmail(emailAddress)
+	// The other posts of the mail show its new state too
+	posts, err := p.getMailPosts(ownerID, messageID)
+	if err != nil {
+		p.API.LogError("Could not get the posts of the mail with ID: "+messageID, "err", err.Error())
+	} else if posts != nil {
+		posts.LabelIDs = labelIDs
+		if err = p.updateMailPosts(ownerID, messageID, posts, post.Id); err != nil {
+			p.API.LogError("Could not update the posts of the mail with ID: "+messageID, "err", err.Error())
+		}
+	}
+	w.Write(response.ToJson())
+}
 
-	p.API.LogInfo("Received Gmail notification for users connected to gmail ID: " + emailAddress)
+// importFromChooser imports the mail or the thread chosen among those matching `/gmail import`
+func (p *Plugin) importFromChooser(w http.ResponseWriter, r *http.Request) {
+	// Check if this was passed within Mattermost
+	authUserID := r.Header.Get("Mattermost-User-ID")
+	if authUserID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
 
-	if len(userIDs) < 1 {
-		p.API.LogInfo("No user connected to gmail ID: " + emailAddress)
-		w.WriteHeader(200)
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != authUserID {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	queryType, _ := request.Context["queryType"].(string)
+	id, _ := request.Context["id"].(string)
+	follow, _ := request.Context["follow"].(string)
+	signature, _ := request.Context["signature"].(string)
+	if (queryType != "thread" && queryType != "mail") || !p.verifyAction(signature, ActionImportChoice, authUserID, queryType, id, follow) {
+		http.Error(w, "Unauthorized or unknown import action detected", http.StatusForbidden)
 		return
 	}
 
-	p.API.LogInfo(fmt.Sprintf("%d users connected to gmail ID: %s", len(userIDs), emailAddress))
+	response := &model.PostActionIntegrationResponse{}
+	if p.checkIfConnected(authUserID) == false || p.isConnectionBroken(authUserID) {
+		response.EphemeralText = "Please connect yourself to Gmail using `/gmail connect`."
+		w.Write(response.ToJson())
+		return
+	}
+	if !p.canPostToChannel(authUserID, request.ChannelId) {
+		response.EphemeralText = "You cannot post in this channel."
+		w.Write(response.ToJson())
+		return
+	}
 
-	for _, userID := range userIDs {
-		p.API.LogInfo("Processing notification for userID: " + userID)
+	message, err := p.importFromGmail(authUserID, request.ChannelId, queryType, id, follow == "true")
+	if err != nil {
+		message = "Unable to import the " + queryType + ": " + err.Error()
+	}
+	if message == "" {
+		message = "The " + queryType + " has been imported."
+	}
+	p.API.UpdateEphemeralPost(authUserID, &model.Post{
+		Id:        request.PostId,
+		UserId:    p.gmailBotID,
+		ChannelId: request.ChannelId,
+		Message:   message,
+	})
+	w.Write(response.ToJson())
+}
 
-		gmailService, srvErr := p.getGmailService(userID)
-		if srvErr != nil {
-			p.API.LogError("Could not get gmail service for user with user ID: "+userID, "err", srvErr.Error())
-			continue
-		}
+// unfollowThreadFromList unfollows the Gmail thread of the button of the list of `/gmail following`, and updates the list
+func (p *Plugin) unfollowThreadFromList(w http.ResponseWriter, r *http.Request) {
+	// Check if this was passed within Mattermost
+	authUserID := r.Header.Get("Mattermost-User-ID")
+	if authUserID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
 
-		lastHistoryID, err := p.getHistoryIDForUser(userID)
-		if err != nil {
-			p.API.LogError("Could not fetch history details for user with user ID: "+userID, "err", err.Error())
-			continue
-		}
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != authUserID {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	channelID, _ := request.Context["channelId"].(string)
+	threadID, _ := request.Context["threadId"].(string)
+	signature, _ := request.Context["signature"].(string)
+	if !p.verifyAction(signature, ActionUnfollowThread, authUserID, channelID, threadID) {
+		http.Error(w, "Unauthorized or unknown unfollow action detected", http.StatusForbidden)
+		return
+	}
 
-		p.API.LogInfo("Fetching gmail messages using last used history ID: " + strconv.Itoa(int(lastHistoryID)))
-		historyResponse, histErr := gmailService.Users.History.List(emailAddress).StartHistoryId(lastHistoryID).Do()
-		if histErr != nil {
-			p.API.LogError("Could not fetch history response for user with user ID: "+userID, "err", histErr.Error())
-			continue
-		}
-		if len(historyResponse.History) < 1 {
-			p.API.LogInfo("Blank history response received for user with user ID: " + userID)
-			continue
-		}
+	response := &model.PostActionIntegrationResponse{}
+	if err := p.unfollowThread(authUserID, channelID, threadID); err != nil {
+		p.API.LogError("Could not unfollow the thread with ID: "+threadID, "err", err.Error())
+		response.EphemeralText = "Unable to unfollow the thread: " + err.Error()
+		w.Write(response.ToJson())
+		return
+	}
 
-		messages := []*gmail.Message{}
+	post, err := p.followingListPost(authUserID, request.ChannelId)
+	if err != nil {
+		response.EphemeralText = "The thread has been unfollowed."
+		w.Write(response.ToJson())
+		return
+	}
+	post.Id = request.PostId
+	p.API.UpdateEphemeralPost(authUserID, post)
+	w.Write(response.ToJson())
+}
 
-		for _, historyElement := range historyResponse.History {
-			for _, addedMessage := range historyElement.MessagesAdded {
-				message, _ := gmailService.Users.Messages.Get(emailAddress, addedMessage.Message.Id).Format("raw").Do()
-				messages = append(messages, message)
-			}
-		}
+// cancelImportFromPost cancels the bulk import of the button of its progress post
+func (p *Plugin) cancelImportFromPost(w http.ResponseWriter, r *http.Request) {
+	// Check if this was passed within Mattermost
+	authUserID := r.Header.Get("Mattermost-User-ID")
+	if authUserID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
 
-		p.API.LogInfo(fmt.Sprintf("%d messages received as a part of the notification, filtering based on user's subscriptions", len(messages)))
-		relevantMessages := p.getRelevantMessagesForUser(userID, messages)
-		if len(relevantMessages) < 1 {
-			p.API.LogInfo("No new relevant messages found for the user")
-			continue
-		}
-		p.API.LogInfo(fmt.Sprintf("%d messages relevant based on user's subscriptions", len(relevantMessages)))
-		directChannel, channelErr := p.API.GetDirectChannel(userID, p.gmailBotID)
-		if channelErr != nil {
-			p.API.LogError("Could not fetch direct channel for the user", "err", channelErr.Error())
-			continue
-		}
-		msgErr := p.handleMessages(relevantMessages, directChannel.Id, userID, true)
-		if msgErr != nil {
-			p.API.LogError("Message could not be posted to the user", "err", msgErr.Error())
-			continue
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != authUserID {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	jobID, _ := request.Context["jobId"].(string)
+	signature, _ := request.Context["signature"].(string)
+	if !p.verifyAction(signature, ActionCancelImport, jobID) {
+		http.Error(w, "Unauthorized or unknown cancel action detected", http.StatusForbidden)
+		return
+	}
+
+	response := &model.PostActionIntegrationResponse{}
+	if errMessage := p.cancelBulkImport(authUserID, jobID); errMessage != "" {
+		response.EphemeralText = errMessage
+	}
+	w.Write(response.ToJson())
+}
+
+// handleSearchResultAction imports a mail listed by `/gmail search`, or moves to another page of the list
+func (p *Plugin) handleSearchResultAction(w http.ResponseWriter, r *http.Request) {
+	// Check if this was passed within Mattermost
+	authUserID := r.Header.Get("Mattermost-User-ID")
+	if authUserID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != authUserID {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	response := &model.PostActionIntegrationResponse{}
+	if p.checkIfConnected(authUserID) == false || p.isConnectionBroken(authUserID) {
+		response.EphemeralText = "Please connect yourself to Gmail using `/gmail connect`."
+		w.Write(response.ToJson())
+		return
+	}
+
+	post, message, err := p.handleSearchAction(authUserID, request.ChannelId, request.Context)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if post != nil {
+		post.Id = request.PostId
+		p.API.UpdateEphemeralPost(authUserID, post)
+	}
+	response.EphemeralText = message
+	w.Write(response.ToJson())
+}
+
+// confirmForwardThread sends or cancels the mail of a thread previewed by `/gmail forward-thread`
+func (p *Plugin) confirmForwardThread(w http.ResponseWriter, r *http.Request) {
+	// Check if this was passed within Mattermost
+	authUserID := r.Header.Get("Mattermost-User-ID")
+	if authUserID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil || request.UserId != authUserID {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	action, _ := request.Context["action"].(string)
+	postID, _ := request.Context["postId"].(string)
+	to, _ := request.Context["to"].(string)
+	lastPostAtContext, _ := request.Context["lastPostAt"].(string)
+	signature, _ := request.Context["signature"].(string)
+	if !p.verifyAction(signature, action, authUserID, postID, to, lastPostAtContext) {
+		http.Error(w, "Unauthorized or unknown forward action detected", http.StatusForbidden)
+		return
+	}
+
+	updatePreview := func(message string) {
+		p.API.UpdateEphemeralPost(authUserID, &model.Post{
+			Id:        request.PostId,
+			UserId:    p.gmailBotID,
+			ChannelId: request.ChannelId,
+			Message:   message,
+		})
+	}
+
+	switch action {
+	case ActionCancel:
+		updatePreview("Emailing the thread cancelled.")
+	case ActionForwardThread:
+		lastPostAt, _ := strconv.ParseInt(lastPostAtContext, 10, 64)
+
+		if p.checkIfConnected(authUserID) == false || p.isConnectionBroken(authUserID) {
+			updatePreview("Please connect yourself to Gmail using `/gmail connect`.")
+			return
 		}
-		p.API.LogInfo("Updating history ID for the user to " + strconv.Itoa(int(historyID)))
-		updateErr := p.updateHistoryIDForUser(historyID, userID)
-		if updateErr != nil {
-			p.API.LogError("Could not update history ID for the user", "err", updateErr.Error())
-			continue
+		recipients, err := p.forwardThread(authUserID, postID, to, lastPostAt)
+		if err != nil {
+			p.API.LogError("Could not email the thread", "err", err.Error())
+			updatePreview("Unable to email the thread: " + err.Error())
+			return
 		}
-		p.API.LogInfo("History ID updated for the user")
+		updatePreview(":email: The thread has been sent to " + strings.Join(recipients, ", ") + ".")
+	default:
+		http.Error(w, "Unknown forward action detected", http.StatusBadRequest)
+	}
+}
 
+// submitSendDialog sends the mail composed in the dialog opened by `/gmail send`
+func (p *Plugin) submitSendDialog(w http.ResponseWriter, r *http.Request) {
+	// Check if this was passed within Mattermost
+	authUserID := r.Header.Get("Mattermost-User-ID")
+	if authUserID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	request := model.SubmitDialogRequestFromJson(r.Body)
+	if request == nil || request.UserId != authUserID || request.CallbackId != sendDialogCallbackID {
+		http.Error(w, "Invalid dialog submission", http.StatusBadRequest)
+		return
+	}
+	if request.Cancelled {
+		return
+	}
+
+	if p.checkIfConnected(authUserID) == false || p.isConnectionBroken(authUserID) {
+		w.Write((&model.SubmitDialogResponse{Error: "Please connect yourself to Gmail using /gmail connect."}).ToJson())
+		return
+	}
+
+	sentMail, fieldErrors, err := p.sendMailFromDialog(request)
+	if err != nil {
+		p.API.LogError("Could not send the mail composed in the dialog", "err", err.Error())
+		w.Write((&model.SubmitDialogResponse{Error: "Your mail could not be sent: " + err.Error()}).ToJson())
+		return
+	}
+	if len(fieldErrors) > 0 {
+		w.Write((&model.SubmitDialogResponse{Errors: fieldErrors}).ToJson())
+		return
+	}
+
+	recipients := append(append(append([]string{}, sentMail.To...), sentMail.Cc...), sentMail.Bcc...)
+	var state sendDialogState
+	json.Unmarshal([]byte(request.State), &state)
+	p.API.SendEphemeralPost(authUserID, &model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: request.ChannelId,
+		RootId:    state.RootID,
+		Message:   ":email: Mail **" + sentMail.Subject + "** sent to " + strings.Join(recipients, ", ") + ".",
+	})
+	w.Write((&model.SubmitDialogResponse{}).ToJson())
+}
+
+// pubsubPushRequest is the body of a request pushed by a Pub/Sub subscription
+type pubsubPushRequest struct {
+	Message struct {
+		Data        string    `json:"data"`
+		MessageID   string    `json:"messageId"`
+		PublishTime time.Time `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+func (p *Plugin) sendMailNotification(w http.ResponseWriter, r *http.Request) {
+	// If the body isn't of type json, then reject
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		p.API.LogInfo("Body type not json: " + contentType)
+		http.Error(w, "Content types don't match", http.StatusBadRequest)
+		return
+	}
+
+	if authErr := p.authenticatePushRequest(r); authErr != nil {
+		p.API.LogWarn("Rejected unauthenticated Gmail notification", "err", authErr.Error())
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	p.API.LogInfo("Received Gmail Notification")
+
+	var pushRequest pubsubPushRequest
+	err := json.NewDecoder(r.Body).Decode(&pushRequest)
+	if err != nil {
+		http.Error(w, "Cannot unmarshal input json", http.StatusBadRequest)
+		return
+	}
+
+	// Stale and replayed messages are acknowledged so that Pub/Sub stops delivering them
+	fresh, freshErr := p.checkPubsubMessageIsFresh(pushRequest.Message.MessageID, pushRequest.Message.PublishTime)
+	if freshErr != nil {
+		p.API.LogError("Could not check if the Gmail notification was received before", "err", freshErr.Error())
+		http.Error(w, "Could not record the notification", http.StatusInternalServerError)
+		return
+	}
+	if !fresh {
+		w.WriteHeader(200)
+		return
+	}
+
+	decodedData, err := p.decodeBase64URL(pushRequest.Message.Data)
+	if err != nil {
+		http.Error(w, "Cannot decode message data", http.StatusBadRequest)
+		return
+	}
+
+	var notification gmailNotification
+	err = json.Unmarshal([]byte(decodedData), &notification)
+	if err != nil || notification.EmailAddress == "" {
+		http.Error(w, "Cannot unmarshal message data", http.StatusBadRequest)
+		return
+	}
+	p.API.LogInfo("Received Gmail notification for users connected to gmail ID: " + notification.EmailAddress)
+
+	// The notification is processed in the background so that Pub/Sub gets acknowledged right away
+	if queueErr := p.enqueueGmailNotification(&notification); queueErr != nil {
+		p.API.LogError("Gmail notification could not be queued", "err", queueErr.Error())
+		p.forgetPubsubMessage(pushRequest.Message.MessageID)
+		http.Error(w, "Could not queue the notification", http.StatusInternalServerError)
+		return
 	}
-	p.API.LogInfo(fmt.Sprintf("Processed notifications for %d users", len(userIDs)))
 	w.WriteHeader(200)
-	return
 }
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// ActionCancelImport is used in Post action to identify the button cancelling a bulk import
+	ActionCancelImport = "ActionCancelImport"
+
+	// bulkImportDefaultLimit is the number of mails imported when no limit is given
+	bulkImportDefaultLimit = 100
+
+	// bulkImportMaxLimit bounds the number of mails imported by a job
+	bulkImportMaxLimit = 500
+
+	// bulkImportMaxListed bounds the search results read to find the oldest mails
+	bulkImportMaxListed = 5000
+
+	// bulkImportItemDelay spaces the imported mails to stay within the Gmail API quota
+	bulkImportItemDelay = 250 * time.Millisecond
+
+	// bulkImportProgressEvery is how many mails are imported between two updates of the progress post
+	bulkImportProgressEvery = 5
+
+	// bulkImportPollInterval is how often the jobs are checked when there is nothing to import
+	bulkImportPollInterval = 30 * time.Second
+
+	// bulkImportListRetryDelay is the delay before listing the mails of a job again after a first failure. It doubles
+	// after each failure.
+	bulkImportListRetryDelay = bulkImportPollInterval
+
+	// bulkImportMaxListAttempts is the number of failed listings of the mails of a job after which it is stopped
+	bulkImportMaxListAttempts = 5
+
+	// bulkImportLockExpiry frees the lock of a job whose server stopped while running one of its steps
+	bulkImportLockExpiry = 5 * time.Minute
+
+	bulkImportJobsKey = "bulkImportJobs"
+)
+
+// statuses of the bulk import jobs
+const (
+	bulkImportRunning   = "running"
+	bulkImportCancelled = "cancelled"
+)
+
+// bulkImportJob imports the mails, or the threads, matching a Gmail search query into a channel, in the background.
+// Its progress is stored so that it resumes after a restart of the plugin.
+type bulkImportJob struct {
+	ID        string
+	UserID    string
+	ChannelID string
+	Query     string
+	Limit     int
+	Oldest    bool
+	Threads   bool
+	Status    string
+	// IDs are the messages, or the threads, to import, in the order they are imported. Nil until they are listed.
+	IDs            []string
+	Next           int
+	Imported       int
+	Failed         int
+	ProgressPostID string
+	CreatedAt      int64
+	// ListFailures counts the failed listings of the mails, which are attempted again from NextAttemptAt
+	ListFailures  int
+	NextAttemptAt int64
+	// Error tells why the job was stopped, when it was not cancelled by a user
+	Error string
+}
+
+// updateBulkImportJobs applies the update to the stored jobs using compare-and-set, retrying if they were modified concurrently
+func (p *Plugin) updateBulkImportJobs(update func(jobs []*bulkImportJob) []*bulkImportJob) error {
+	for attempt := 0; attempt < queueMaxRetries; attempt++ {
+		storedJobs, appErr := p.API.KVGet(bulkImportJobsKey)
+		if appErr != nil {
+			return appErr
+		}
+
+		jobs := []*bulkImportJob{}
+		if storedJobs != nil {
+			if err := json.Unmarshal(storedJobs, &jobs); err != nil {
+				return err
+			}
+		}
+
+		updatedJobs, err := json.Marshal(update(jobs))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(updatedJobs, storedJobs) {
+			return nil
+		}
+
+		updated, appErr := p.API.KVCompareAndSet(bulkImportJobsKey, storedJobs, updatedJobs)
+		if appErr != nil {
+			return appErr
+		}
+		if updated {
+			return nil
+		}
+	}
+	return errors.New("Could not update the bulk import jobs, too many concurrent updates")
+}
+
+// getBulkImportJobs returns the stored jobs
+func (p *Plugin) getBulkImportJobs() ([]*bulkImportJob, error) {
+	jobs := []*bulkImportJob{}
+	storedJobs, appErr := p.API.KVGet(bulkImportJobsKey)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if storedJobs == nil {
+		return jobs, nil
+	}
+	if err := json.Unmarshal(storedJobs, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// updateBulkImportJob applies the update to the stored job with the ID. The update is not called if the job is gone.
+func (p *Plugin) updateBulkImportJob(jobID string, update func(job *bulkImportJob)) error {
+	return p.updateBulkImportJobs(func(jobs []*bulkImportJob) []*bulkImportJob {
+		for _, job := range jobs {
+			if job.ID == jobID {
+				update(job)
+			}
+		}
+		return jobs
+	})
+}
+
+// removeBulkImportJob forgets the finished job
+func (p *Plugin) removeBulkImportJob(jobID string) error {
+	return p.updateBulkImportJobs(func(jobs []*bulkImportJob) []*bulkImportJob {
+		remainJobs := []*bulkImportJob{}
+		for _, job := range jobs {
+			if job.ID != jobID {
+				remainJobs = append(remainJobs, job)
+			}
+		}
+		return remainJobs
+	})
+}
+
+// handleImportSearchCommand starts a background job importing the mails matching a Gmail search query into the channel
+func (p *Plugin) handleImportSearchCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	// `/gmail import search "<query>" [--limit N] [--order oldest|newest] [--threads]`
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args.Command), "/"+commandGmail))
+	text = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(text, "import")), "search"))
+	query, options := parseCommandOptions(text, "--limit", "--order", "--threads")
+	query = trimQuotes(query)
+	if query == "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please specify a Gmail search query, for eg. `/"+commandGmail+" import search \"from:vendor.com after:2020/07/01 before:2020/10/01\" --limit 200 --order oldest`.")
+		return &model.CommandResponse{}, nil
+	}
+
+	limit := bulkImportDefaultLimit
+	if value, ok := options["--limit"]; ok {
+		parsedLimit, err := strconv.Atoi(value)
+		if err != nil || parsedLimit < 1 || parsedLimit > bulkImportMaxLimit {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, fmt.Sprintf("Please give a limit between 1 and %d.", bulkImportMaxLimit))
+			return &model.CommandResponse{}, nil
+		}
+		limit = parsedLimit
+	}
+	order := strings.ToLower(options["--order"])
+	if order != "" && order != "oldest" && order != "newest" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please use `--order oldest` or `--order newest`.")
+		return &model.CommandResponse{}, nil
+	}
+	_, threads := options["--threads"]
+
+	if !p.canPostToChannel(args.UserId, args.ChannelId) {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You cannot post in this channel.")
+		return &model.CommandResponse{}, nil
+	}
+
+	// Check the query with Gmail before starting the job
+	gmailID, err := p.getGmailID(args.UserId)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	gmailService, err := p.getGmailService(args.UserId)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	if _, err = gmailService.Users.Messages.List(gmailID).Q(query).MaxResults(1).Do(); err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Gmail could not run the query: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+
+	job := &bulkImportJob{
+		ID:        model.NewId(),
+		UserID:    args.UserId,
+		ChannelID: args.ChannelId,
+		Query:     query,
+		Limit:     limit,
+		Oldest:    order == "oldest",
+		Threads:   threads,
+		Status:    bulkImportRunning,
+		CreatedAt: model.GetMillis(),
+	}
+
+	alreadyRunning := false
+	err = p.updateBulkImportJobs(func(jobs []*bulkImportJob) []*bulkImportJob {
+		alreadyRunning = false
+		for _, storedJob := range jobs {
+			if storedJob.UserID == args.UserId {
+				alreadyRunning = true
+				return jobs
+			}
+		}
+		return append(jobs, job)
+	})
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to start the import: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	if alreadyRunning {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "An import of yours is already running. Please wait for it to complete or cancel it.")
+		return &model.CommandResponse{}, nil
+	}
+
+	progressPost, appErr := p.API.CreatePost(p.bulkImportProgressPost(job))
+	if appErr != nil {
+		p.API.LogError("Could not post the progress of the bulk import", "err", appErr.Error())
+	} else {
+		if err = p.updateBulkImportJob(job.ID, func(storedJob *bulkImportJob) { storedJob.ProgressPostID = progressPost.Id }); err != nil {
+			p.API.LogError("Could not record the progress post of the bulk import", "err", err.Error())
+		}
+	}
+
+	p.wakeUpBulkImports()
+	return &model.CommandResponse{}, nil
+}
+
+// bulkImportProgressPost returns the post showing the progress of the job, with a button to cancel it while it runs
+func (p *Plugin) bulkImportProgressPost(job *bulkImportJob) *model.Post {
+	kind := "mails"
+	if job.Threads {
+		kind = "threads"
+	}
+
+	attachment := &model.SlackAttachment{
+		Title: "Importing " + kind + " from Gmail",
+		Fields: []*model.SlackAttachmentField{
+			{Title: "Query", Value: "`" + job.Query + "`"},
+		},
+	}
+	switch {
+	case job.Error != "":
+		attachment.Text = fmt.Sprintf(":warning: Import stopped after %d %s: %s", job.Imported, kind, job.Error)
+	case job.Status == bulkImportCancelled:
+		attachment.Text = fmt.Sprintf(":no_entry_sign: Import cancelled after %d %s.", job.Imported, kind)
+	case job.IDs == nil && job.ListFailures > 0:
+		attachment.Text = fmt.Sprintf(":hourglass_flowing_sand: Searching Gmail… Gmail could not run the query, attempt %d of %d.", job.ListFailures+1, bulkImportMaxListAttempts)
+	case job.IDs == nil:
+		attachment.Text = ":hourglass_flowing_sand: Searching Gmail…"
+	case job.Next >= len(job.IDs):
+		attachment.Text = fmt.Sprintf(":white_check_mark: Import complete: %d %s imported.", job.Imported, kind)
+	default:
+		attachment.Text = fmt.Sprintf(":hourglass_flowing_sand: %d of %d %s imported…", job.Imported, len(job.IDs), kind)
+	}
+	if job.Failed > 0 {
+		attachment.Text += fmt.Sprintf(" %d could not be imported.", job.Failed)
+	}
+
+	if siteURL := p.API.GetConfig().ServiceSettings.SiteURL; siteURL != nil && job.Status == bulkImportRunning && (job.IDs == nil || job.Next < len(job.IDs)) {
+		attachment.Actions = []*model.PostAction{{
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Name: "Cancel",
+			Integration: &model.PostActionIntegration{
+				URL: fmt.Sprintf("%s/plugins/%s/command/cancelimport", *siteURL, manifest.Id),
+				Context: map[string]interface{}{
+					"action":    ActionCancelImport,
+					"jobId":     job.ID,
+					"signature": p.signAction(ActionCancelImport, job.ID),
+				},
+			},
+		}}
+	}
+
+	post := &model.Post{
+		Id:        job.ProgressPostID,
+		UserId:    p.gmailBotID,
+		ChannelId: job.ChannelID,
+	}
+	post.AddProp("attachments", []*model.SlackAttachment{attachment})
+	return post
+}
+
+// updateBulkImportProgress edits the progress post of the job
+func (p *Plugin) updateBulkImportProgress(job *bulkImportJob) {
+	if job.ProgressPostID == "" {
+		return
+	}
+	if _, appErr := p.API.UpdatePost(p.bulkImportProgressPost(job)); appErr != nil {
+		p.API.LogError("Could not update the progress of the bulk import", "err", appErr.Error())
+	}
+}
+
+// cancelBulkImport stops the job, if the user started it or is an admin of its channel. It returns an error message for the user.
+func (p *Plugin) cancelBulkImport(userID string, jobID string) string {
+	var cancelled *bulkImportJob
+	errMessage := "This import is already finished."
+	err := p.updateBulkImportJob(jobID, func(job *bulkImportJob) {
+		if job.UserID != userID && !p.isChannelAdmin(userID, job.ChannelID) {
+			errMessage = "Only the user who started the import, or a channel admin, can cancel it."
+			return
+		}
+		job.Status = bulkImportCancelled
+		cancelled = job
+		errMessage = ""
+	})
+	if err != nil {
+		return "Unable to cancel the import: " + err.Error()
+	}
+	if cancelled == nil {
+		return errMessage
+	}
+
+	p.updateBulkImportProgress(cancelled)
+	if err = p.removeBulkImportJob(jobID); err != nil {
+		p.API.LogError("Could not remove the cancelled bulk import", "err", err.Error())
+	}
+	return ""
+}
+
+// startBulkImports starts the background job running the bulk imports, resuming those stopped by a restart
+func (p *Plugin) startBulkImports() {
+	p.bulkImportStop = make(chan struct{})
+	p.bulkImportDone = make(chan struct{})
+	p.bulkImportWakeUp = make(chan struct{}, 1)
+
+	go func(stop <-chan struct{}, done chan<- struct{}, wakeUp <-chan struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(bulkImportPollInterval)
+		defer ticker.Stop()
+
+		for {
+			p.runBulkImports(stop)
+
+			select {
+			case <-stop:
+				return
+			case <-wakeUp:
+			case <-ticker.C:
+			}
+		}
+	}(p.bulkImportStop, p.bulkImportDone, p.bulkImportWakeUp)
+}
+
+// stopBulkImports stops the bulk imports and waits for the mail being imported. Their progress is kept for the next start.
+func (p *Plugin) stopBulkImports() {
+	if p.bulkImportStop == nil {
+		return
+	}
+	close(p.bulkImportStop)
+	<-p.bulkImportDone
+	p.bulkImportStop = nil
+}
+
+// wakeUpBulkImports makes the background job look for new bulk imports
+func (p *Plugin) wakeUpBulkImports() {
+	p.workersLock.Lock()
+	defer p.workersLock.Unlock()
+
+	if p.bulkImportWakeUp == nil {
+		return
+	}
+	select {
+	case p.bulkImportWakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// runBulkImports runs the stored jobs until they are all finished, one mail of each job at a time. The jobs waiting
+// to list their mails again are left to a later run.
+func (p *Plugin) runBulkImports(stop <-chan struct{}) {
+	for {
+		jobs, err := p.getBulkImportJobs()
+		if err != nil {
+			p.API.LogError("Could not read the bulk import jobs", "err", err.Error())
+			return
+		}
+
+		dueJobs := []*bulkImportJob{}
+		now := model.GetMillis()
+		for _, job := range jobs {
+			if job.NextAttemptAt <= now {
+				dueJobs = append(dueJobs, job)
+			}
+		}
+		if len(dueJobs) == 0 {
+			return
+		}
+
+		for _, job := range dueJobs {
+			select {
+			case <-stop:
+				return
+			case <-time.After(bulkImportItemDelay):
+			}
+			p.runBulkImportStepLocked(job.ID)
+		}
+	}
+}
+
+// runBulkImportStepLocked runs the next step of the job, unless another server of the cluster is running one
+func (p *Plugin) runBulkImportStepLocked(jobID string) {
+	unlock, err := p.tryLock("bulkImport_"+jobID, bulkImportLockExpiry)
+	if err != nil {
+		p.API.LogError("Could not lock the bulk import", "err", err.Error())
+		return
+	}
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	// Read under the lock, as another server may just have run a step of the job
+	jobs, err := p.getBulkImportJobs()
+	if err != nil {
+		p.API.LogError("Could not read the bulk import jobs", "err", err.Error())
+		return
+	}
+	for _, job := range jobs {
+		if job.ID == jobID && job.NextAttemptAt <= model.GetMillis() {
+			p.runBulkImportStep(job)
+		}
+	}
+}
+
+// runBulkImportStep lists the mails of the job if not done yet, or imports its next mail, and records its progress
+func (p *Plugin) runBulkImportStep(job *bulkImportJob) {
+	if job.Status != bulkImportRunning {
+		return
+	}
+
+	gmailID, err := p.getGmailID(job.UserID)
+	var gmailService *gmail.Service
+	if err == nil {
+		gmailService, err = p.getGmailService(job.UserID)
+	}
+	if err != nil || p.isConnectionBroken(job.UserID) {
+		// The user disconnected Gmail, or revoked the access of the plugin
+		p.API.LogError("Stopping the bulk import of user with user ID: " + job.UserID + " who is no longer connected to Gmail")
+		job.Status = bulkImportCancelled
+		p.updateBulkImportProgress(job)
+		if err = p.removeBulkImportJob(job.ID); err != nil {
+			p.API.LogError("Could not remove the bulk import", "err", err.Error())
+		}
+		return
+	}
+
+	if job.IDs == nil {
+		ids, err := listBulkImportIDs(gmailService, gmailID, job)
+		if err != nil {
+			p.API.LogError("Could not list the mails of the bulk import", "err", err.Error())
+			p.recordBulkImportListFailure(job, err)
+			return
+		}
+		err = p.updateBulkImportJob(job.ID, func(storedJob *bulkImportJob) {
+			storedJob.IDs = ids
+			*job = *storedJob
+		})
+		if err != nil {
+			p.API.LogError("Could not record the mails of the bulk import", "err", err.Error())
+			return
+		}
+		p.updateBulkImportProgress(job)
+	} else if job.Next < len(job.IDs) {
+		id := job.IDs[job.Next]
+		if job.Threads {
+			_, err = p.importThread(job.UserID, job.ChannelID, gmailService, gmailID, id)
+		} else {
+			var message *gmail.Message
+			if message, err = gmailService.Users.Messages.Get(gmailID, id).Format("raw").Do(); err == nil {
+				err = p.handleMessages([]*gmail.Message{message}, job.ChannelID, job.UserID, false)
+			}
+		}
+		if err != nil {
+			p.API.LogError("Could not import the mail with ID: "+id, "err", err.Error())
+		}
+
+		imported := err == nil
+		stillRunning := false
+		updateErr := p.updateBulkImportJob(job.ID, func(storedJob *bulkImportJob) {
+			stillRunning = storedJob.Status == bulkImportRunning
+			if !stillRunning {
+				return
+			}
+			storedJob.Next++
+			if imported {
+				storedJob.Imported++
+			} else {
+				storedJob.Failed++
+			}
+			*job = *storedJob
+		})
+		if updateErr != nil {
+			p.API.LogError("Could not record the progress of the bulk import", "err", updateErr.Error())
+			return
+		}
+		// Cancelled while the mail was imported
+		if !stillRunning {
+			return
+		}
+		if job.Next%bulkImportProgressEvery == 0 || job.Next >= len(job.IDs) {
+			p.updateBulkImportProgress(job)
+		}
+	}
+
+	if job.IDs != nil && job.Next >= len(job.IDs) {
+		if err = p.removeBulkImportJob(job.ID); err != nil {
+			p.API.LogError("Could not remove the finished bulk import", "err", err.Error())
+		}
+	}
+}
+
+// recordBulkImportListFailure counts the failed listing of the mails of the job and delays the next attempt. The job is
+// stopped after too many failures, so that a query Gmail keeps rejecting is not run again forever.
+func (p *Plugin) recordBulkImportListFailure(job *bulkImportJob, listErr error) {
+	stillRunning := false
+	err := p.updateBulkImportJob(job.ID, func(storedJob *bulkImportJob) {
+		stillRunning = storedJob.Status == bulkImportRunning
+		if !stillRunning {
+			return
+		}
+		storedJob.ListFailures++
+		if storedJob.ListFailures >= bulkImportMaxListAttempts {
+			storedJob.Status = bulkImportCancelled
+			storedJob.Error = "Gmail could not run the query: " + listErr.Error()
+		} else {
+			retryDelay := bulkImportListRetryDelay << uint(storedJob.ListFailures-1)
+			storedJob.NextAttemptAt = model.GetMillis() + int64(retryDelay/time.Millisecond)
+		}
+		*job = *storedJob
+	})
+	if err != nil {
+		p.API.LogError("Could not record the failure of the bulk import", "err", err.Error())
+		return
+	}
+	// Cancelled while the mails were listed
+	if !stillRunning {
+		return
+	}
+
+	p.updateBulkImportProgress(job)
+	if job.Status == bulkImportCancelled {
+		p.API.LogError("Stopping the bulk import of user with user ID: "+job.UserID+" after too many failures", "err", job.Error)
+		if err = p.removeBulkImportJob(job.ID); err != nil {
+			p.API.LogError("Could not remove the bulk import", "err", err.Error())
+		}
+	}
+}
+
+// listBulkImportIDs returns the messages, or the threads, matching the query of the job, in the order they are imported
+func listBulkImportIDs(gmailService *gmail.Service, gmailID string, job *bulkImportJob) ([]string, error) {
+	ids := []string{}
+	seen := map[string]bool{}
+	// The oldest mails are the last results, all of them are read up to a bound
+	maxListed := job.Limit
+	if job.Oldest {
+		maxListed = bulkImportMaxListed
+	}
+
+	pageToken := ""
+	for len(ids) < maxListed {
+		listCall := gmailService.Users.Messages.List(gmailID).Q(job.Query).MaxResults(bulkImportMaxLimit)
+		if pageToken != "" {
+			listCall = listCall.PageToken(pageToken)
+		}
+		listResponse, err := listCall.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range listResponse.Messages {
+			id := message.Id
+			if job.Threads {
+				id = message.ThreadId
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		pageToken = listResponse.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+
+	// Results are listed newest first
+	if job.Oldest {
+		if len(ids) > maxListed {
+			ids = ids[:maxListed]
+		}
+		for left, right := 0, len(ids)-1; left < right; left, right = left+1, right-1 {
+			ids[left], ids[right] = ids[right], ids[left]
+		}
+	}
+	if len(ids) > job.Limit {
+		ids = ids[:job.Limit]
+	}
+	return ids, nil
+}
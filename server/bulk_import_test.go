@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordBulkImportListFailure(t *testing.T) {
+	for name, test := range map[string]struct {
+		status             string
+		listFailures       int
+		expectListFailures int
+		expectRetryDelay   time.Duration
+		expectStopped      bool
+		expectProgress     bool
+	}{
+		"first failure": {
+			status:             bulkImportRunning,
+			expectListFailures: 1,
+			expectRetryDelay:   bulkImportListRetryDelay,
+			expectProgress:     true,
+		},
+		"delay doubles after each failure": {
+			status:             bulkImportRunning,
+			listFailures:       3,
+			expectListFailures: 4,
+			expectRetryDelay:   8 * bulkImportListRetryDelay,
+			expectProgress:     true,
+		},
+		"stopped after the last attempt": {
+			status:         bulkImportRunning,
+			listFailures:   bulkImportMaxListAttempts - 1,
+			expectStopped:  true,
+			expectProgress: true,
+		},
+		"cancelled while the mails were listed": {
+			status:       bulkImportCancelled,
+			listFailures: 1,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			job := &bulkImportJob{
+				ID:             "job-id",
+				UserID:         "user-id",
+				ChannelID:      "channel-id",
+				Query:          "from:vendor.com",
+				Status:         test.status,
+				ListFailures:   test.listFailures,
+				ProgressPostID: "progress-post-id",
+			}
+			storedJobs, err := json.Marshal([]*bulkImportJob{job})
+			require.NoError(t, err)
+
+			api := &plugintest.API{}
+			api.On("KVGet", bulkImportJobsKey).Return(func(string) []byte { return storedJobs }, nil)
+			api.On("KVCompareAndSet", bulkImportJobsKey, mock.Anything, mock.Anything).Return(func(_ string, _ []byte, newValue []byte) bool {
+				storedJobs = newValue
+				return true
+			}, nil)
+			api.On("GetConfig").Return(&model.Config{})
+			api.On("UpdatePost", mock.Anything).Return(&model.Post{}, nil)
+			api.On("LogError", mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			p.setConfiguration(&configuration{})
+
+			before := model.GetMillis()
+			p.recordBulkImportListFailure(job, errors.New("quota exceeded"))
+
+			if test.expectProgress {
+				api.AssertNumberOfCalls(t, "UpdatePost", 1)
+			} else {
+				api.AssertNotCalled(t, "UpdatePost", mock.Anything)
+			}
+
+			jobs := []*bulkImportJob{}
+			require.NoError(t, json.Unmarshal(storedJobs, &jobs))
+			if test.expectStopped {
+				assert.Empty(t, jobs)
+				assert.Equal(t, bulkImportCancelled, job.Status)
+				assert.Equal(t, "Gmail could not run the query: quota exceeded", job.Error)
+				return
+			}
+
+			require.Len(t, jobs, 1)
+			assert.Equal(t, test.status, jobs[0].Status)
+			assert.Empty(t, jobs[0].Error)
+			if test.expectListFailures == 0 {
+				assert.Equal(t, test.listFailures, jobs[0].ListFailures)
+				assert.Zero(t, jobs[0].NextAttemptAt)
+				return
+			}
+			assert.Equal(t, test.expectListFailures, jobs[0].ListFailures)
+			retryDelay := int64(test.expectRetryDelay / time.Millisecond)
+			assert.True(t, jobs[0].NextAttemptAt >= before+retryDelay && jobs[0].NextAttemptAt <= model.GetMillis()+retryDelay)
+		})
+	}
+}
+
+func TestRunBulkImportStepLocked(t *testing.T) {
+	for name, test := range map[string]struct {
+		lockedElsewhere bool
+		nextAttemptAt   int64
+		expectRun       bool
+	}{
+		"step run by another server": {
+			lockedElsewhere: true,
+		},
+		"job delayed by another server": {
+			nextAttemptAt: model.GetMillis() + 60*1000,
+		},
+		"step run by this server": {
+			expectRun: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			store := mockKVStore(api)
+			mockLogs(api)
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			p.setConfiguration(&configuration{})
+			storedJobs, err := json.Marshal([]*bulkImportJob{{ID: "job-id", UserID: "user-id", Status: bulkImportRunning, NextAttemptAt: test.nextAttemptAt}})
+			require.NoError(t, err)
+			store.set(bulkImportJobsKey, storedJobs)
+			if test.lockedElsewhere {
+				store.set(lockKeyPrefix+"bulkImport_job-id", []byte("other-server"))
+			}
+
+			// The user has no Gmail ID stored, so running the step stops the job
+			p.runBulkImportStepLocked("job-id")
+
+			jobs, err := p.getBulkImportJobs()
+			require.NoError(t, err)
+			if test.expectRun {
+				assert.Empty(t, jobs)
+				assert.Nil(t, store.get(lockKeyPrefix+"bulkImport_job-id"))
+			} else {
+				assert.Len(t, jobs, 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// channelMailboxPrefix starts the owner IDs of the mailboxes connected to channels.
+// A channel mailbox is stored like the mailbox of a user, using the owner ID in place of the user ID.
+const channelMailboxPrefix = "ch_"
+
+// channelMailbox records who connected a shared mailbox to a channel
+type channelMailbox struct {
+	ChannelID   string
+	ConnectedBy string
+	ConnectedAt int64
+}
+
+// channelMailboxOwnerID returns the owner ID of the mailbox connected to the channel
+func channelMailboxOwnerID(channelID string) string {
+	return channelMailboxPrefix + channelID
+}
+
+// isChannelMailbox tells if the owner ID is the one of a mailbox connected to a channel
+func isChannelMailbox(ownerID string) bool {
+	return strings.HasPrefix(ownerID, channelMailboxPrefix)
+}
+
+// channelIDOfMailbox returns the channel a channel mailbox is connected to
+func channelIDOfMailbox(ownerID string) string {
+	return strings.TrimPrefix(ownerID, channelMailboxPrefix)
+}
+
+// getChannelMailbox returns the record of the mailbox connected to the channel, or nil if there is none
+func (p *Plugin) getChannelMailbox(channelID string) (*channelMailbox, error) {
+	storedMailbox, appErr := p.API.KVGet(channelMailboxOwnerID(channelID) + "channelMailbox")
+	if appErr != nil {
+		return nil, appErr
+	}
+	if storedMailbox == nil {
+		return nil, nil
+	}
+
+	mailbox := &channelMailbox{}
+	if err := json.Unmarshal(storedMailbox, mailbox); err != nil {
+		return nil, err
+	}
+	return mailbox, nil
+}
+
+// storeChannelMailbox stores the record of the mailbox connected to the channel
+func (p *Plugin) storeChannelMailbox(mailbox *channelMailbox) error {
+	mailboxJSON, err := json.Marshal(mailbox)
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(channelMailboxOwnerID(mailbox.ChannelID)+"channelMailbox", mailboxJSON); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// connectChannelMailbox connects the mailbox authorized by the channel admin to the channel. The mailbox belongs to
+// the channel, so that it keeps working when the admin who authorized it leaves.
+func (p *Plugin) connectChannelMailbox(channelID string, userID string, token *oauth2.Token) error {
+	if errMessage := p.checkCanManageChannelMailbox(userID, channelID); errMessage != "" {
+		return errors.New(errMessage)
+	}
+
+	ownerID := channelMailboxOwnerID(channelID)
+	p.API.LogInfo("Starting to onboard the shared mailbox of channel with channel ID: " + channelID)
+	if err := p.onboardUser(ownerID, token); err != nil {
+		return err
+	}
+
+	err := p.storeChannelMailbox(&channelMailbox{
+		ChannelID:   channelID,
+		ConnectedBy: userID,
+		ConnectedAt: model.GetMillis(),
+	})
+	if err != nil {
+		return err
+	}
+	p.API.LogInfo("Onboarding completed successfully for the shared mailbox of channel with channel ID: " + channelID)
+
+	gmailID, _ := p.getGmailID(ownerID)
+	connectedBy := "A channel admin"
+	if user, appErr := p.API.GetUser(userID); appErr == nil {
+		connectedBy = "@" + user.Username
+	}
+	message := "#### Shared Gmail account connected\n" +
+		connectedBy + " connected the Gmail account **" + gmailID + "** to this channel. New mails of its inbox will be posted here.\n" +
+		"Channel admins can change its subscriptions using `/gmail subscribe --shared <labels>` and `/gmail unsubscribe --shared <labels>`. " +
+		"Use `/gmail subscriptions --shared` to list them."
+	if _, err = p.sendMessageFromBot(channelID, "", false, message); err != nil {
+		p.API.LogError("Could not post the welcome message of the shared mailbox", "err", err.Error())
+	}
+	return nil
+}
+
+// getMailboxChannelID returns the channel where the mails of the mailbox are posted: the channel of a
+// channel mailbox, or the direct channel between the user and the bot
+func (p *Plugin) getMailboxChannelID(ownerID string) (string, error) {
+	if isChannelMailbox(ownerID) {
+		return channelIDOfMailbox(ownerID), nil
+	}
+
+	directChannel, appErr := p.API.GetDirectChannel(ownerID, p.gmailBotID)
+	if appErr != nil {
+		return "", appErr
+	}
+	return directChannel.Id, nil
+}
+
+// isChannelAdmin tells if the user can manage the channel mailbox, as a channel, team or system admin
+func (p *Plugin) isChannelAdmin(userID string, channelID string) bool {
+	return p.API.HasPermissionToChannel(userID, channelID, model.PERMISSION_MANAGE_CHANNEL_ROLES)
+}
+
+// checkCanManageChannelMailbox returns an error message for the user if the mailbox of the channel cannot be managed by the user
+func (p *Plugin) checkCanManageChannelMailbox(userID string, channelID string) string {
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return "Unable to get the channel."
+	}
+	if channel.Type != model.CHANNEL_OPEN && channel.Type != model.CHANNEL_PRIVATE {
+		return "A shared mailbox can only be connected to a public or private channel."
+	}
+	if !p.isChannelAdmin(userID, channelID) {
+		return "Only the admins of this channel can manage its shared mailbox."
+	}
+	return ""
+}
+
+// handleConnectChannelCommand sends the link connecting a shared mailbox to the channel
+func (p *Plugin) handleConnectChannelCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	if errMessage := p.checkCanManageChannelMailbox(args.UserId, args.ChannelId); errMessage != "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, errMessage)
+		return &model.CommandResponse{}, nil
+	}
+
+	ownerID := channelMailboxOwnerID(args.ChannelId)
+	if p.checkIfConnected(ownerID) == true && p.isConnectionBroken(ownerID) == false {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "A shared mailbox is already connected to this channel. Use `/gmail disconnect --channel` to disconnect it first.")
+		return &model.CommandResponse{}, nil
+	}
+
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Error! Site URL is not defined in the App")
+		return &model.CommandResponse{}, nil
+	}
+
+	p.sendMessageFromBot(args.ChannelId, args.UserId, true, fmt.Sprintf("[Click here to connect a shared Gmail account with this channel.](%s/plugins/%s/oauth/connect?channel_id=%s)", *siteURL, manifest.Id, args.ChannelId))
+	return &model.CommandResponse{}, nil
+}
+
+// handleDisconnectChannelCommand asks the channel admin to confirm disconnecting the shared mailbox of the channel
+func (p *Plugin) handleDisconnectChannelCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	if errMessage := p.checkCanManageChannelMailbox(args.UserId, args.ChannelId); errMessage != "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, errMessage)
+		return &model.CommandResponse{}, nil
+	}
+
+	if p.checkIfConnected(channelMailboxOwnerID(args.ChannelId)) == false {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "No shared mailbox is connected to this channel. Use `/gmail connect --channel` to connect one.")
+		return &model.CommandResponse{}, nil
+	}
+
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Error! Site URL is not defined in the App")
+		return &model.CommandResponse{}, nil
+	}
+
+	// The context is signed so that it cannot be forged to disconnect the mailbox of another channel
+	actionContext := func(action string) map[string]interface{} {
+		return map[string]interface{}{
+			"action":           action,
+			"mailboxChannelId": args.ChannelId,
+			"signature":        p.signAction(action, args.UserId, args.ChannelId),
+		}
+	}
+
+	deleteButton := &model.PostAction{
+		Type: model.POST_ACTION_TYPE_BUTTON,
+		Name: "Disconnect",
+		Integration: &model.PostActionIntegration{
+			URL:     fmt.Sprintf("%s/plugins/%s/command/disconnect", *siteURL, manifest.Id),
+			Context: actionContext(ActionDisconnectPlugin),
+		},
+	}
+
+	cancelButton := &model.PostAction{
+		Type: model.POST_ACTION_TYPE_BUTTON,
+		Name: "Cancel",
+		Integration: &model.PostActionIntegration{
+			URL:     fmt.Sprintf("%s/plugins/%s/command/disconnect", *siteURL, manifest.Id),
+			Context: actionContext(ActionCancel),
+		},
+	}
+
+	p.API.SendEphemeralPost(args.UserId, &model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: args.ChannelId,
+		Props: map[string]interface{}{
+			"attachments": []*model.SlackAttachment{{
+				Title:   "Disconnect shared mailbox",
+				Text:    ":scissors: Are you sure you would like to disconnect the shared Gmail account from this channel? Its mails will no longer be posted here.",
+				Actions: []*model.PostAction{deleteButton, cancelButton},
+			}},
+		},
+	})
+
+	return &model.CommandResponse{}, nil
+}
+
+// getSubscriptionOwnerID returns whose subscriptions a subscription command manages: the mailbox of the channel
+// with `--shared`, or the mailbox of the user. An error message for the user is returned if it cannot be managed.
+func (p *Plugin) getSubscriptionOwnerID(args *model.CommandArgs, shared bool, manage bool) (string, string) {
+	if !shared {
+		if p.checkIfConnected(args.UserId) == false {
+			return "", "Please connect yourself to Gmail using `/gmail connect`."
+		}
+		return args.UserId, ""
+	}
+
+	ownerID := channelMailboxOwnerID(args.ChannelId)
+	if p.checkIfConnected(ownerID) == false {
+		return "", "No shared mailbox is connected to this channel. A channel admin can connect one using `/gmail connect --channel`."
+	}
+	if manage && !p.isChannelAdmin(args.UserId, args.ChannelId) {
+		return "", "Only the admins of this channel can change the subscriptions of its shared mailbox."
+	}
+	return ownerID, ""
+}
+
+// removeSharedFlag removes the `--shared` flag from the text of a command, telling if it was given
+func removeSharedFlag(text string) (string, bool) {
+	return removeCommandFlag(text, "--shared")
+}
@@ -4,8 +4,9 @@ import (
 	"fmt"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
-	"google.golang.org/api/gmail/v1"
 	"strings"
+	"time"
+	"unicode"
 )
 
 // ExecuteCommand executes the commands registered on getCommand() via RegisterCommand hook
@@ -30,17 +31,35 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 
 	switch action {
 	case "connect":
+		if len(arguments) > 2 && arguments[2] == "--channel" {
+			return p.handleConnectChannelCommand(c, args)
+		}
 		return p.handleConnectCommand(c, args)
 	case "disconnect":
+		if len(arguments) > 2 && arguments[2] == "--channel" {
+			return p.handleDisconnectChannelCommand(c, args)
+		}
 		return p.handleDisconnectCommand(c, args)
 	case "import":
 		return p.handleImportCommand(c, args)
+	case "search":
+		return p.handleSearchCommand(c, args)
+	case "send":
+		return p.handleSendCommand(c, args)
+	case "sync":
+		return p.handleSyncCommand(c, args)
+	case "forward-thread":
+		return p.handleForwardThreadCommand(c, args)
 	case "subscribe":
 		return p.handleSubscriptionCommands(c, args, action)
 	case "unsubscribe":
 		return p.handleSubscriptionCommands(c, args, action)
+	case "following":
+		return p.handleFollowingCommand(c, args)
 	case "subscriptions":
 		return p.handleListSubscriptionsCommand(c, args)
+	case "deadletters":
+		return p.handleDeadLettersCommand(c, args)
 	case "":
 		return p.handleHelpCommand(c, args)
 	case "help":
@@ -52,7 +71,7 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 
 // handleConnectCommand connects the user with Gmail account
 func (p *Plugin) handleConnectCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
-	if p.checkIfConnected(args.UserId) == true {
+	if p.checkIfConnected(args.UserId) == true && p.isConnectionBroken(args.UserId) == false {
 		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You are already connected to Gmail.")
 		return &model.CommandResponse{}, nil
 	}
@@ -84,16 +103,14 @@ func (p *Plugin) handleDisconnectCommand(c *plugin.Context, args *model.CommandA
 		return &model.CommandResponse{}, nil
 	}
 
-	actionSecret := p.getConfiguration().EncryptionKey
-
 	deleteButton := &model.PostAction{
 		Type: model.POST_ACTION_TYPE_BUTTON,
 		Name: "Disconnect",
 		Integration: &model.PostActionIntegration{
 			URL: fmt.Sprintf("%s/plugins/%s/command/disconnect", *siteURL, manifest.Id),
 			Context: map[string]interface{}{
-				"action":       ActionDisconnectPlugin,
-				"actionSecret": actionSecret,
+				"action":    ActionDisconnectPlugin,
+				"signature": p.signAction(ActionDisconnectPlugin, args.UserId),
 			},
 		},
 	}
@@ -104,8 +121,8 @@ func (p *Plugin) handleDisconnectCommand(c *plugin.Context, args *model.CommandA
 		Integration: &model.PostActionIntegration{
 			URL: fmt.Sprintf("%s/plugins/%s/command/disconnect", *siteURL, manifest.Id),
 			Context: map[string]interface{}{
-				"action":       ActionCancel,
-				"actionSecret": actionSecret,
+				"action":    ActionCancel,
+				"signature": p.signAction(ActionCancel, args.UserId),
 			},
 		},
 	}
@@ -137,7 +154,8 @@ func (p *Plugin) handleHelpCommand(c *plugin.Context, args *model.CommandArgs) (
 	return &model.CommandResponse{}, nil
 }
 
-// handleImportCommand handles the command `/gmail import thread [id]` and `/gmail import mail [id]`
+// handleImportCommand handles the command `/gmail import thread [id] [--follow]` and `/gmail import mail [id]`.
+// The ID can be a Message ID, a Gmail URL, a Gmail API ID or `search:"<gmail query>"`.
 func (p *Plugin) handleImportCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
 
 	if p.checkIfConnected(args.UserId) == false {
@@ -145,22 +163,38 @@ func (p *Plugin) handleImportCommand(c *plugin.Context, args *model.CommandArgs)
 		return &model.CommandResponse{}, nil
 	}
 
-	arguments := strings.Fields(args.Command)
+	// `/gmail import search "<query>"` imports the results in the background
+	if fields := strings.Fields(args.Command); len(fields) > 2 && fields[2] == "search" {
+		return p.handleImportSearchCommand(c, args)
+	}
+
+	// `--follow` keeps adding the new mails of an imported thread
+	command, follow := removeCommandFlag(args.Command, "--follow")
+	words := splitCommandWords(command)
+	arguments := []string{}
+	for _, word := range words {
+		arguments = append(arguments, word.text)
+	}
 	// validate arguments of the command
 	if len(arguments) < 3 {
-		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please use `thread` or `mail` after `/gmail import`. Also provide the ID of thread/mail.")
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please use `thread`, `mail` or `search` after `/gmail import`. Also provide the ID of thread/mail.")
 		return &model.CommandResponse{}, nil
 	}
 	queryType := arguments[2]
 	if queryType != "thread" && queryType != "mail" {
-		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Only `thread` and `mail` are supported after `/gmail import`.")
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Only `thread`, `mail` and `search` are supported after `/gmail import`.")
+		return &model.CommandResponse{}, nil
+	}
+	if follow && queryType != "thread" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Only threads can be followed, using `/gmail import thread <thread-message-id> --follow`.")
 		return &model.CommandResponse{}, nil
 	}
 	if len(arguments) < 4 {
 		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please provide the ID of "+arguments[2])
 		return &model.CommandResponse{}, nil
 	}
-	rfcID := arguments[3]
+	// A search query may contain spaces, kept as written
+	reference := strings.TrimSpace(command[words[3].start:])
 
 	gmailID, err := p.getGmailID(args.UserId)
 	if err != nil {
@@ -175,119 +209,186 @@ func (p *Plugin) handleImportCommand(c *plugin.Context, args *model.CommandArgs)
 	}
 	p.API.LogInfo("gmailService created successfully")
 
+	candidates, err := findMessagesToImport(gmailService, gmailID, reference)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, err.Error())
+		return &model.CommandResponse{}, nil
+	}
 	if queryType == "thread" {
-		threadID, threadIDErr := p.getThreadID(args.UserId, gmailID, rfcID)
-		if threadIDErr != nil {
-			p.sendMessageFromBot(args.ChannelId, args.UserId, true, threadIDErr.Error())
-			return &model.CommandResponse{}, nil
-		}
-		thread, threadErr := gmailService.Users.Threads.Get(gmailID, threadID).Format("minimal").Do()
-		if threadErr != nil {
-			p.sendMessageFromBot(args.ChannelId, args.UserId, true, threadErr.Error())
-			return &model.CommandResponse{}, nil
-		}
-		threadMessages := []*gmail.Message{}
-		for _, messageInfo := range thread.Messages {
-			message, mailErr := gmailService.Users.Messages.Get(gmailID, messageInfo.Id).Format("raw").Do()
-			if mailErr != nil {
-				p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to get the thread.")
-				return &model.CommandResponse{}, nil
-			}
-			threadMessages = append(threadMessages, message)
-		}
-		p.handleMessages(threadMessages, args.ChannelId, args.UserId, false)
-
+		candidates = uniqueThreads(candidates)
+	}
+	if len(candidates) == 0 {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "No mail found for `"+reference+"`. Please provide a Message ID, a Gmail URL or `search:\"<gmail query>\"`.")
 		return &model.CommandResponse{}, nil
 	}
-	// if queryType == "mail" =>
-	// Note that explicit condition check is not required
 
-	messageID, err := p.getMessageID(args.UserId, gmailID, rfcID)
-	if err != nil {
-		p.sendMessageFromBot(args.ChannelId, args.UserId, true, err.Error())
-		p.API.LogInfo(err.Error())
+	// Let the user choose among the matching mails
+	if len(candidates) > 1 {
+		post, chooserErr := p.importChooserPost(args.UserId, args.ChannelId, queryType, follow, candidates)
+		if chooserErr != nil {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, chooserErr.Error())
+			return &model.CommandResponse{}, nil
+		}
+		p.API.SendEphemeralPost(args.UserId, post)
 		return &model.CommandResponse{}, nil
 	}
-	p.API.LogInfo("Extracted Message ID from rfc ID successfully")
 
-	message, err := gmailService.Users.Messages.Get(gmailID, messageID).Format("raw").Do()
+	id := candidates[0].Id
+	if queryType == "thread" {
+		id = candidates[0].ThreadId
+	}
+	message, err := p.importFromGmail(args.UserId, args.ChannelId, queryType, id, follow)
 	if err != nil {
-		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to get the mail.")
-		return &model.CommandResponse{}, nil
+		message = err.Error()
+	}
+	if message != "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, message)
 	}
-	p.API.LogInfo("Message extracted successfully")
-
-	// Message extracted successfully
-	p.handleMessages([]*gmail.Message{message}, args.ChannelId, args.UserId, false)
 
 	return &model.CommandResponse{}, nil
 }
 
 func (p *Plugin) handleSubscriptionCommands(c *plugin.Context, args *model.CommandArgs, action string) (*model.CommandResponse, *model.AppError) {
-
-	if p.checkIfConnected(args.UserId) == false {
-		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please connect yourself to Gmail using `/gmail connect`.")
+	// `--shared` manages the subscriptions of the mailbox connected to the channel
+	text, shared := removeSharedFlag(strings.TrimPrefix(args.Command, "/"+commandGmail+" "+action))
+	ownerID, errMessage := p.getSubscriptionOwnerID(args, shared, true)
+	if errMessage != "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, errMessage)
 		return &model.CommandResponse{}, nil
 	}
 
+	// `/gmail subscribe query ...` and `/gmail unsubscribe query ...` manage the query subscriptions
+	if text == "query" || strings.HasPrefix(text, "query ") {
+		if action == "subscribe" {
+			return p.handleSubscribeQueryCommand(c, args, ownerID, strings.TrimPrefix(text, "query"))
+		}
+		return p.handleUnsubscribeQueryCommand(c, args, ownerID, strings.TrimPrefix(text, "query"))
+	}
+
 	if action == "subscribe" {
-		return p.handleSubscribeCommand(c, args)
+		return p.handleSubscribeCommand(c, args, ownerID, text)
 	}
-	return p.handleUnsubscribeCommand(c, args)
+	return p.handleUnsubscribeCommand(c, args, ownerID, text)
 }
 
 // handleSubscribeCommand updates the subscriptions of user in the KV Store
-func (p *Plugin) handleSubscribeCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
-	// `/gmail subscribe [LABELS for eg. INBOX, CATEGORY_PROMOTIONS]`
-	// if no Label specified, assume all the supported labels
-
-	allLabelIDs := strings.TrimSpace(strings.ToUpper(strings.TrimPrefix(args.Command, "/"+commandGmail+" subscribe")))
-	labelIDs := p.getSupportedLabels()
+func (p *Plugin) handleSubscribeCommand(c *plugin.Context, args *model.CommandArgs, ownerID string, text string) (*model.CommandResponse, *model.AppError) {
+	// `/gmail subscribe [LABEL IDs or names for eg. INBOX, Customers/ACME] [--channel ~channel-name]`
+	// if no Label specified, assume the default labels
+
+	allLabels, options := parseCommandOptions(text, "--channel")
+	labelIDs := p.getDefaultLabels()
+
+	if allLabels != "" {
+		givenLabels := splitLabels(allLabels)
+		var notFound []string
+		var err error
+		labelIDs, notFound, err = p.resolveLabelsOfUser(ownerID, givenLabels)
+		if err != nil {
+			p.API.LogError("Could not get the labels of user with user ID: "+ownerID, "err", err.Error())
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to get your Gmail labels. Please try again later.")
+			return &model.CommandResponse{}, nil
+		}
+		if len(notFound) > 0 {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Label: "+strings.Join(notFound, ", ")+" not found in your Gmail account")
+			return &model.CommandResponse{}, nil
+		}
+	}
 
-	if allLabelIDs != "" {
-		labelIDs = strings.Split(allLabelIDs, ",")
+	channelName, routed := options["--channel"]
+	if routed && isChannelMailbox(ownerID) {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "The mails of a shared mailbox are always delivered to its channel.")
+		return &model.CommandResponse{}, nil
 	}
+	if routed {
+		// Routed labels are added to the subscriptions of the user
+		channel, errMessage := p.getRouteChannel(args.UserId, args.TeamId, channelName)
+		if channel == nil {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, errMessage)
+			return &model.CommandResponse{}, nil
+		}
+
+		subscriptions, _ := p.getSubscriptionsOfUser(ownerID)
+		for _, labelID := range labelIDs {
+			alreadySubscribed := false
+			for _, subscription := range subscriptions {
+				if subscription == labelID {
+					alreadySubscribed = true
+					break
+				}
+			}
+			if !alreadySubscribed {
+				subscriptions = append(subscriptions, labelID)
+			}
+		}
 
-	for labelIndex, labelID := range labelIDs {
-		labelIDs[labelIndex] = strings.TrimSpace(labelID)
-		if _, ok := supportedLabelIDs[labelIDs[labelIndex]]; !ok {
-			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Label ID: "+labelID+" not supported")
+		err := p.updateRoutesOfUser(ownerID, func(routes map[string]string) {
+			for _, labelID := range labelIDs {
+				routes[labelRouteKey(labelID)] = channel.Id
+			}
+		})
+		if err != nil {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to save the channel of the subscription: "+err.Error())
 			return &model.CommandResponse{}, nil
 		}
+		p.updateSubscriptionsOfUser(ownerID, subscriptions)
+		p.applySubscriptionsOfUser(ownerID)
+
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Mails with the labels: "+strings.Join(p.getLabelNamesOfUser(ownerID, labelIDs), ", ")+" will be delivered to ~"+channel.Name+".")
+		return &model.CommandResponse{}, nil
 	}
 
-	p.updateSubscriptionsOfUser(args.UserId, labelIDs)
+	// The label subscriptions are overwritten, along with the channels they were delivered to
+	err := p.updateRoutesOfUser(ownerID, func(routes map[string]string) {
+		for routeKey := range routes {
+			if strings.HasPrefix(routeKey, labelRouteKey("")) {
+				delete(routes, routeKey)
+			}
+		}
+	})
+	if err != nil {
+		p.API.LogError("Could not remove the label routes of user with user ID: "+ownerID, "err", err.Error())
+	}
+	p.updateSubscriptionsOfUser(ownerID, labelIDs)
+	p.applySubscriptionsOfUser(ownerID)
 
-	p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have subscribed to the labels: "+strings.Join(labelIDs, ",")+" successfully. Any previous subscription is overwritten.")
+	p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have subscribed to the labels: "+strings.Join(p.getLabelNamesOfUser(ownerID, labelIDs), ", ")+" successfully. Any previous subscription is overwritten.")
 	return &model.CommandResponse{}, nil
 }
 
-func (p *Plugin) handleUnsubscribeCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+func (p *Plugin) handleUnsubscribeCommand(c *plugin.Context, args *model.CommandArgs, ownerID string, text string) (*model.CommandResponse, *model.AppError) {
 
-	allLabelIDs := strings.TrimSpace(strings.ToUpper(strings.TrimPrefix(args.Command, "/"+commandGmail+" unsubscribe")))
+	allLabels := strings.TrimSpace(text)
 
-	labelIDs, _ := p.getSubscriptionsOfUser(args.UserId)
+	labelIDs, _ := p.getSubscriptionsOfUser(ownerID)
 	subscribedIDs := labelIDs
 
 	// if not subscribed to any of the labelID
 	if len(labelIDs) == 0 {
-		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have not subscribed to any label ID. Use `/"+commandGmail+" subscribe <Label IDs>` to subscribe.")
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have not subscribed to any label. Use `/"+commandGmail+" subscribe <Labels>` to subscribe.")
 		return &model.CommandResponse{}, nil
 	}
-	// get mentioned label IDs
-	if allLabelIDs != "" {
-		labelIDs = strings.Split(allLabelIDs, ",")
+	// get mentioned labels
+	if allLabels != "" {
+		givenLabels := splitLabels(allLabels)
+		resolvedIDs, notFound, err := p.resolveLabelsOfUser(ownerID, givenLabels)
+		if err != nil {
+			p.API.LogError("Could not get the labels of user with user ID: "+ownerID, "err", err.Error())
+			resolvedIDs, notFound = []string{}, givenLabels
+		}
+		// labels deleted from Gmail can still be unsubscribed from using their ID
+		labelIDs = append(resolvedIDs, notFound...)
 	}
 
 	remainSubscribed := []string{}
-	unsubscribedTo := ""
+	unsubscribedFrom := []string{}
 
 	for _, subscribedID := range subscribedIDs {
 		// user is currently subscribed to subscribedID
 		foundInGivenIDs := false
 		for _, labelID := range labelIDs {
-			if strings.TrimSpace(labelID) == subscribedID {
-				unsubscribedTo += subscribedID + ", "
+			if labelID == subscribedID {
+				unsubscribedFrom = append(unsubscribedFrom, subscribedID)
 				foundInGivenIDs = true
 				break
 			}
@@ -296,40 +397,253 @@ func (p *Plugin) handleUnsubscribeCommand(c *plugin.Context, args *model.Command
 			remainSubscribed = append(remainSubscribed, subscribedID)
 		}
 	}
-	if unsubscribedTo == "" {
-		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have not been unsubscribed from any labels. Please check if you have specified correct label IDs.")
+	if len(unsubscribedFrom) == 0 {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have not been unsubscribed from any labels. Please check if you have specified correct labels.")
 		return &model.CommandResponse{}, nil
 	}
 
-	p.updateSubscriptionsOfUser(args.UserId, remainSubscribed)
-	remainSubscribedMessage := ""
-	for labelIndex, labelID := range remainSubscribed {
-		remainSubscribedMessage += labelID
-		if labelIndex != len(remainSubscribed)-1 {
-			remainSubscribedMessage += ", "
+	p.updateSubscriptionsOfUser(ownerID, remainSubscribed)
+	p.applySubscriptionsOfUser(ownerID)
+	err := p.updateRoutesOfUser(ownerID, func(routes map[string]string) {
+		for _, labelID := range unsubscribedFrom {
+			delete(routes, labelRouteKey(labelID))
 		}
+	})
+	if err != nil {
+		p.API.LogError("Could not remove the label routes of user with user ID: "+ownerID, "err", err.Error())
 	}
+
+	remainSubscribedMessage := strings.Join(p.getLabelNamesOfUser(ownerID, remainSubscribed), ", ")
 	if remainSubscribedMessage != "" {
 		remainSubscribedMessage = "You are currently subscribed to the labels: " + remainSubscribedMessage
 	} else {
 		remainSubscribedMessage = "Currently, you have no active subscriptions"
 	}
 
-	p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have successfully unsubscribed from the labels: "+unsubscribedTo+" .\n"+remainSubscribedMessage)
+	p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have successfully unsubscribed from the labels: "+strings.Join(p.getLabelNamesOfUser(ownerID, unsubscribedFrom), ", ")+".\n"+remainSubscribedMessage)
 	return &model.CommandResponse{}, nil
 }
 
 func (p *Plugin) handleListSubscriptionsCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
-	if p.checkIfConnected(args.UserId) == false {
+	_, shared := removeSharedFlag(strings.TrimPrefix(args.Command, "/"+commandGmail+" subscriptions"))
+	if !shared && p.checkIfConnected(args.UserId) == false {
 		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You are not currently connected with Gmail. Use `/gmail connect` to get connected.")
 		return &model.CommandResponse{}, nil
 	}
-	subscriptions, _ := p.getSubscriptionsOfUser(args.UserId)
-	if len(subscriptions) == 0 {
-		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have not subscribed to any labels. Please use `/gmail subscribe <Label IDs>` to subscribe.")
+	ownerID, errMessage := p.getSubscriptionOwnerID(args, shared, false)
+	if errMessage != "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, errMessage)
+		return &model.CommandResponse{}, nil
+	}
+	subscriptions, _ := p.getSubscriptionsOfUser(ownerID)
+	querySubscriptions, _ := p.getQuerySubscriptionsOfUser(ownerID)
+	if len(subscriptions) == 0 && len(querySubscriptions) == 0 {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have not subscribed to any labels or queries. Please use `/gmail subscribe <Labels>` or `/gmail subscribe query \"<query>\"` to subscribe.")
 		return &model.CommandResponse{}, nil
 	}
-	p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Currently, you are subscribed to the label IDs: "+strings.Join(subscriptions, ", "))
+
+	routes, err := p.getRoutesOfUser(ownerID)
+	if err != nil {
+		p.API.LogError("Could not get the subscription routes of user with user ID: "+ownerID, "err", err.Error())
+		routes = map[string]string{}
+	}
+	// routeInfo tells where the mails of a subscription delivered to another channel than the bot DM go
+	routeInfo := func(routeKey string) string {
+		if channelID, ok := routes[routeKey]; ok {
+			return " (delivered to " + p.getChannelDisplayName(channelID) + ")"
+		}
+		return ""
+	}
+
+	message := "Currently, you are not subscribed to any labels."
+	if len(subscriptions) > 0 {
+		labelNames := p.getLabelNamesOfUser(ownerID, subscriptions)
+		for labelIndex, labelID := range subscriptions {
+			labelNames[labelIndex] += routeInfo(labelRouteKey(labelID))
+		}
+		message = "Currently, you are subscribed to the labels: " + strings.Join(labelNames, ", ")
+	}
+	if isChannelMailbox(ownerID) {
+		message = strings.Replace(message, "you are", "the shared mailbox is", 1)
+		if mailbox, err := p.getChannelMailbox(args.ChannelId); err == nil && mailbox != nil {
+			if user, appErr := p.API.GetUser(mailbox.ConnectedBy); appErr == nil {
+				message = "The shared mailbox of this channel was connected by @" + user.Username + ".\n" + message
+			}
+		}
+	}
+	if len(querySubscriptions) > 0 {
+		if isChannelMailbox(ownerID) {
+			message += "\n\nThe shared mailbox is subscribed to the queries:\n"
+		} else {
+			message += "\n\nYou are subscribed to the queries:\n"
+		}
+		for _, subscription := range querySubscriptions {
+			message += "* **" + subscription.Name + "**: `" + subscription.Query + "`" + routeInfo(queryRouteKey(subscription.Name)) + "\n"
+		}
+	}
+	p.sendMessageFromBot(args.ChannelId, args.UserId, true, message)
+	return &model.CommandResponse{}, nil
+}
+
+// commandWord is a word of the text of a command, with its position in the text
+type commandWord struct {
+	text  string
+	start int
+	end   int
+}
+
+// splitCommandWords splits the text of a command into the words separated by whitespace. Whitespace within straight
+// or curly quotes does not separate words, so that a quoted Gmail query is a single word.
+func splitCommandWords(text string) []commandWord {
+	words := []commandWord{}
+	start := -1
+	closingQuote := rune(0)
+	for index, character := range text {
+		switch {
+		case closingQuote != 0:
+			if character == closingQuote {
+				closingQuote = 0
+			}
+		case character == '"':
+			closingQuote = '"'
+		case character == '“':
+			closingQuote = '”'
+		case unicode.IsSpace(character):
+			if start >= 0 {
+				words = append(words, commandWord{text: text[start:index], start: start, end: index})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = index
+		}
+	}
+	if start >= 0 {
+		words = append(words, commandWord{text: text[start:], start: start, end: len(text)})
+	}
+	return words
+}
+
+// parseCommandOptions separates the options given at the end of a command, like `--channel ~town-square`,
+// from the text before them. Options not followed by a value are mapped to an empty string. Options within
+// quotes are part of the text, and the text and the values are kept as written, quotes aside.
+func parseCommandOptions(text string, options ...string) (string, map[string]string) {
+	values := map[string]string{}
+	words := splitCommandWords(text)
+
+	isOption := func(word commandWord) bool {
+		for _, option := range options {
+			if word.text == option {
+				return true
+			}
+		}
+		return false
+	}
+
+	optionWords := []commandWord{}
+	for _, word := range words {
+		if isOption(word) {
+			optionWords = append(optionWords, word)
+		}
+	}
+	if len(optionWords) == 0 {
+		return strings.TrimSpace(text), values
+	}
+
+	for index, option := range optionWords {
+		valueEnd := len(text)
+		if index+1 < len(optionWords) {
+			valueEnd = optionWords[index+1].start
+		}
+		values[option.text] = trimQuotes(strings.TrimSpace(text[option.end:valueEnd]))
+	}
+
+	return strings.TrimSpace(text[:optionWords[0].start]), values
+}
+
+// removeCommandFlag removes the flag from the text of a command, telling if it was given. A flag within quotes is
+// part of the text, and the rest of the text is kept as written.
+func removeCommandFlag(text string, flag string) (string, bool) {
+	flagged := false
+	parts := []string{}
+	partStart := 0
+	for _, word := range splitCommandWords(text) {
+		if word.text != flag {
+			continue
+		}
+		flagged = true
+		if part := strings.TrimSpace(text[partStart:word.start]); part != "" {
+			parts = append(parts, part)
+		}
+		partStart = word.end
+	}
+	if part := strings.TrimSpace(text[partStart:]); part != "" {
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " "), flagged
+}
+
+// splitLabels splits the comma-separated labels given to a command
+func splitLabels(allLabels string) []string {
+	labels := []string{}
+	for _, label := range strings.Split(allLabels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// handleDeadLettersCommand lets system admins inspect, retry and clear the notification jobs that failed repeatedly
+func (p *Plugin) handleDeadLettersCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	if !p.API.HasPermissionTo(args.UserId, model.PERMISSION_MANAGE_SYSTEM) {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Only system admins can manage failed notifications.")
+		return &model.CommandResponse{}, nil
+	}
+
+	arguments := strings.Fields(args.Command)
+	subAction := ""
+	if len(arguments) > 2 {
+		subAction = arguments[2]
+	}
+
+	switch subAction {
+	case "retry":
+		retried, err := p.retryDeadLetters()
+		if err != nil {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to retry the failed notifications: "+err.Error())
+			return &model.CommandResponse{}, nil
+		}
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, fmt.Sprintf("%d failed notifications queued again.", retried))
+	case "clear":
+		if err := p.API.KVDelete(deadLettersKey); err != nil {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to clear the failed notifications: "+err.Error())
+			return &model.CommandResponse{}, nil
+		}
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Failed notifications cleared.")
+	case "":
+		deadJobs, err := p.getJobList(deadLettersKey)
+		if err != nil {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to get the failed notifications: "+err.Error())
+			return &model.CommandResponse{}, nil
+		}
+		if len(deadJobs) == 0 {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "There are no failed notifications.")
+			return &model.CommandResponse{}, nil
+		}
+
+		message := "###### Failed notifications\n\n| Gmail ID | Attempts | Received | Last Error |\n|---|---|---|---|\n"
+		for _, job := range deadJobs {
+			message += fmt.Sprintf("| %s | %d | %s | %s |\n", job.EmailAddress, job.Attempts,
+				time.Unix(0, job.CreatedAt*int64(time.Millisecond)).UTC().Format(time.RFC1123), strings.Replace(job.LastError, "|", "\\|", -1))
+		}
+		message += "\nUse `/gmail deadletters retry` to queue them again or `/gmail deadletters clear` to discard them."
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, message)
+	default:
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Only `retry` and `clear` are supported after `/gmail deadletters`.")
+	}
+
 	return &model.CommandResponse{}, nil
 }
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommandOptions(t *testing.T) {
+	for name, test := range map[string]struct {
+		text         string
+		expectText   string
+		expectValues map[string]string
+	}{
+		"no option": {
+			text:         " Customers,INBOX ",
+			expectText:   "Customers,INBOX",
+			expectValues: map[string]string{},
+		},
+		"options with and without value": {
+			text:         `"from:vendor.com" --limit 20 --threads`,
+			expectText:   `"from:vendor.com"`,
+			expectValues: map[string]string{"--limit": "20", "--threads": ""},
+		},
+		"quotes keep their whitespace": {
+			text:         `"subject:(weekly  report)   from:a.com" --name "Weekly  report"`,
+			expectText:   `"subject:(weekly  report)   from:a.com"`,
+			expectValues: map[string]string{"--name": "Weekly  report"},
+		},
+		"options within quotes are part of the text": {
+			text:         `"subject:(--channel) --name" --channel ~town-square`,
+			expectText:   `"subject:(--channel) --name"`,
+			expectValues: map[string]string{"--channel": "~town-square"},
+		},
+		"options within curly quotes are part of the text": {
+			text:         `“from:a.com --name b” --name c`,
+			expectText:   `“from:a.com --name b”`,
+			expectValues: map[string]string{"--name": "c"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			text, values := parseCommandOptions(test.text, "--name", "--channel", "--limit", "--threads")
+			assert.Equal(t, test.expectText, text)
+			assert.Equal(t, test.expectValues, values)
+		})
+	}
+}
+
+func TestRemoveCommandFlag(t *testing.T) {
+	for name, test := range map[string]struct {
+		text          string
+		expectText    string
+		expectFlagged bool
+	}{
+		"no flag": {
+			text:       " query \"from:a.com\" ",
+			expectText: `query "from:a.com"`,
+		},
+		"flag between words": {
+			text:          `query --shared "from:a.com"`,
+			expectText:    `query "from:a.com"`,
+			expectFlagged: true,
+		},
+		"flag at the end": {
+			text:          `Customers,INBOX --shared`,
+			expectText:    "Customers,INBOX",
+			expectFlagged: true,
+		},
+		"quotes keep their whitespace": {
+			text:          `query "subject:(weekly  report)"   --shared`,
+			expectText:    `query "subject:(weekly  report)"`,
+			expectFlagged: true,
+		},
+		"flag within quotes is part of the text": {
+			text:       `query "subject:(--shared)  inbox"`,
+			expectText: `query "subject:(--shared)  inbox"`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			text, flagged := removeCommandFlag(test.text, "--shared")
+			assert.Equal(t, test.expectText, text)
+			assert.Equal(t, test.expectFlagged, flagged)
+		})
+	}
+
+	t.Run("follow flag after a quoted search", func(t *testing.T) {
+		text, flagged := removeCommandFlag(`/gmail import thread search:"subject:(--follow  up)" --follow`, "--follow")
+		assert.Equal(t, `/gmail import thread search:"subject:(--follow  up)"`, text)
+		assert.True(t, flagged)
+		words := splitCommandWords(text)
+		assert.Len(t, words, 4)
+		assert.Equal(t, `search:"subject:(--follow  up)"`, words[3].text)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+// base64LineLength is the maximum length of the lines of base64 encoded MIME parts
+const base64LineLength = 76
+
+// outgoingMail is a mail sent through Gmail by the plugin
+type outgoingMail struct {
+	To      []string
+	Cc      []string
+	Bcc     []string
+	Subject string
+	// TextBody is always sent, HTMLBody is sent as an alternative if set
+	TextBody string
+	HTMLBody string
+	// InReplyTo and References thread a reply with the mail it replies to
+	InReplyTo   string
+	References  string
+	Attachments []*outgoingAttachment
+}
+
+// outgoingAttachment is a file attached to an outgoing mail
+type outgoingAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// sanitizeHeader prevents header injection through the values of the headers
+func sanitizeHeader(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// buildMIMEMessage builds the RFC 2822 message of the mail, as expected by the Gmail API.
+// Gmail sets the From header to the address of the authenticated mailbox.
+func buildMIMEMessage(mail *outgoingMail) ([]byte, error) {
+	var message bytes.Buffer
+
+	writeHeader := func(name string, value string) {
+		if value != "" {
+			fmt.Fprintf(&message, "%s: %s\r\n", name, sanitizeHeader(value))
+		}
+	}
+	writeHeader("To", strings.Join(mail.To, ", "))
+	writeHeader("Cc", strings.Join(mail.Cc, ", "))
+	writeHeader("Bcc", strings.Join(mail.Bcc, ", "))
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", mail.Subject))
+	writeHeader("Date", time.Now().Format(time.RFC1123Z))
+	writeHeader("In-Reply-To", mail.InReplyTo)
+	writeHeader("References", mail.References)
+	writeHeader("MIME-Version", "1.0")
+
+	bodyHeader, body, err := buildMailBody(mail)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mail.Attachments) == 0 {
+		for _, name := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			writeHeader(name, bodyHeader.Get(name))
+		}
+		message.WriteString("\r\n")
+		message.Write(body)
+		return message.Bytes(), nil
+	}
+
+	mixedWriter := multipart.NewWriter(&message)
+	writeHeader("Content-Type", "multipart/mixed; boundary="+mixedWriter.Boundary())
+	message.WriteString("\r\n")
+
+	bodyPart, err := mixedWriter.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = bodyPart.Write(body); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range mail.Attachments {
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		attachmentPart, err := mixedWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": attachment.Name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > base64LineLength {
+			fmt.Fprintf(attachmentPart, "%s\r\n", encoded[:base64LineLength])
+			encoded = encoded[base64LineLength:]
+		}
+		fmt.Fprintf(attachmentPart, "%s\r\n", encoded)
+	}
+
+	if err = mixedWriter.Close(); err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
+
+// buildMailBody returns the headers and the content of the text of the mail, with an HTML alternative if any
+func buildMailBody(mail *outgoingMail) (textproto.MIMEHeader, []byte, error) {
+	if mail.HTMLBody == "" {
+		content, err := encodeQuotedPrintable(mail.TextBody)
+		if err != nil {
+			return nil, nil, err
+		}
+		return textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		}, content, nil
+	}
+
+	var body bytes.Buffer
+	alternativeWriter := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", mail.TextBody},
+		{"text/html; charset=UTF-8", mail.HTMLBody},
+	} {
+		partWriter, err := alternativeWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := encodeQuotedPrintable(part.content)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err = partWriter.Write(content); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := alternativeWriter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternativeWriter.Boundary()},
+	}, body.Bytes(), nil
+}
+
+// encodeQuotedPrintable encodes the text as quoted-printable, with CRLF line endings
+func encodeQuotedPrintable(text string) ([]byte, error) {
+	var content bytes.Buffer
+	writer := quotedprintable.NewWriter(&content)
+	text = strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return content.Bytes(), nil
+}
+
+// sendMail sends the mail from the mailbox, in the Gmail thread if a thread ID is given
+func sendMail(gmailService *gmail.Service, gmailID string, mail *outgoingMail, threadID string) (*gmail.Message, error) {
+	rawMessage, err := buildMIMEMessage(mail)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not build the mail")
+	}
+
+	sentMessage, err := gmailService.Users.Messages.Send(gmailID, &gmail.Message{
+		Raw:      base64.URLEncoding.EncodeToString(rawMessage),
+		ThreadId: threadID,
+	}).Do()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not send the mail")
+	}
+	return sentMessage, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readPart decodes the content of a part according to its transfer encoding
+func readPart(t *testing.T, encoding string, content io.Reader) string {
+	t.Helper()
+
+	switch encoding {
+	case "quoted-printable":
+		content = quotedprintable.NewReader(content)
+	case "base64":
+		content = base64.NewDecoder(base64.StdEncoding, content)
+	}
+	decoded, err := ioutil.ReadAll(content)
+	require.NoError(t, err)
+	return string(decoded)
+}
+
+// readMultipart returns the parts of a multipart body by content type, decoded
+func readMultipart(t *testing.T, contentType string, body io.Reader) ([]*multipart.Part, []string) {
+	t.Helper()
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(mediaType, "multipart/"), mediaType)
+
+	parts := []*multipart.Part{}
+	contents := []string{}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		parts = append(parts, part)
+		contents = append(contents, readPart(t, part.Header.Get("Content-Transfer-Encoding"), part))
+	}
+	return parts, contents
+}
+
+func TestBuildMIMEMessage(t *testing.T) {
+	textBody := "Bonjour à tous,\nThe line of this mail is longer than seventy six characters, so it has to be wrapped by the encoding.\n= signs are escaped"
+	attachmentData := bytes.Repeat([]byte{0, 1, 2, 250, 251, 252}, 40)
+
+	for name, test := range map[string]struct {
+		mail  *outgoingMail
+		check func(t *testing.T, message *mail.Message)
+	}{
+		"headers": {
+			mail: &outgoingMail{
+				To:         []string{"Jane Doe <jane@example.com>", "bob@example.com"},
+				Cc:         []string{"carol@example.com"},
+				Bcc:        []string{"dave@example.com"},
+				Subject:    "Réunion de l'équipe",
+				TextBody:   "Hello",
+				InReplyTo:  "<original@mail.example.com>",
+				References: "<first@mail.example.com> <original@mail.example.com>",
+			},
+			check: func(t *testing.T, message *mail.Message) {
+				assert.Equal(t, "Jane Doe <jane@example.com>, bob@example.com", message.Header.Get("To"))
+				assert.Equal(t, "carol@example.com", message.Header.Get("Cc"))
+				assert.Equal(t, "dave@example.com", message.Header.Get("Bcc"))
+				assert.Equal(t, "<original@mail.example.com>", message.Header.Get("In-Reply-To"))
+				assert.Equal(t, "<first@mail.example.com> <original@mail.example.com>", message.Header.Get("References"))
+				assert.Equal(t, "1.0", message.Header.Get("MIME-Version"))
+				_, err := message.Header.Date()
+				assert.NoError(t, err)
+
+				// Non ASCII subjects are encoded
+				assert.NotContains(t, message.Header.Get("Subject"), "é")
+				subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+				require.NoError(t, err)
+				assert.Equal(t, "Réunion de l'équipe", subject)
+			},
+		},
+		"empty headers are left out": {
+			mail: &outgoingMail{To: []string{"jane@example.com"}, TextBody: "Hello"},
+			check: func(t *testing.T, message *mail.Message) {
+				for _, name := range []string{"Cc", "Bcc", "Subject", "In-Reply-To", "References"} {
+					_, present := message.Header[name]
+					assert.False(t, present, name)
+				}
+			},
+		},
+		"header injection": {
+			mail: &outgoingMail{
+				To:         []string{"jane@example.com\r\nBcc: attacker@example.com"},
+				TextBody:   "Hello",
+				References: "<id@example.com>\nX-Injected: yes",
+			},
+			check: func(t *testing.T, message *mail.Message) {
+				assert.Empty(t, message.Header.Get("Bcc"))
+				assert.Empty(t, message.Header.Get("X-Injected"))
+				assert.Equal(t, "jane@example.com  Bcc: attacker@example.com", message.Header.Get("To"))
+			},
+		},
+		"plain text body": {
+			mail: &outgoingMail{To: []string{"jane@example.com"}, TextBody: textBody},
+			check: func(t *testing.T, message *mail.Message) {
+				assert.Equal(t, "text/plain; charset=UTF-8", message.Header.Get("Content-Type"))
+				assert.Equal(t, "quoted-printable", message.Header.Get("Content-Transfer-Encoding"))
+
+				body, err := ioutil.ReadAll(message.Body)
+				require.NoError(t, err)
+				for _, line := range strings.Split(string(body), "\r\n") {
+					assert.True(t, len(line) <= 76, line)
+				}
+				// Line endings are sent as CRLF
+				assert.Equal(t, strings.Replace(textBody, "\n", "\r\n", -1), readPart(t, "quoted-printable", bytes.NewReader(body)))
+			},
+		},
+		"HTML alternative": {
+			mail: &outgoingMail{
+				To:       []string{"jane@example.com"},
+				TextBody: "Hello *world*",
+				HTMLBody: "<p>Hello <em>world</em></p>",
+			},
+			check: func(t *testing.T, message *mail.Message) {
+				assert.True(t, strings.HasPrefix(message.Header.Get("Content-Type"), "multipart/alternative;"))
+
+				parts, contents := readMultipart(t, message.Header.Get("Content-Type"), message.Body)
+				require.Len(t, parts, 2)
+				assert.Equal(t, "text/plain; charset=UTF-8", parts[0].Header.Get("Content-Type"))
+				assert.Equal(t, "Hello *world*", contents[0])
+				assert.Equal(t, "text/html; charset=UTF-8", parts[1].Header.Get("Content-Type"))
+				assert.Equal(t, "<p>Hello <em>world</em></p>", contents[1])
+			},
+		},
+		"attachments": {
+			mail: &outgoingMail{
+				To:       []string{"jane@example.com"},
+				TextBody: "See attached",
+				Attachments: []*outgoingAttachment{
+					{Name: "report.pdf", ContentType: "application/pdf", Data: attachmentData},
+					{Name: "données.bin", Data: []byte("raw")},
+				},
+			},
+			check: func(t *testing.T, message *mail.Message) {
+				assert.True(t, strings.HasPrefix(message.Header.Get("Content-Type"), "multipart/mixed;"))
+
+				parts, contents := readMultipart(t, message.Header.Get("Content-Type"), message.Body)
+				require.Len(t, parts, 3)
+				assert.Equal(t, "text/plain; charset=UTF-8", parts[0].Header.Get("Content-Type"))
+				assert.Equal(t, "See attached", contents[0])
+
+				assert.Equal(t, "report.pdf", parts[1].FileName())
+				mediaType, _, err := mime.ParseMediaType(parts[1].Header.Get("Content-Type"))
+				require.NoError(t, err)
+				assert.Equal(t, "application/pdf", mediaType)
+				assert.Equal(t, string(attachmentData), contents[1])
+
+				// Names are encoded, and the content type defaults to binary
+				assert.Equal(t, "données.bin", parts[2].FileName())
+				mediaType, _, err = mime.ParseMediaType(parts[2].Header.Get("Content-Type"))
+				require.NoError(t, err)
+				assert.Equal(t, "application/octet-stream", mediaType)
+				assert.Equal(t, "raw", contents[2])
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			raw, err := buildMIMEMessage(test.mail)
+			require.NoError(t, err)
+
+			message, err := mail.ReadMessage(bytes.NewReader(raw))
+			require.NoError(t, err)
+			test.check(t, message)
+		})
+	}
+}
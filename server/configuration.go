@@ -23,6 +23,22 @@ type configuration struct {
 	GmailOAuthSecret   string
 	TopicName          string
 	EncryptionKey      string
+
+	// DeliveryMode selects how Gmail notifications reach the plugin
+	DeliveryMode            string
+	PullSubscriptionName    string
+	PubSubServiceAccountKey string
+	PubSubEndpoint          string
+	PollingIntervalSeconds  int
+
+	// Authentication of the push requests sent by Pub/Sub to the webhook
+	PushAuthServiceAccount string
+	PushAuthAudience       string
+	PushAuthJWKSURL        string
+	PushVerificationToken  string
+
+	// AllowUnauthenticatedPush accepts push requests when no authentication is configured
+	AllowUnauthenticatedPush bool
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -43,7 +59,8 @@ func (c *configuration) IsValid() error {
 		return fmt.Errorf("Must have Gmail OAuth secret entered in plugin settings")
 	}
 
-	if c.TopicName == "" {
+	// Polling the history needs no Pub/Sub topic
+	if c.TopicName == "" && c.getDeliveryMode() != deliveryModePoll {
 		return fmt.Errorf("Must have Topic Name entered in plugin settings")
 	}
 
@@ -51,9 +68,21 @@ func (c *configuration) IsValid() error {
 		return fmt.Errorf("Must have Encryption Key generated in plugin settings")
 	}
 
+	if c.getDeliveryMode() == deliveryModePull && c.PullSubscriptionName == "" {
+		return fmt.Errorf("Must have Pull Subscription Name entered in plugin settings to pull notifications")
+	}
+
 	return nil
 }
 
+// getDeliveryMode returns the configured delivery mode of notifications, defaulting to push
+func (c *configuration) getDeliveryMode() string {
+	if c.DeliveryMode == "" {
+		return deliveryModePush
+	}
+	return c.DeliveryMode
+}
+
 // getConfiguration retrieves the active configuration under lock, making it safe to use
 // concurrently. The active configuration may change underneath the client of this method, but
 // the struct returned by this API call is considered immutable.
@@ -104,7 +133,16 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	// Re-encrypt the stored tokens if the encryption key has been regenerated. The tokens not re-encrypted yet are
+	// decrypted with the previous key. Note: No previous configuration exists when the plugin is starting up.
+	oldEncryptionKey := p.getConfiguration().EncryptionKey
 	p.setConfiguration(configuration)
+	if err := p.syncEncryptionKey(oldEncryptionKey, configuration.EncryptionKey); err != nil {
+		p.API.LogError("Failed to re-encrypt stored tokens with the new encryption key", "err", err.Error())
+	}
+
+	// Apply the new settings to the running background jobs
+	p.restartNotificationWorkers()
 
 	return nil
 }
@@ -11,11 +11,25 @@ const (
 
 	commonHelpText = "\n* `/gmail connect` - Connect your Mattermost account to your Gmail account\n" +
 		"* `/gmail disconnect` - Disconnect Gmail from Mattermost\n" +
-		"* `/gmail import mail <message-id>` - Import a mail/message from Gmail using message ID.\n\nNote: To get ID of any mail, click on the 3 dots after opening the mail, and then select 'Show Original'. You will see the Message ID at the top in a new tab\n" +
-		"* `/gmail import thread <thread-message-id>` - Import a complete Gmail thread (conversation) using ID of any mail in the thread\n" +
-		"* `/gmail subscribe <optional-label-ids>` - Subscribe to get notifications from the Gmail Bot for the labels mentioned. Mention the label IDs in comma-separated fashion from the list: INBOX, CATEGORY_PERSONAL, CATEGORY_SOCIAL, CATEGORY_PROMOTIONS, CATEGORY_UPDATES, CATEGORY_FORUMS. The default label is INBOX.\n" +
-		"* `/gmail unsubscribe <optional-label-ids>` - Unsubscribe from the mentioned labels (should be comma-separated). If none is mentioned, you'll be unsubscribed from all the label IDs. It might take a few minutes for the effect to take place.\n" +
-		"* `/gmail subscriptions` - Display label IDs currently subscribed to\n" +
+		"* `/gmail import mail <message-id-or-url>` - Import a mail/message from Gmail using its Message ID (from 'Show Original'), the URL of its 'Show Original' tab, its Gmail API ID, or `search:\"<gmail-search-query>\"`. If several mails match, you can choose the one to import\n" +
+		"* `/gmail import thread <thread-message-id-or-url> <optional --follow>` - Import a complete Gmail thread (conversation) using ID of any mail in the thread, a Gmail URL of the thread or `search:\"<gmail-search-query>\"`. Importing it again only adds the mails not imported yet. Add `--follow` to keep adding its new mails to the Mattermost thread\n" +
+		"* `/gmail search <gmail-search-query>` - List the mails matching the query, 5 at a time, with buttons to import a mail or its thread in the channel\n" +
+		"* `/gmail import search \"<gmail-search-query>\" <optional --limit N> <optional --order oldest|newest> <optional --threads>` - Import, in the background, up to N (100 by default, 500 at most) mails matching the query, or their threads with `--threads`. The progress post has a button to cancel the import\n" +
+		"* `/gmail following` - List the Gmail threads you follow, with a button to unfollow each one\n" +
+		"* `/gmail subscribe <optional-labels> <optional --channel ~channel-name>` - Subscribe to get notifications from the Gmail Bot for the labels mentioned. Mention the label names or IDs in comma-separated fashion, for eg. INBOX, SENT, IMPORTANT, CATEGORY_SOCIAL or your own labels like Customers/ACME. By default, you are subscribed to INBOX and the category labels. Add `--channel ~channel-name` to deliver the mails of the labels to a channel you can post in, instead of your direct messages with the Gmail Bot.\n" +
+		"* `/gmail unsubscribe <optional-labels>` - Unsubscribe from the mentioned labels (should be comma-separated). If none is mentioned, you'll be unsubscribed from all the labels. It might take a few minutes for the effect to take place.\n" +
+		"* `/gmail subscribe query \"<gmail-search-query>\" <optional --name name> <optional --channel ~channel-name>` - Subscribe to get notifications for the new mails matching the Gmail search query, for eg. `from:pagerduty.com subject:(P1 OR P2)`. A subscription with the same name is replaced. Add `--channel ~channel-name` to deliver the matching mails to a channel.\n" +
+		"* `/gmail unsubscribe query <optional-name>` - Remove the query subscription with the name. If none is mentioned, you'll be unsubscribed from all the queries.\n" +
+		"* `/gmail subscriptions` - Display labels and queries currently subscribed to\n" +
+		"* `/gmail connect --channel` - (Channel admins only) Connect a shared Gmail account, like support@, to the current channel. Its mails are posted to the channel for all its members\n" +
+		"* `/gmail disconnect --channel` - (Channel admins only) Disconnect the shared Gmail account from the current channel\n" +
+		"* Add `--shared` to `/gmail subscribe`, `/gmail unsubscribe` and `/gmail subscriptions` to manage the subscriptions of the shared Gmail account of the current channel. Only channel admins can change them\n" +
+		"* `/gmail send` - Compose and send a new mail from a dialog. The body is written in Markdown. When run from a thread, the files of the post you reply to are attached\n" +
+		"* `/gmail forward-thread <optional-permalink> to:<addresses>` - Email a Mattermost thread, with the names of the authors, the times of the posts and its files, from your Gmail account. Give the permalink of any post of the thread, or run the command from the thread. A preview is shown before the mail is sent\n" +
+		"* Reply in the thread of a mail starting with `!reply` or `!replyall` to answer it from Gmail, for eg. `!reply Thanks, we are on it`. Files attached to the reply are sent along\n" +
+		"* `/gmail sync <optional-kind> <optional-on-or-off>` - Show or choose which changes made in Gmail are shown on the posts of the mails: read, archive, star, labels or delete. All are synced by default. Add `--shared` for the shared Gmail account of the current channel\n" +
+		"* Use the buttons of the mails posted by the Gmail Bot to mark them read, archive, star, trash or label them in Gmail\n" +
+		"* `/gmail deadletters <optional-retry-or-clear>` - (System admins only) List, retry or clear the notifications that could not be processed after several attempts\n" +
 		"* `/gmail help` - Display help about this plugin"
 )
 
@@ -26,14 +40,24 @@ const (
 	ActionCancel = "ActionCancel"
 )
 
+// delivery modes of Gmail notifications
+const (
+	// deliveryModePush receives notifications pushed by Pub/Sub to the webhook
+	deliveryModePush = "push"
+	// deliveryModePull pulls notifications from a Pub/Sub subscription
+	deliveryModePull = "pull"
+	// deliveryModePoll polls the history of every mailbox, without Pub/Sub
+	deliveryModePoll = "poll"
+)
+
 // specific to scope required
 const (
 	emailScope = "https://www.googleapis.com/auth/userinfo.email"
 )
 
-// label IDs supported
-// Note: supportedLabelIDs used as set data structure
-var supportedLabelIDs = map[string]int{
+// label IDs subscribed to when no label is given
+// Note: defaultLabelIDs used as set data structure
+var defaultLabelIDs = map[string]int{
 	/* Label */            /* Any valid int*/
 	"INBOX":               1,
 	"CATEGORY_PROMOTIONS": 2,
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// keysPerPage is the page size used while listing keys of the KV store
+const keysPerPage = 100
+
+// tokenKeySuffix is appended to the user ID to form the KV key of the stored OAuth token
+const tokenKeySuffix = "gmailToken"
+
+// encryptionKeyFingerprintKey is the KV key of the fingerprint of the encryption key the stored tokens are encrypted
+// with. Only the fingerprint is stored, as the key itself would decrypt the tokens stored next to it.
+const encryptionKeyFingerprintKey = "encryptionKeyFingerprint"
+
+// encryptionMaxRetries bounds the attempts to update a stored token, or the fingerprint, when it is modified concurrently
+const encryptionMaxRetries = 10
+
+// getEncryptionKey derives a 256 bit AES key from the EncryptionKey plugin setting
+func getEncryptionKey(secret string) []byte {
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+// getEncryptionKeyFingerprint returns a fingerprint of the key derived from the secret, telling whether the key changed
+// without revealing it
+func getEncryptionKeyFingerprint(secret string) []byte {
+	mac := hmac.New(sha256.New, getEncryptionKey(secret))
+	mac.Write([]byte(encryptionKeyFingerprintKey))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// encrypt seals the plain text with AES-GCM and returns nonce and cipher text encoded in base64
+func encrypt(key []byte, plainText []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := aesGCM.Seal(nonce, nonce, plainText, nil)
+	encoded := make([]byte, base64.URLEncoding.EncodedLen(len(sealed)))
+	base64.URLEncoding.Encode(encoded, sealed)
+	return encoded, nil
+}
+
+// decrypt opens cipher text produced by encrypt. Tampered data or a wrong key results in an error.
+func decrypt(key []byte, encoded []byte) ([]byte, error) {
+	sealed := make([]byte, base64.URLEncoding.DecodedLen(len(encoded)))
+	n, err := base64.URLEncoding.Decode(sealed, encoded)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[:n]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aesGCM.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("Cipher text is too short")
+	}
+
+	return aesGCM.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+}
+
+// isPlainTextToken reports whether a stored token was written before tokens were encrypted
+func isPlainTextToken(storedToken []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(storedToken), []byte("{"))
+}
+
+// storeTokenForUser encrypts the OAuth token of the user and stores it in the KV store
+func (p *Plugin) storeTokenForUser(userID string, token *oauth2.Token) error {
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	encryptedToken, err := encrypt(getEncryptionKey(p.getConfiguration().EncryptionKey), tokenJSON)
+	if err != nil {
+		return errors.Wrap(err, "Could not encrypt the token")
+	}
+
+	if appErr := p.API.KVSet(userID+tokenKeySuffix, encryptedToken); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// getTokenForUser reads the stored OAuth token of the user and decrypts it
+func (p *Plugin) getTokenForUser(userID string) (*oauth2.Token, error) {
+	storedToken, appErr := p.API.KVGet(userID + tokenKeySuffix)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if storedToken == nil {
+		return nil, errors.New("Gmail token not found. Please connect using `/gmail connect`")
+	}
+
+	tokenJSON := storedToken
+	if !isPlainTextToken(storedToken) {
+		var err error
+		tokenJSON, err = p.decryptToken(storedToken)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not decrypt the Gmail token. Please reconnect using `/gmail connect`")
+		}
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(tokenJSON, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// decryptToken decrypts a stored token with the current encryption key, or else with the previous one if the token
+// has not been re-encrypted yet
+func (p *Plugin) decryptToken(storedToken []byte) ([]byte, error) {
+	tokenJSON, err := decrypt(getEncryptionKey(p.getConfiguration().EncryptionKey), storedToken)
+	if err == nil {
+		return tokenJSON, nil
+	}
+
+	previousSecret := p.getPreviousEncryptionKey()
+	if previousSecret == "" {
+		return nil, err
+	}
+	return decrypt(getEncryptionKey(previousSecret), storedToken)
+}
+
+// getPreviousEncryptionKey returns the encryption key replaced by the last change of the configuration, if any
+func (p *Plugin) getPreviousEncryptionKey() string {
+	p.configurationLock.RLock()
+	defer p.configurationLock.RUnlock()
+
+	return p.previousEncryptionKey
+}
+
+// setPreviousEncryptionKey keeps the replaced encryption key in memory, to decrypt the tokens not re-encrypted yet
+func (p *Plugin) setPreviousEncryptionKey(secret string) {
+	p.configurationLock.Lock()
+	defer p.configurationLock.Unlock()
+
+	p.previousEncryptionKey = secret
+}
+
+// updateStoredToken replaces the stored token of the user with the one returned by the update, using compare-and-set
+// and retrying with the token read again if it was modified concurrently, for eg. by a refresh. The update returns
+// false if the token needs no change. It returns whether the token was replaced.
+func (p *Plugin) updateStoredToken(userID string, update func(storedToken []byte) ([]byte, bool, error)) (bool, error) {
+	for attempt := 0; attempt < encryptionMaxRetries; attempt++ {
+		storedToken, appErr := p.API.KVGet(userID + tokenKeySuffix)
+		if appErr != nil {
+			return false, appErr
+		}
+		if storedToken == nil {
+			return false, nil
+		}
+
+		updatedToken, changed, err := update(storedToken)
+		if err != nil || !changed {
+			return false, err
+		}
+
+		updated, appErr := p.API.KVCompareAndSet(userID+tokenKeySuffix, storedToken, updatedToken)
+		if appErr != nil {
+			return false, appErr
+		}
+		if updated {
+			return true, nil
+		}
+	}
+	return false, errors.New("Could not update the token, too many concurrent updates")
+}
+
+// getConnectedUserIDs lists the IDs of all the users who have a Gmail token stored
+func (p *Plugin) getConnectedUserIDs() ([]string, error) {
+	userIDs := []string{}
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, keysPerPage)
+		if appErr != nil {
+			return nil, appErr
+		}
+
+		for _, key := range keys {
+			if strings.HasSuffix(key, tokenKeySuffix) {
+				userIDs = append(userIDs, strings.TrimSuffix(key, tokenKeySuffix))
+			}
+		}
+
+		if len(keys) < keysPerPage {
+			return userIDs, nil
+		}
+	}
+}
+
+// encryptPlainTextTokens is a one time migration encrypting tokens stored by earlier versions of the plugin
+func (p *Plugin) encryptPlainTextTokens() error {
+	userIDs, err := p.getConnectedUserIDs()
+	if err != nil {
+		return err
+	}
+
+	key := getEncryptionKey(p.getConfiguration().EncryptionKey)
+	migrated := 0
+	for _, userID := range userIDs {
+		// Only replace the token if it was not updated in the meantime
+		updated, err := p.updateStoredToken(userID, func(storedToken []byte) ([]byte, bool, error) {
+			if !isPlainTextToken(storedToken) {
+				return nil, false, nil
+			}
+			encryptedToken, err := encrypt(key, storedToken)
+			return encryptedToken, true, err
+		})
+		if err != nil {
+			p.API.LogError("Could not encrypt the token of the user with user ID: "+userID, "err", err.Error())
+			continue
+		}
+		if updated {
+			migrated++
+		}
+	}
+
+	if migrated > 0 {
+		p.API.LogInfo("Encrypted stored Gmail tokens", "count", migrated)
+	}
+	return nil
+}
+
+// syncEncryptionKey re-encrypts the stored tokens with newSecret if the encryption key changed from oldSecret, the
+// key of the previous configuration, and records the fingerprint of the new key. The old key is kept in memory to
+// decrypt the tokens not re-encrypted yet. A key changed while the plugin was inactive cannot be known, so only a
+// warning is logged then.
+func (p *Plugin) syncEncryptionKey(oldSecret, newSecret string) error {
+	if newSecret == "" {
+		return nil
+	}
+	if oldSecret != "" && oldSecret != newSecret {
+		p.setPreviousEncryptionKey(oldSecret)
+	}
+
+	fingerprint := getEncryptionKeyFingerprint(newSecret)
+	for attempt := 0; attempt < encryptionMaxRetries; attempt++ {
+		storedFingerprint, appErr := p.API.KVGet(encryptionKeyFingerprintKey)
+		if appErr != nil {
+			return appErr
+		}
+		// Already recorded, for eg. by another server of the cluster
+		if hmac.Equal(storedFingerprint, fingerprint) {
+			return nil
+		}
+
+		switch {
+		case oldSecret != "" && oldSecret != newSecret:
+			if err := p.rotateEncryptionKey(oldSecret, newSecret); err != nil {
+				return err
+			}
+		case storedFingerprint != nil:
+			p.API.LogWarn("The encryption key was changed while the plugin was inactive. The Gmail tokens encrypted with the previous key cannot be decrypted, their users need to connect again using `/gmail connect`.")
+		}
+
+		updated, appErr := p.API.KVCompareAndSet(encryptionKeyFingerprintKey, storedFingerprint, fingerprint)
+		if appErr != nil {
+			return appErr
+		}
+		if updated {
+			return nil
+		}
+	}
+	return errors.New("Could not record the encryption key, too many concurrent updates")
+}
+
+// rotateEncryptionKey re-encrypts all stored tokens that were encrypted with oldSecret using newSecret
+func (p *Plugin) rotateEncryptionKey(oldSecret, newSecret string) error {
+	userIDs, err := p.getConnectedUserIDs()
+	if err != nil {
+		return err
+	}
+
+	oldKey := getEncryptionKey(oldSecret)
+	newKey := getEncryptionKey(newSecret)
+	for _, userID := range userIDs {
+		_, err := p.updateStoredToken(userID, func(storedToken []byte) ([]byte, bool, error) {
+			tokenJSON := storedToken
+			if !isPlainTextToken(storedToken) {
+				// Already re-encrypted, for eg. by another server of the cluster
+				if _, err := decrypt(newKey, storedToken); err == nil {
+					return nil, false, nil
+				}
+
+				var err error
+				tokenJSON, err = decrypt(oldKey, storedToken)
+				if err != nil {
+					return nil, false, errors.Wrap(err, "could not decrypt the token using the previous key")
+				}
+			}
+
+			encryptedToken, err := encrypt(newKey, tokenJSON)
+			return encryptedToken, true, err
+		})
+		if err != nil {
+			p.API.LogError("Could not re-encrypt the token of the user with user ID: "+userID, "err", err.Error())
+		}
+	}
+
+	p.API.LogInfo("Re-encrypted stored Gmail tokens with the new encryption key")
+	return nil
+}
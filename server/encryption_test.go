@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestSyncEncryptionKey(t *testing.T) {
+	const (
+		oldSecret = "old-encryption-key"
+		newSecret = "new-encryption-key"
+	)
+
+	for name, test := range map[string]struct {
+		storedWith        string
+		storedFingerprint string
+		oldSecret         string
+		expectDecryptable bool
+		expectWarning     bool
+	}{
+		"first start records the fingerprint": {
+			storedWith:        newSecret,
+			expectDecryptable: true,
+		},
+		"unchanged key": {
+			storedWith:        newSecret,
+			storedFingerprint: newSecret,
+			oldSecret:         newSecret,
+			expectDecryptable: true,
+		},
+		"key changed in the configuration": {
+			storedWith:        oldSecret,
+			storedFingerprint: oldSecret,
+			oldSecret:         oldSecret,
+			expectDecryptable: true,
+		},
+		"key changed by another server": {
+			storedWith:        oldSecret,
+			storedFingerprint: newSecret,
+			oldSecret:         oldSecret,
+			expectDecryptable: true,
+		},
+		"key changed while the plugin was inactive": {
+			storedWith:        oldSecret,
+			storedFingerprint: oldSecret,
+			expectWarning:     true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			store := mockKVStore(api)
+			api.On("LogInfo", mock.Anything).Maybe()
+			api.On("LogWarn", mock.Anything).Maybe()
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			p.setConfiguration(&configuration{EncryptionKey: test.storedWith})
+			require.NoError(t, p.storeTokenForUser("user-id", &oauth2.Token{AccessToken: "access-token"}))
+			if test.storedFingerprint != "" {
+				store.set(encryptionKeyFingerprintKey, getEncryptionKeyFingerprint(test.storedFingerprint))
+			}
+
+			p.setConfiguration(&configuration{EncryptionKey: newSecret})
+			require.NoError(t, p.syncEncryptionKey(test.oldSecret, newSecret))
+
+			// Only a fingerprint of the key is stored
+			assert.Equal(t, getEncryptionKeyFingerprint(newSecret), store.get(encryptionKeyFingerprintKey))
+			for key, value := range store.values {
+				assert.False(t, bytes.Contains(value, []byte(newSecret)), key)
+				assert.False(t, bytes.Contains(value, []byte(oldSecret)), key)
+			}
+
+			token, err := p.getTokenForUser("user-id")
+			if test.expectDecryptable {
+				require.NoError(t, err)
+				assert.Equal(t, "access-token", token.AccessToken)
+			} else {
+				assert.Error(t, err)
+			}
+			if test.expectWarning {
+				api.AssertCalled(t, "LogWarn", mock.Anything)
+			} else {
+				api.AssertNotCalled(t, "LogWarn", mock.Anything)
+			}
+		})
+	}
+
+	t.Run("previous key decrypts tokens not re-encrypted yet", func(t *testing.T) {
+		api := &plugintest.API{}
+		store := mockKVStore(api)
+
+		p := &Plugin{}
+		p.SetAPI(api)
+		p.setConfiguration(&configuration{EncryptionKey: oldSecret})
+		require.NoError(t, p.storeTokenForUser("user-id", &oauth2.Token{AccessToken: "access-token"}))
+		// Recorded by another server, which re-encrypted the tokens it listed
+		store.set(encryptionKeyFingerprintKey, getEncryptionKeyFingerprint(newSecret))
+
+		p.setConfiguration(&configuration{EncryptionKey: newSecret})
+		require.NoError(t, p.syncEncryptionKey(oldSecret, newSecret))
+		store.set("user-id"+tokenKeySuffix, mustEncryptToken(t, oldSecret, `{"access_token":"access-token"}`))
+
+		token, err := p.getTokenForUser("user-id")
+		require.NoError(t, err)
+		assert.Equal(t, "access-token", token.AccessToken)
+	})
+}
+
+// mustEncryptToken returns the token JSON encrypted with the secret as it is stored
+func mustEncryptToken(t *testing.T, secret string, tokenJSON string) []byte {
+	t.Helper()
+
+	encryptedToken, err := encrypt(getEncryptionKey(secret), []byte(tokenJSON))
+	require.NoError(t, err)
+	return encryptedToken
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// ActionUnfollowThread is used in Post action to identify the button unfollowing a Gmail thread
+	ActionUnfollowThread = "ActionUnfollowThread"
+
+	// followedThreadsMaxCount bounds the Gmail threads a user follows
+	followedThreadsMaxCount = 50
+
+	// importedThreadMaxRetries bounds the attempts to update an imported thread when it is modified concurrently
+	importedThreadMaxRetries = 10
+)
+
+// importedThread records a Gmail thread imported into a channel: the Mattermost thread it was posted in and the
+// mails posted so far, so that a re-import only posts the new mails
+type importedThread struct {
+	ChannelID  string
+	ThreadID   string
+	RootID     string
+	Subject    string
+	MessageIDs []string
+	// FollowedBy is the user whose notifications add the new mails of the Gmail thread, if any
+	FollowedBy string
+}
+
+// followedThreadRef identifies a Gmail thread followed by a user in a channel
+type followedThreadRef struct {
+	ChannelID string
+	ThreadID  string
+}
+
+// importedThreadKey returns the key of the Gmail thread imported into a channel. Gmail thread IDs are 16 hex
+// digits, which keeps the key within the 50 characters allowed.
+func importedThreadKey(channelID string, threadID string) string {
+	return "f_" + channelID + "_" + threadID
+}
+
+// getImportedThread returns the Gmail thread imported into the channel along with its stored value, used for
+// compare-and-set. Nil is returned if the thread was not imported into the channel.
+func (p *Plugin) getImportedThread(channelID string, threadID string) (*importedThread, []byte, error) {
+	storedThread, appErr := p.API.KVGet(importedThreadKey(channelID, threadID))
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	if storedThread == nil {
+		return nil, nil, nil
+	}
+
+	thread := &importedThread{}
+	if err := json.Unmarshal(storedThread, thread); err != nil {
+		return nil, nil, err
+	}
+	return thread, storedThread, nil
+}
+
+// updateImportedThread applies the update to the Gmail thread imported into the channel using compare-and-set,
+// retrying if it was modified concurrently. The update receives nil if the thread was not imported yet, and
+// returns the thread to store, or nil if nothing needs to be written.
+func (p *Plugin) updateImportedThread(channelID string, threadID string, update func(thread *importedThread) *importedThread) error {
+	for attempt := 0; attempt < importedThreadMaxRetries; attempt++ {
+		thread, storedThread, err := p.getImportedThread(channelID, threadID)
+		if err != nil {
+			return err
+		}
+
+		thread = update(thread)
+		if thread == nil {
+			return nil
+		}
+		updatedThread, err := json.Marshal(thread)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(updatedThread, storedThread) {
+			return nil
+		}
+
+		updated, appErr := p.API.KVCompareAndSet(importedThreadKey(channelID, threadID), storedThread, updatedThread)
+		if appErr != nil {
+			return appErr
+		}
+		if updated {
+			return nil
+		}
+	}
+
+	return errors.New("Could not update the imported thread, too many concurrent updates")
+}
+
+// getFollowedThreadsOfUser returns the Gmail threads followed by the user
+func (p *Plugin) getFollowedThreadsOfUser(userID string) ([]*followedThreadRef, error) {
+	followedThreads := []*followedThreadRef{}
+	storedThreads, appErr := p.API.KVGet(userID + "followedThreads")
+	if appErr != nil {
+		return nil, appErr
+	}
+	if storedThreads == nil {
+		return followedThreads, nil
+	}
+	if err := json.Unmarshal(storedThreads, &followedThreads); err != nil {
+		return nil, err
+	}
+	return followedThreads, nil
+}
+
+// updateFollowedThreadsOfUser stores the Gmail threads followed by the user
+func (p *Plugin) updateFollowedThreadsOfUser(userID string, followedThreads []*followedThreadRef) error {
+	if len(followedThreads) == 0 {
+		if appErr := p.API.KVDelete(userID + "followedThreads"); appErr != nil {
+			return appErr
+		}
+		return nil
+	}
+
+	threadsJSON, err := json.Marshal(followedThreads)
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(userID+"followedThreads", threadsJSON); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// followThread makes the new mails of the Gmail thread, seen through the notifications of the user, be added
+// to the Mattermost thread it was imported in
+func (p *Plugin) followThread(userID string, channelID string, threadID string) error {
+	followedThreads, err := p.getFollowedThreadsOfUser(userID)
+	if err != nil {
+		return err
+	}
+
+	followed := false
+	for _, ref := range followedThreads {
+		followed = followed || (ref.ChannelID == channelID && ref.ThreadID == threadID)
+	}
+	if !followed {
+		if len(followedThreads) >= followedThreadsMaxCount {
+			return errors.Errorf("you can follow at most %d threads. Use `/%s following` to unfollow some", followedThreadsMaxCount, commandGmail)
+		}
+		followedThreads = append(followedThreads, &followedThreadRef{ChannelID: channelID, ThreadID: threadID})
+		if err = p.updateFollowedThreadsOfUser(userID, followedThreads); err != nil {
+			return err
+		}
+	}
+
+	return p.updateImportedThread(channelID, threadID, func(thread *importedThread) *importedThread {
+		if thread == nil || thread.FollowedBy == userID {
+			return nil
+		}
+		thread.FollowedBy = userID
+		return thread
+	})
+}
+
+// unfollowThread stops adding the new mails of the Gmail thread to the channel for the user
+func (p *Plugin) unfollowThread(userID string, channelID string, threadID string) error {
+	followedThreads, err := p.getFollowedThreadsOfUser(userID)
+	if err != nil {
+		return err
+	}
+
+	remainFollowed := []*followedThreadRef{}
+	for _, ref := range followedThreads {
+		if ref.ChannelID != channelID || ref.ThreadID != threadID {
+			remainFollowed = append(remainFollowed, ref)
+		}
+	}
+	if err = p.updateFollowedThreadsOfUser(userID, remainFollowed); err != nil {
+		return err
+	}
+
+	return p.updateImportedThread(channelID, threadID, func(thread *importedThread) *importedThread {
+		if thread == nil || thread.FollowedBy != userID {
+			return nil
+		}
+		thread.FollowedBy = ""
+		return thread
+	})
+}
+
+// unfollowThreadsOfChannel unfollows the Gmail threads the user follows in the channel
+func (p *Plugin) unfollowThreadsOfChannel(userID string, channelID string) {
+	followedThreads, err := p.getFollowedThreadsOfUser(userID)
+	if err != nil {
+		p.API.LogError("Could not get the followed threads of user with user ID: "+userID, "err", err.Error())
+		return
+	}
+	for _, ref := range followedThreads {
+		if ref.ChannelID != channelID {
+			continue
+		}
+		if err = p.unfollowThread(userID, ref.ChannelID, ref.ThreadID); err != nil {
+			p.API.LogError("Could not unfollow the thread with ID: "+ref.ThreadID, "err", err.Error())
+		}
+	}
+}
+
+// isRootPostOfChannel tells if the post still exists as a root post of the channel
+func (p *Plugin) isRootPostOfChannel(postID string, channelID string) bool {
+	if postID == "" {
+		return false
+	}
+	post, appErr := p.API.GetPost(postID)
+	return appErr == nil && post.DeleteAt == 0 && post.ChannelId == channelID && post.RootId == ""
+}
+
+// importThread posts the mails of the Gmail thread not yet imported into the channel, in the Mattermost thread of the
+// earlier import if it still exists. It returns the number of mails posted.
+func (p *Plugin) importThread(userID string, channelID string, gmailService *gmail.Service, gmailID string, threadID string) (int, error) {
+	thread, err := gmailService.Users.Threads.Get(gmailID, threadID).Format("metadata").MetadataHeaders("Subject").Do()
+	if err != nil {
+		return 0, err
+	}
+	if len(thread.Messages) == 0 {
+		return 0, errors.New("The thread has no mail")
+	}
+
+	imported, _, err := p.getImportedThread(channelID, threadID)
+	if err != nil {
+		return 0, err
+	}
+	rootID := ""
+	posted := map[string]bool{}
+	if imported != nil && p.isRootPostOfChannel(imported.RootID, channelID) {
+		rootID = imported.RootID
+		for _, messageID := range imported.MessageIDs {
+			posted[messageID] = true
+		}
+	}
+
+	messages := []*gmail.Message{}
+	for _, messageInfo := range thread.Messages {
+		if posted[messageInfo.Id] {
+			continue
+		}
+		message, mailErr := gmailService.Users.Messages.Get(gmailID, messageInfo.Id).Format("raw").Do()
+		if mailErr != nil {
+			return 0, errors.Wrap(mailErr, "Unable to get the mails of the thread")
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	if rootID, _, err = p.postMessages(messages, channelID, userID, false, rootID); err != nil {
+		return 0, err
+	}
+
+	subject := ""
+	if thread.Messages[0].Payload != nil {
+		subject = getHeader(thread.Messages[0].Payload.Headers, "Subject")
+	}
+	err = p.updateImportedThread(channelID, threadID, func(stored *importedThread) *importedThread {
+		if stored == nil || stored.RootID != rootID {
+			// First import, or the Mattermost thread of the earlier import was deleted
+			followedBy := ""
+			if stored != nil {
+				followedBy = stored.FollowedBy
+			}
+			stored = &importedThread{ChannelID: channelID, ThreadID: threadID, RootID: rootID, FollowedBy: followedBy}
+		}
+		stored.Subject = subject
+		for _, message := range messages {
+			stored.MessageIDs = append(stored.MessageIDs, message.Id)
+		}
+		return stored
+	})
+	if err != nil {
+		p.API.LogError("Could not record the imported thread with ID: "+threadID, "err", err.Error())
+	}
+	return len(messages), nil
+}
+
+// deliverFollowedThreadsToUser adds the new mails of the Gmail threads followed by the user to the Mattermost threads
+// they were imported in
+func (p *Plugin) deliverFollowedThreadsToUser(userID string, messages []*gmail.Message) error {
+	followedThreads, err := p.getFollowedThreadsOfUser(userID)
+	if err != nil {
+		return errors.Wrap(err, "Could not get the followed threads")
+	}
+	if len(followedThreads) == 0 {
+		return nil
+	}
+
+	channelsOfThread := map[string][]string{}
+	for _, ref := range followedThreads {
+		channelsOfThread[ref.ThreadID] = append(channelsOfThread[ref.ThreadID], ref.ChannelID)
+	}
+	// Keep the order of the mails for each followed thread
+	refs := []*followedThreadRef{}
+	messagesOfRef := map[followedThreadRef][]*gmail.Message{}
+	for _, message := range messages {
+		for _, channelID := range channelsOfThread[message.ThreadId] {
+			ref := followedThreadRef{ChannelID: channelID, ThreadID: message.ThreadId}
+			if _, ok := messagesOfRef[ref]; !ok {
+				refs = append(refs, &ref)
+			}
+			messagesOfRef[ref] = append(messagesOfRef[ref], message)
+		}
+	}
+
+	var postErr error
+	for _, ref := range refs {
+		if err = p.deliverFollowedThread(userID, ref, messagesOfRef[*ref]); err != nil {
+			p.API.LogError("Could not add the new mails of the followed thread with ID: "+ref.ThreadID, "err", err.Error())
+			postErr = err
+		}
+	}
+	return postErr
+}
+
+// deliverFollowedThread posts the mails of the followed thread which were not posted yet, claiming them first so that
+// overlapping notifications do not post them twice
+func (p *Plugin) deliverFollowedThread(userID string, ref *followedThreadRef, messages []*gmail.Message) error {
+	imported, _, err := p.getImportedThread(ref.ChannelID, ref.ThreadID)
+	if err != nil {
+		return err
+	}
+	if imported == nil || imported.FollowedBy != userID {
+		return nil
+	}
+	if !p.isRootPostOfChannel(imported.RootID, ref.ChannelID) || !p.canPostToChannel(userID, ref.ChannelID) {
+		p.API.LogInfo("Unfollowing the thread with ID: " + ref.ThreadID + " which cannot be continued in its channel")
+		return p.unfollowThread(userID, ref.ChannelID, ref.ThreadID)
+	}
+
+	claimed := []*gmail.Message{}
+	err = p.updateImportedThread(ref.ChannelID, ref.ThreadID, func(thread *importedThread) *importedThread {
+		claimed = []*gmail.Message{}
+		if thread == nil || thread.RootID != imported.RootID {
+			return nil
+		}
+		posted := map[string]bool{}
+		for _, messageID := range thread.MessageIDs {
+			posted[messageID] = true
+		}
+		for _, message := range messages {
+			if !posted[message.Id] {
+				posted[message.Id] = true
+				claimed = append(claimed, message)
+				thread.MessageIDs = append(thread.MessageIDs, message.Id)
+			}
+		}
+		if len(claimed) == 0 {
+			return nil
+		}
+		return thread
+	})
+	if err != nil || len(claimed) == 0 {
+		return err
+	}
+
+	_, postedIDs, err := p.postMessages(claimed, ref.ChannelID, userID, false, imported.RootID)
+	if err != nil {
+		// Let the mails which were not posted be posted again by a later notification
+		posted := map[string]bool{}
+		for _, messageID := range postedIDs {
+			posted[messageID] = true
+		}
+		failed := map[string]bool{}
+		for _, message := range claimed {
+			if !posted[message.Id] {
+				failed[message.Id] = true
+			}
+		}
+		releaseErr := p.updateImportedThread(ref.ChannelID, ref.ThreadID, func(thread *importedThread) *importedThread {
+			if thread == nil {
+				return nil
+			}
+			remainPosted := []string{}
+			for _, messageID := range thread.MessageIDs {
+				if !failed[messageID] {
+					remainPosted = append(remainPosted, messageID)
+				}
+			}
+			thread.MessageIDs = remainPosted
+			return thread
+		})
+		if releaseErr != nil {
+			p.API.LogError("Could not release the mails of the followed thread that were not posted", "err", releaseErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// handleFollowingCommand lists the Gmail threads followed by the user, with a button to unfollow each one
+func (p *Plugin) handleFollowingCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	post, err := p.followingListPost(args.UserId, args.ChannelId)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to list the threads you follow: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	p.API.SendEphemeralPost(args.UserId, post)
+	return &model.CommandResponse{}, nil
+}
+
+// followingListPost returns the ephemeral post listing the Gmail threads followed by the user
+func (p *Plugin) followingListPost(userID string, channelID string) (*model.Post, error) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		return nil, errors.New("Site URL is not defined in the App")
+	}
+
+	followedThreads, err := p.getFollowedThreadsOfUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	post := &model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: channelID,
+	}
+	attachments := []*model.SlackAttachment{}
+	for _, ref := range followedThreads {
+		imported, _, err := p.getImportedThread(ref.ChannelID, ref.ThreadID)
+		if err != nil {
+			return nil, err
+		}
+		// Followed by another user since
+		if imported == nil || imported.FollowedBy != userID {
+			continue
+		}
+
+		subject := imported.Subject
+		if subject == "" {
+			subject = "(no subject)"
+		}
+		text := "Followed in " + p.getChannelDisplayName(ref.ChannelID)
+		if channel, appErr := p.API.GetChannel(ref.ChannelID); appErr == nil {
+			if team, appErr := p.API.GetTeam(channel.TeamId); appErr == nil {
+				text += fmt.Sprintf(" · [Open thread](%s/%s/pl/%s)", *siteURL, team.Name, imported.RootID)
+			}
+		}
+		attachments = append(attachments, &model.SlackAttachment{
+			Title: subject,
+			Text:  text,
+			Actions: []*model.PostAction{{
+				Type: model.POST_ACTION_TYPE_BUTTON,
+				Name: "Unfollow",
+				Integration: &model.PostActionIntegration{
+					URL: fmt.Sprintf("%s/plugins/%s/command/unfollow", *siteURL, manifest.Id),
+					Context: map[string]interface{}{
+						"action":    ActionUnfollowThread,
+						"channelId": ref.ChannelID,
+						"threadId":  ref.ThreadID,
+						"signature": p.signAction(ActionUnfollowThread, userID, ref.ChannelID, ref.ThreadID),
+					},
+				},
+			}},
+		})
+	}
+
+	if len(attachments) == 0 {
+		post.Message = "You are not following any thread. Use `/" + commandGmail + " import thread <thread-message-id> --follow` to follow one."
+		return post, nil
+	}
+	post.Message = "You are following these Gmail threads. Their new mails are added to the threads they were imported in."
+	post.AddProp("attachments", attachments)
+	return post, nil
+}
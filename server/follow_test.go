@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestDeliverFollowedThread(t *testing.T) {
+	const (
+		userID    = "user-id"
+		channelID = "channel-id"
+		threadID  = "17da1e9dae1dc6d9"
+		rootID    = "root-id"
+	)
+	ref := &followedThreadRef{ChannelID: channelID, ThreadID: threadID}
+	messages := []*gmail.Message{testMessage("earlier", "earlier mail"), testMessage("first", "first mail"), testMessage("second", "second mail")}
+
+	api := &plugintest.API{}
+	store := mockKVStore(api)
+	mockLogs(api)
+	api.On("GetPost", rootID).Return(&model.Post{Id: rootID, ChannelId: channelID}, nil)
+	api.On("GetChannelMember", channelID, userID).Return(&model.ChannelMember{}, nil)
+	api.On("HasPermissionToChannel", userID, channelID, model.PERMISSION_CREATE_POST).Return(true)
+	api.On("GetConfig").Return(&model.Config{})
+	api.On("GetUser", mock.Anything).Return(nil, &model.AppError{Message: "not found"})
+
+	failing := true
+	posted := []string{}
+	api.On("CreatePost", mock.Anything).Return(func(post *model.Post) *model.Post {
+		return &model.Post{Id: model.NewId(), ChannelId: post.ChannelId}
+	}, func(post *model.Post) *model.AppError {
+		if failing && strings.Contains(post.Message, "second mail") {
+			return &model.AppError{Message: "database unavailable"}
+		}
+		posted = append(posted, strings.TrimSpace(post.Message))
+		return nil
+	})
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.setConfiguration(&configuration{})
+	store.set(userID+"gmailID", []byte("me@example.com"))
+	thread, err := json.Marshal(&importedThread{ChannelID: channelID, ThreadID: threadID, RootID: rootID, MessageIDs: []string{"earlier"}, FollowedBy: userID})
+	require.NoError(t, err)
+	store.set(importedThreadKey(channelID, threadID), thread)
+
+	postedIDs := func() []string {
+		thread, _, err := p.getImportedThread(channelID, threadID)
+		require.NoError(t, err)
+		return thread.MessageIDs
+	}
+
+	// Only the mail which could not be posted is released
+	assert.Error(t, p.deliverFollowedThread(userID, ref, messages))
+	assert.Equal(t, []string{"first mail"}, posted)
+	assert.Equal(t, []string{"earlier", "first"}, postedIDs())
+
+	// The next notification posts it, and only it
+	failing = false
+	posted = []string{}
+	require.NoError(t, p.deliverFollowedThread(userID, ref, messages))
+	assert.Equal(t, []string{"second mail"}, posted)
+	assert.Equal(t, []string{"earlier", "first", "second"}, postedIDs())
+}
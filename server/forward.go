@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/mattermost/mattermost-server/v5/utils/markdown"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ActionForwardThread is used in Post action to identify the button sending a thread by mail
+	ActionForwardThread = "ActionForwardThread"
+
+	// forwardMaxAttachmentsSize keeps the mail under the 25 MB limit of Gmail once the files are base64 encoded
+	forwardMaxAttachmentsSize = 18 * 1024 * 1024
+
+	// forwardPreviewMaxLength bounds the text of the thread shown in the preview
+	forwardPreviewMaxLength = 1500
+
+	// forwardSubjectMaxLength bounds the part of the first post used as the subject of the mail
+	forwardSubjectMaxLength = 80
+)
+
+// forwardedThread is the mail rendering the posts of a thread
+type forwardedThread struct {
+	Mail      *outgoingMail
+	PostCount int
+	FileIDs   []string
+	// LastPostAt is the creation time of the last post of the thread included in the mail
+	LastPostAt int64
+}
+
+// parsePostLink returns the ID of the post of a permalink, like https://chat.example.com/team/pl/<post-id>, or of a post ID
+func parsePostLink(link string) string {
+	link = strings.Trim(strings.TrimSpace(link), "<>")
+	if model.IsValidId(link) {
+		return link
+	}
+
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	segments := strings.Split(strings.Trim(linkURL.Path, "/"), "/")
+	if len(segments) < 2 || segments[len(segments)-2] != "pl" || !model.IsValidId(segments[len(segments)-1]) {
+		return ""
+	}
+	return segments[len(segments)-1]
+}
+
+// parseForwardThreadArgs splits `<permalink> to:<addresses>` into the link of the thread and the recipients
+func parseForwardThreadArgs(text string) (string, string) {
+	link := ""
+	recipients := []string{}
+	inRecipients := false
+	for _, word := range strings.Fields(text) {
+		if strings.HasPrefix(strings.ToLower(word), "to:") {
+			inRecipients = true
+			word = word[len("to:"):]
+		}
+		if !inRecipients {
+			if link == "" {
+				link = word
+			}
+			continue
+		}
+		if word = strings.Trim(word, ","); word != "" {
+			recipients = append(recipients, word)
+		}
+	}
+	return link, strings.Join(recipients, ", ")
+}
+
+// handleForwardThreadCommand shows the preview of the mail rendering a thread, with buttons to send or cancel it
+func (p *Plugin) handleForwardThreadCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	// `/gmail forward-thread <permalink> to:<addresses>`
+	if p.checkIfConnected(args.UserId) == false || p.isConnectionBroken(args.UserId) {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please connect yourself to Gmail using `/gmail connect`.")
+		return &model.CommandResponse{}, nil
+	}
+
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args.Command), "/"+commandGmail))
+	text = strings.TrimSpace(strings.TrimPrefix(text, "forward-thread"))
+	link, to := parseForwardThreadArgs(text)
+
+	postID := parsePostLink(link)
+	if link == "" {
+		// The thread the command is run from
+		postID = args.RootId
+	}
+	if postID == "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please give the permalink of a post of the thread, for eg. `/"+commandGmail+" forward-thread https://chat.example.com/team/pl/<post-id> to:customer@example.com`.")
+		return &model.CommandResponse{}, nil
+	}
+
+	recipients, err := parseAddressField(to)
+	if err != nil || len(recipients) == 0 {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please give valid recipients after `to:`, separated by commas, for eg. `to:customer@example.com,support@example.com`.")
+		return &model.CommandResponse{}, nil
+	}
+
+	thread, err := p.renderThreadMail(args.UserId, postID, 0)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to email the thread: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	thread.Mail.To = recipients
+	if err = p.checkAttachmentsSize(thread.FileIDs); err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to email the thread: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Error! Site URL is not defined in the App")
+		return &model.CommandResponse{}, nil
+	}
+
+	// The posts created after the preview are not sent. The context is signed so that the recipients or the
+	// thread cannot be changed after the preview.
+	joinedRecipients := strings.Join(recipients, ", ")
+	lastPostAt := strconv.FormatInt(thread.LastPostAt, 10)
+	actionContext := func(action string) map[string]interface{} {
+		return map[string]interface{}{
+			"action":     action,
+			"postId":     postID,
+			"to":         joinedRecipients,
+			"lastPostAt": lastPostAt,
+			"signature":  p.signAction(action, args.UserId, postID, joinedRecipients, lastPostAt),
+		}
+	}
+	sendButton := &model.PostAction{
+		Type: model.POST_ACTION_TYPE_BUTTON,
+		Name: "Send",
+		Integration: &model.PostActionIntegration{
+			URL:     fmt.Sprintf("%s/plugins/%s/command/forward", *siteURL, manifest.Id),
+			Context: actionContext(ActionForwardThread),
+		},
+	}
+	cancelButton := &model.PostAction{
+		Type: model.POST_ACTION_TYPE_BUTTON,
+		Name: "Cancel",
+		Integration: &model.PostActionIntegration{
+			URL:     fmt.Sprintf("%s/plugins/%s/command/forward", *siteURL, manifest.Id),
+			Context: actionContext(ActionCancel),
+		},
+	}
+
+	preview := thread.Mail.TextBody
+	if runes := []rune(preview); len(runes) > forwardPreviewMaxLength {
+		preview = string(runes[:forwardPreviewMaxLength]) + "…"
+	}
+	p.API.SendEphemeralPost(args.UserId, &model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: args.ChannelId,
+		RootId:    args.RootId,
+		Props: map[string]interface{}{
+			"attachments": []*model.SlackAttachment{{
+				Title: "Email this thread",
+				Fields: []*model.SlackAttachmentField{
+					{Title: "To", Value: joinedRecipients},
+					{Title: "Subject", Value: thread.Mail.Subject},
+					{Title: "Posts", Value: strconv.Itoa(thread.PostCount), Short: true},
+					{Title: "Files", Value: strconv.Itoa(len(thread.FileIDs)), Short: true},
+				},
+				Text:    "```\n" + preview + "\n```",
+				Actions: []*model.PostAction{sendButton, cancelButton},
+			}},
+		},
+	})
+	return &model.CommandResponse{}, nil
+}
+
+// renderThreadMail renders the thread of the post as a mail, with the names of the authors and the times of the posts.
+// Only the posts created until lastPostAt are included, if given. The user must be able to read the channel of the thread.
+func (p *Plugin) renderThreadMail(userID string, postID string, lastPostAt int64) (*forwardedThread, error) {
+	post, appErr := p.API.GetPost(postID)
+	if appErr != nil {
+		return nil, errors.New("the post was not found")
+	}
+	if !p.API.HasPermissionToChannel(userID, post.ChannelId, model.PERMISSION_READ_CHANNEL) {
+		return nil, errors.New("you cannot read the channel of the thread")
+	}
+
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.Id
+	}
+	postList, appErr := p.API.GetPostThread(rootID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "could not get the thread")
+	}
+	postList.SortByCreateAt()
+
+	location := p.getUserLocation(userID)
+	channelName := ""
+	if channel, appErr := p.API.GetChannel(post.ChannelId); appErr == nil {
+		channelName = channel.DisplayName
+	}
+
+	thread := &forwardedThread{Mail: &outgoingMail{}}
+	authors := map[string]string{}
+	var textBody, htmlBody strings.Builder
+	htmlBody.WriteString(`<div style="font-family: sans-serif; font-size: 14px;">`)
+	// Posts are sorted from the newest
+	for index := len(postList.Order) - 1; index >= 0; index-- {
+		threadPost := postList.Posts[postList.Order[index]]
+		if threadPost.IsSystemMessage() || threadPost.DeleteAt != 0 || (lastPostAt > 0 && threadPost.CreateAt > lastPostAt) {
+			continue
+		}
+
+		if _, ok := authors[threadPost.UserId]; !ok {
+			authors[threadPost.UserId] = "Unknown user"
+			if author, appErr := p.API.GetUser(threadPost.UserId); appErr == nil {
+				authors[threadPost.UserId] = author.GetDisplayName(model.SHOW_NICKNAME_FULLNAME)
+			}
+		}
+		postedAt := time.Unix(0, threadPost.CreateAt*int64(time.Millisecond)).In(location).Format("Jan 2, 2006 3:04 PM MST")
+
+		fmt.Fprintf(&textBody, "%s - %s\n%s\n\n", authors[threadPost.UserId], postedAt, threadPost.Message)
+		fmt.Fprintf(&htmlBody, `<p style="margin: 16px 0 4px;"><b>%s</b> <span style="color: #888;">%s</span></p><div>%s</div>`,
+			html.EscapeString(authors[threadPost.UserId]), html.EscapeString(postedAt), markdown.RenderHTML(threadPost.Message))
+
+		if thread.PostCount == 0 {
+			thread.Mail.Subject = threadSubject(channelName, threadPost.Message)
+		}
+		thread.PostCount++
+		thread.FileIDs = append(thread.FileIDs, threadPost.FileIds...)
+		thread.LastPostAt = threadPost.CreateAt
+	}
+	htmlBody.WriteString(`</div>`)
+
+	if thread.PostCount == 0 {
+		return nil, errors.New("the thread has no post to send")
+	}
+	thread.Mail.TextBody = strings.TrimSpace(textBody.String())
+	thread.Mail.HTMLBody = htmlBody.String()
+	return thread, nil
+}
+
+// threadSubject returns the subject of the mail of a thread, from the channel and the first line of its root post
+func threadSubject(channelName string, message string) string {
+	firstLine := strings.TrimSpace(strings.SplitN(strings.TrimSpace(message), "\n", 2)[0])
+	if runes := []rune(firstLine); len(runes) > forwardSubjectMaxLength {
+		firstLine = string(runes[:forwardSubjectMaxLength]) + "…"
+	}
+
+	subject := "Mattermost thread"
+	if channelName != "" {
+		subject += " in " + channelName
+	}
+	if firstLine != "" {
+		subject += ": " + firstLine
+	}
+	return subject
+}
+
+// checkAttachmentsSize returns an error if the files are too large to be sent in a mail
+func (p *Plugin) checkAttachmentsSize(fileIDs []string) error {
+	size := int64(0)
+	for _, fileID := range fileIDs {
+		fileInfo, appErr := p.API.GetFileInfo(fileID)
+		if appErr != nil {
+			return errors.Wrap(appErr, "could not get the attached file")
+		}
+		size += fileInfo.Size
+	}
+	if size > forwardMaxAttachmentsSize {
+		return errors.Errorf("the files of the thread weigh %d MB, more than the %d MB which can be sent by mail", size/(1024*1024), forwardMaxAttachmentsSize/(1024*1024))
+	}
+	return nil
+}
+
+// forwardThread renders the thread again and sends it from the mailbox of the user
+func (p *Plugin) forwardThread(userID string, postID string, to string, lastPostAt int64) ([]string, error) {
+	recipients, err := parseAddressField(to)
+	if err != nil || len(recipients) == 0 {
+		return nil, errors.New("invalid recipients")
+	}
+
+	thread, err := p.renderThreadMail(userID, postID, lastPostAt)
+	if err != nil {
+		return nil, err
+	}
+	thread.Mail.To = recipients
+	if err = p.checkAttachmentsSize(thread.FileIDs); err != nil {
+		return nil, err
+	}
+	if thread.Mail.Attachments, err = p.getPostAttachments(thread.FileIDs); err != nil {
+		return nil, err
+	}
+
+	gmailID, err := p.getGmailID(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail ID")
+	}
+	gmailService, err := p.getGmailService(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail service")
+	}
+	if _, err = sendMail(gmailService, gmailID, thread.Mail, ""); err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// ActionImportChoice is used in Post action to identify the button importing one of the mails matching an import
+	ActionImportChoice = "ActionImportChoice"
+
+	// importChooserMaxOptions bounds the mails offered when several match an import
+	importChooserMaxOptions = 10
+
+	// importSearchPrefix starts an import by Gmail search query
+	importSearchPrefix = "search:"
+)
+
+// gmailAPIIDPattern matches the IDs of messages and threads used by the Gmail API, and by older Gmail web URLs
+var gmailAPIIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// parseGmailWebURL returns the Gmail API message or thread ID found in a mail.google.com URL: the message
+// or thread of a `Show original` or print URL, or the hex thread ID ending older URLs. Newer URLs ending with
+// tokens like FMfcgz… cannot be resolved through the Gmail API.
+func parseGmailWebURL(link string) (string, string, error) {
+	webURL, err := url.Parse(link)
+	if err != nil || !strings.HasSuffix(webURL.Hostname(), "mail.google.com") {
+		return "", "", errors.New("Not a Gmail URL")
+	}
+
+	// `permmsgid=msg-f:<decimal>` and `permthid=thread-f:<decimal>` hold the decimal form of the API IDs
+	query := webURL.Query()
+	for _, parameter := range []struct {
+		name   string
+		prefix string
+		kind   string
+	}{
+		{"permmsgid", "msg-f:", "mail"},
+		{"permthid", "thread-f:", "thread"},
+	} {
+		value := query.Get(parameter.name)
+		if !strings.HasPrefix(value, parameter.prefix) {
+			continue
+		}
+		decimalID, err := strconv.ParseUint(strings.TrimPrefix(value, parameter.prefix), 10, 64)
+		if err != nil {
+			return "", "", errors.New("Invalid Gmail URL")
+		}
+		return strconv.FormatUint(decimalID, 16), parameter.kind, nil
+	}
+	if threadID := query.Get("th"); gmailAPIIDPattern.MatchString(threadID) {
+		return threadID, "thread", nil
+	}
+
+	// Like https://mail.google.com/mail/u/0/#inbox/<id>
+	segments := strings.Split(webURL.Fragment, "/")
+	lastSegment := segments[len(segments)-1]
+	if gmailAPIIDPattern.MatchString(lastSegment) {
+		return lastSegment, "thread", nil
+	}
+	return "", "", errors.New("This Gmail URL cannot be imported, as Gmail does not expose the ID of the mail in it. " +
+		"Open the mail, click on the three dots and select `Show original`, then paste the URL of the new tab, or use the Message ID it shows")
+}
+
+// findMessagesToImport returns the mails matching what the user gave to import: a Gmail web URL, a Gmail API message
+// or thread ID, an RFC 822 Message-ID, with or without angle brackets, or `search:"<gmail query>"`
+func findMessagesToImport(gmailService *gmail.Service, gmailID string, reference string) ([]*gmail.Message, error) {
+	reference = strings.TrimSpace(reference)
+
+	if strings.HasPrefix(strings.ToLower(reference), importSearchPrefix) {
+		query := trimQuotes(strings.TrimSpace(reference[len(importSearchPrefix):]))
+		if query == "" {
+			return nil, errors.New("Please give a Gmail search query, for eg. `search:\"from:jane@example.com invoice\"`")
+		}
+		listResponse, err := gmailService.Users.Messages.List(gmailID).Q(query).MaxResults(importChooserMaxOptions).Do()
+		if err != nil {
+			return nil, errors.Wrap(err, "Gmail could not run the query")
+		}
+		return listResponse.Messages, nil
+	}
+
+	id := strings.Trim(reference, "<>")
+	if strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://") {
+		apiID, kind, err := parseGmailWebURL(id)
+		if err != nil {
+			return nil, err
+		}
+		return findMessagesByAPIID(gmailService, gmailID, apiID, kind)
+	}
+
+	if gmailAPIIDPattern.MatchString(id) {
+		return findMessagesByAPIID(gmailService, gmailID, id, "")
+	}
+
+	listResponse, err := gmailService.Users.Messages.List(gmailID).Q("rfc822msgid:" + id).MaxResults(importChooserMaxOptions).Do()
+	if err != nil {
+		return nil, err
+	}
+	return listResponse.Messages, nil
+}
+
+// findMessagesByAPIID returns the message with the Gmail API ID, or the messages of the thread with the ID.
+// The kind tells which one the ID is, if known.
+func findMessagesByAPIID(gmailService *gmail.Service, gmailID string, id string, kind string) ([]*gmail.Message, error) {
+	if kind != "thread" {
+		message, err := gmailService.Users.Messages.Get(gmailID, id).Format("minimal").Do()
+		if err == nil {
+			return []*gmail.Message{message}, nil
+		}
+		if !isNotFoundError(err) {
+			return nil, err
+		}
+	}
+
+	thread, err := gmailService.Users.Threads.Get(gmailID, id).Format("minimal").Do()
+	if isNotFoundError(err) {
+		return []*gmail.Message{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return thread.Messages, nil
+}
+
+// uniqueThreads keeps the first of the messages of each thread
+func uniqueThreads(messages []*gmail.Message) []*gmail.Message {
+	seen := map[string]bool{}
+	threads := []*gmail.Message{}
+	for _, message := range messages {
+		if !seen[message.ThreadId] {
+			seen[message.ThreadId] = true
+			threads = append(threads, message)
+		}
+	}
+	return threads
+}
+
+// importFromGmail imports the mail, or the thread, with the Gmail API ID into the channel, following the thread if asked.
+// It returns a message for the user, if any.
+func (p *Plugin) importFromGmail(userID string, channelID string, queryType string, id string, follow bool) (string, error) {
+	gmailID, err := p.getGmailID(userID)
+	if err != nil {
+		return "", err
+	}
+	gmailService, err := p.getGmailService(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if queryType == "thread" {
+		if follow && !p.canPostToChannel(userID, channelID) {
+			return "", errors.New("You cannot post in this channel, so its threads cannot be followed.")
+		}
+
+		// Only the mails not imported yet in this channel are posted
+		postedCount, err := p.importThread(userID, channelID, gmailService, gmailID, id)
+		if err != nil {
+			return "", err
+		}
+
+		message := ""
+		if postedCount == 0 {
+			message = "All the mails of this thread were already imported in this channel."
+		}
+		if follow {
+			if followErr := p.followThread(userID, channelID, id); followErr != nil {
+				message += " Unable to follow the thread: " + followErr.Error()
+			} else {
+				message += " You are following this thread: its new mails will be added to it. Use `/" + commandGmail + " following` to unfollow it."
+			}
+		}
+		return strings.TrimSpace(message), nil
+	}
+
+	message, err := gmailService.Users.Messages.Get(gmailID, id).Format("raw").Do()
+	if err != nil {
+		return "", errors.New("Unable to get the mail.")
+	}
+	p.API.LogInfo("Message extracted successfully")
+
+	if err = p.handleMessages([]*gmail.Message{message}, channelID, userID, false); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// importChooserPost returns the ephemeral post letting the user choose which of the matching mails, or of their
+// threads, to import
+func (p *Plugin) importChooserPost(userID string, channelID string, queryType string, follow bool, candidates []*gmail.Message) (*model.Post, error) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		return nil, errors.New("Site URL is not defined in the App")
+	}
+	gmailID, err := p.getGmailID(userID)
+	if err != nil {
+		return nil, err
+	}
+	gmailService, err := p.getGmailService(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := []*model.SlackAttachment{}
+	for _, candidate := range candidates {
+		id := candidate.Id
+		if queryType == "thread" {
+			id = candidate.ThreadId
+		}
+
+		title := "(no subject)"
+		text := ""
+		message, err := gmailService.Users.Messages.Get(gmailID, candidate.Id).Format("metadata").MetadataHeaders("From", "Subject", "Date").Do()
+		if err == nil && message.Payload != nil {
+			if subject := getHeader(message.Payload.Headers, "Subject"); subject != "" {
+				title = subject
+			}
+			text = getHeader(message.Payload.Headers, "From") + " · " + getHeader(message.Payload.Headers, "Date")
+		}
+
+		attachments = append(attachments, &model.SlackAttachment{
+			Title: title,
+			Text:  text,
+			Actions: []*model.PostAction{{
+				Type: model.POST_ACTION_TYPE_BUTTON,
+				Name: "Import " + queryType,
+				Integration: &model.PostActionIntegration{
+					URL: fmt.Sprintf("%s/plugins/%s/command/import", *siteURL, manifest.Id),
+					Context: map[string]interface{}{
+						"action":    ActionImportChoice,
+						"queryType": queryType,
+						"id":        id,
+						"follow":    strconv.FormatBool(follow),
+						"signature": p.signAction(ActionImportChoice, userID, queryType, id, strconv.FormatBool(follow)),
+					},
+				},
+			}},
+		})
+	}
+
+	post := &model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: channelID,
+		Message:   fmt.Sprintf("%d mails match. Choose the %s to import in this channel:", len(candidates), queryType),
+	}
+	post.AddProp("attachments", attachments)
+	return post, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseGmailWebURL(t *testing.T) {
+	for name, test := range map[string]struct {
+		link        string
+		expectID    string
+		expectKind  string
+		expectError string
+	}{
+		"message permalink": {
+			link:       "https://mail.google.com/mail/u/0?ik=abc123&view=om&permmsgid=msg-f:1718719870375151321",
+			expectID:   "17da1e9dae1dc6d9",
+			expectKind: "mail",
+		},
+		"thread permalink": {
+			link:       "https://mail.google.com/mail/u/0?ik=abc123&view=pt&search=all&permthid=thread-f:1718719870375151321",
+			expectID:   "17da1e9dae1dc6d9",
+			expectKind: "thread",
+		},
+		"message permalink preferred over thread permalink": {
+			link:       "https://mail.google.com/mail/u/0?permthid=thread-f:1&permmsgid=msg-f:255",
+			expectID:   "ff",
+			expectKind: "mail",
+		},
+		"invalid decimal ID": {
+			link:        "https://mail.google.com/mail/u/0?permmsgid=msg-f:17da1e9dae1dc6d9",
+			expectError: "Invalid Gmail URL",
+		},
+		"decimal ID out of range": {
+			link:        "https://mail.google.com/mail/u/0?permthid=thread-f:99999999999999999999",
+			expectError: "Invalid Gmail URL",
+		},
+		"legacy message ID prefix is ignored": {
+			link:        "https://mail.google.com/mail/u/0?permmsgid=msg-a:r123456",
+			expectError: "cannot be imported",
+		},
+		"thread parameter": {
+			link:       "https://mail.google.com/mail/?ui=2&view=cv&th=17da1e9dae1dc6d9",
+			expectID:   "17da1e9dae1dc6d9",
+			expectKind: "thread",
+		},
+		"invalid thread parameter": {
+			link:        "https://mail.google.com/mail/?th=not-an-id",
+			expectError: "cannot be imported",
+		},
+		"inbox fragment": {
+			link:       "https://mail.google.com/mail/u/0/#inbox/17da1e9dae1dc6d9",
+			expectID:   "17da1e9dae1dc6d9",
+			expectKind: "thread",
+		},
+		"label fragment": {
+			link:       "https://mail.google.com/mail/u/1/#label/Customers/17da1e9dae1dc6d9",
+			expectID:   "17da1e9dae1dc6d9",
+			expectKind: "thread",
+		},
+		"opaque token fragment": {
+			link:        "https://mail.google.com/mail/u/0/#inbox/FMfcgxwKjBXFgLbZxZLsRvXhCqBvjmKm",
+			expectError: "cannot be imported",
+		},
+		"upper case ID in fragment": {
+			link:        "https://mail.google.com/mail/u/0/#inbox/17DA1E9DAE1DC6D9",
+			expectError: "cannot be imported",
+		},
+		"inbox without mail": {
+			link:        "https://mail.google.com/mail/u/0/#inbox",
+			expectError: "cannot be imported",
+		},
+		"other host": {
+			link:        "https://example.com/mail/u/0/#inbox/17da1e9dae1dc6d9",
+			expectError: "Not a Gmail URL",
+		},
+		"Gmail host in the path": {
+			link:        "https://example.com/mail.google.com?th=17da1e9dae1dc6d9",
+			expectError: "Not a Gmail URL",
+		},
+		"unparsable URL": {
+			link:        "https://mail.google.com/%zz",
+			expectError: "Not a Gmail URL",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			id, kind, err := parseGmailWebURL(test.link)
+			if test.expectError != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), test.expectError)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectID, id)
+			assert.Equal(t, test.expectKind, kind)
+		})
+	}
+}
+
+func TestUniqueThreads(t *testing.T) {
+	for name, test := range map[string]struct {
+		messages  []*gmail.Message
+		expectIDs []string
+	}{
+		"no messages": {
+			messages:  []*gmail.Message{},
+			expectIDs: []string{},
+		},
+		"messages of different threads": {
+			messages:  []*gmail.Message{{Id: "a", ThreadId: "1"}, {Id: "b", ThreadId: "2"}},
+			expectIDs: []string{"a", "b"},
+		},
+		"first message of each thread is kept": {
+			messages:  []*gmail.Message{{Id: "a", ThreadId: "1"}, {Id: "b", ThreadId: "2"}, {Id: "c", ThreadId: "1"}, {Id: "d", ThreadId: "2"}},
+			expectIDs: []string{"a", "b"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ids := []string{}
+			for _, message := range uniqueThreads(test.messages) {
+				ids = append(ids, message.Id)
+			}
+			assert.Equal(t, test.expectIDs, ids)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// labelsCacheTTL is how long the labels of a user are cached before being listed again
+const labelsCacheTTL = time.Hour
+
+// userLabel is a Gmail label of the user, either a system label or one created by the user
+type userLabel struct {
+	ID   string
+	Name string
+}
+
+// getLabelsOfUser returns the labels of the mailbox of the user, from the cache unless refresh is set
+func (p *Plugin) getLabelsOfUser(userID string, refresh bool) ([]*userLabel, error) {
+	labels := []*userLabel{}
+	if !refresh {
+		cachedLabels, appErr := p.API.KVGet(userID + "labels")
+		if appErr != nil {
+			return nil, appErr
+		}
+		if cachedLabels != nil && json.Unmarshal(cachedLabels, &labels) == nil {
+			return labels, nil
+		}
+	}
+
+	gmailID, err := p.getGmailID(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail ID")
+	}
+	gmailService, err := p.getGmailService(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail service")
+	}
+
+	labelsResponse, err := gmailService.Users.Labels.List(gmailID).Do()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list the labels")
+	}
+
+	labels = []*userLabel{}
+	for _, label := range labelsResponse.Labels {
+		labels = append(labels, &userLabel{ID: label.Id, Name: label.Name})
+	}
+
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+	_, appErr := p.API.KVSetWithOptions(userID+"labels", labelsJSON, model.PluginKVSetOptions{
+		ExpireInSeconds: int64(labelsCacheTTL / time.Second),
+	})
+	if appErr != nil {
+		p.API.LogError("Could not cache the labels of user with user ID: "+userID, "err", appErr.Error())
+	}
+	return labels, nil
+}
+
+// checkAssignableLabel returns an error unless the label is one created by the user in the mailbox. System
+// labels such as SPAM or TRASH cannot be applied from the menu of a mail.
+func (p *Plugin) checkAssignableLabel(userID string, labelID string) error {
+	if !strings.HasPrefix(labelID, userLabelIDPrefix) {
+		return errors.New("The label cannot be applied")
+	}
+
+	// The label may have been created since the labels were cached
+	for _, refresh := range []bool{false, true} {
+		labels, err := p.getLabelsOfUser(userID, refresh)
+		if err != nil {
+			return errors.Wrap(err, "Could not get the labels")
+		}
+		for _, label := range labels {
+			if label.ID == labelID {
+				return nil
+			}
+		}
+	}
+	return errors.New("The label does not exist in the mailbox")
+}
+
+// findLabel looks for a label by ID, then by name. Case is ignored unless two labels only differ by case.
+func findLabel(labels []*userLabel, labelIDOrName string) *userLabel {
+	for _, label := range labels {
+		if label.ID == labelIDOrName || label.Name == labelIDOrName {
+			return label
+		}
+	}
+	for _, label := range labels {
+		if strings.EqualFold(label.ID, labelIDOrName) || strings.EqualFold(label.Name, labelIDOrName) {
+			return label
+		}
+	}
+	return nil
+}
+
+// resolveLabelsOfUser returns the IDs of the labels given by ID or name, along with the ones not found.
+// The labels are listed again if some are not found in the cache, as they may have been created recently.
+func (p *Plugin) resolveLabelsOfUser(userID string, labelIDsOrNames []string) ([]string, []string, error) {
+	labels, err := p.getLabelsOfUser(userID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for refreshed := false; ; refreshed = true {
+		labelIDs := []string{}
+		notFound := []string{}
+		for _, labelIDOrName := range labelIDsOrNames {
+			if label := findLabel(labels, labelIDOrName); label != nil {
+				labelIDs = append(labelIDs, label.ID)
+			} else {
+				notFound = append(notFound, labelIDOrName)
+			}
+		}
+
+		if len(notFound) == 0 || refreshed {
+			return labelIDs, notFound, nil
+		}
+
+		if labels, err = p.getLabelsOfUser(userID, true); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// getLabelNamesOfUser returns the names of the labels, falling back to the ID of the labels not found
+func (p *Plugin) getLabelNamesOfUser(userID string, labelIDs []string) []string {
+	labels, err := p.getLabelsOfUser(userID, false)
+	if err != nil {
+		p.API.LogError("Could not get the labels of user with user ID: "+userID, "err", err.Error())
+	}
+
+	names := []string{}
+	for _, labelID := range labelIDs {
+		name := labelID
+		for _, label := range labels {
+			if label.ID == labelID {
+				name = label.Name
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAssignableLabel(t *testing.T) {
+	const userID = "user-id"
+
+	cachedLabels, err := json.Marshal([]*userLabel{
+		{ID: "INBOX", Name: "INBOX"},
+		{ID: "SPAM", Name: "SPAM"},
+		{ID: "TRASH", Name: "TRASH"},
+		{ID: "Label_1", Name: "Customers"},
+	})
+	require.NoError(t, err)
+
+	for name, test := range map[string]struct {
+		labelID     string
+		expectError bool
+	}{
+		"label of the user":              {labelID: "Label_1"},
+		"spam":                           {labelID: "SPAM", expectError: true},
+		"trash":                          {labelID: "TRASH", expectError: true},
+		"system label":                   {labelID: "INBOX", expectError: true},
+		"category":                       {labelID: "CATEGORY_PROMOTIONS", expectError: true},
+		"empty label":                    {labelID: "", expectError: true},
+		"label not found in the mailbox": {labelID: "Label_2", expectError: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("KVGet", userID+"labels").Return(cachedLabels, nil)
+			// The labels cannot be listed again, as the user is not connected
+			api.On("KVGet", mock.Anything).Return(nil, nil)
+			api.On("LogError", mock.Anything, mock.Anything, mock.Anything).Maybe()
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			p.setConfiguration(&configuration{})
+
+			err := p.checkAssignableLabel(userID, test.labelID)
+			if test.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
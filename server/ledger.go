@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ledgerRetention is how long a delivered message is remembered. It must exceed resyncMaxAge.
+	ledgerRetention = 14 * 24 * time.Hour
+
+	// ledgerMaxRetries bounds the attempts to update the ledger when it is modified concurrently
+	ledgerMaxRetries = 10
+)
+
+// deliveryLedger records the history ID up to which the mailbox of a user has been processed, and the Gmail
+// messages already delivered to the user. Both are kept in one KV entry so that they are updated atomically.
+type deliveryLedger struct {
+	HistoryID uint64
+	// Delivered maps the delivery keys of the delivered Gmail messages to the time (ms) after which they are forgotten
+	Delivered map[string]int64
+}
+
+// deliveryKey returns the key recording the delivery of the message to the channel in the ledger, an empty channel ID
+// standing for the channel of the mailbox. A message routed to several channels is delivered to each one separately.
+func deliveryKey(messageID string, channelID string) string {
+	return messageID + "/" + channelID
+}
+
+// isDelivered tells if the ledger records the delivery of the key. Earlier versions of the plugin recorded the
+// messages delivered to any channel by their ID alone.
+func (ledger *deliveryLedger) isDelivered(key string) bool {
+	if _, delivered := ledger.Delivered[key]; delivered {
+		return true
+	}
+	_, delivered := ledger.Delivered[strings.SplitN(key, "/", 2)[0]]
+	return delivered
+}
+
+// getDeliveryLedger returns the ledger of the user along with its stored value, used for compare-and-set
+func (p *Plugin) getDeliveryLedger(userID string) (*deliveryLedger, []byte, error) {
+	ledger := &deliveryLedger{Delivered: map[string]int64{}}
+
+	storedLedger, appErr := p.API.KVGet(userID + "deliveryLedger")
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+
+	if storedLedger == nil {
+		// Users connected with earlier versions of the plugin only have the history ID stored
+		historyID, appErr := p.API.KVGet(userID + "historyID")
+		if appErr != nil {
+			return nil, nil, appErr
+		}
+		if historyID != nil {
+			ledger.HistoryID, _ = strconv.ParseUint(string(historyID), 10, 64)
+		}
+		return ledger, nil, nil
+	}
+
+	if err := json.Unmarshal(storedLedger, ledger); err != nil {
+		return nil, nil, err
+	}
+	if ledger.Delivered == nil {
+		ledger.Delivered = map[string]int64{}
+	}
+	return ledger, storedLedger, nil
+}
+
+// updateDeliveryLedger applies the update to the ledger of the user using compare-and-set, retrying if the
+// ledger was modified concurrently. The update returns false if nothing needs to be written.
+func (p *Plugin) updateDeliveryLedger(userID string, update func(ledger *deliveryLedger) bool) error {
+	for attempt := 0; attempt < ledgerMaxRetries; attempt++ {
+		ledger, storedLedger, err := p.getDeliveryLedger(userID)
+		if err != nil {
+			return err
+		}
+
+		if !update(ledger) {
+			return nil
+		}
+
+		// Forget the messages delivered long ago
+		now := model.GetMillis()
+		for messageID, expiresAt := range ledger.Delivered {
+			if expiresAt < now {
+				delete(ledger.Delivered, messageID)
+			}
+		}
+
+		updatedLedger, err := json.Marshal(ledger)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(updatedLedger, storedLedger) {
+			return nil
+		}
+
+		updated, appErr := p.API.KVCompareAndSet(userID+"deliveryLedger", storedLedger, updatedLedger)
+		if appErr != nil {
+			return appErr
+		}
+		if updated {
+			return nil
+		}
+	}
+
+	return errors.New("Could not update the delivery ledger, too many concurrent updates")
+}
+
+// claimMessagesForDelivery records the deliveries of messages to the user, given by their delivery keys, and returns
+// the keys of those which were not delivered before. Only the caller that claimed a delivery may post the message.
+func (p *Plugin) claimMessagesForDelivery(userID string, keys []string) (map[string]bool, error) {
+	claimed := map[string]bool{}
+	err := p.updateDeliveryLedger(userID, func(ledger *deliveryLedger) bool {
+		claimed = map[string]bool{}
+		expiresAt := model.GetMillisForTime(time.Now().Add(ledgerRetention))
+		for _, key := range keys {
+			if ledger.isDelivered(key) {
+				continue
+			}
+			ledger.Delivered[key] = expiresAt
+			claimed[key] = true
+		}
+		return len(claimed) > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// releaseMessagesForDelivery forgets claimed deliveries of messages which could not be posted, so that they are
+// delivered again
+func (p *Plugin) releaseMessagesForDelivery(userID string, keys []string) error {
+	return p.updateDeliveryLedger(userID, func(ledger *deliveryLedger) bool {
+		for _, key := range keys {
+			delete(ledger.Delivered, key)
+		}
+		return true
+	})
+}
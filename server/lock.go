@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// lockKeyPrefix prefixes the keys of the locks shared by all the servers of the cluster
+	lockKeyPrefix = "lock_"
+
+	// mailboxLockExpiry frees the lock of a mailbox whose server stopped while processing it.
+	// It exceeds the time needed to resync a mailbox.
+	mailboxLockExpiry = 15 * time.Minute
+)
+
+// tryLock acquires the lock of the name for the whole cluster, unless another process holds it.
+// The returned function releases the lock; it is nil when the lock is held by another process.
+// The lock expires if it is not released in time, so that a server stopping while holding it does not block the others.
+func (p *Plugin) tryLock(name string, expiry time.Duration) (func(), error) {
+	key := lockKeyPrefix + name
+	// The value identifies this holder, so that a lock taken over after expiring is not released by the previous holder
+	holder := []byte(model.NewId())
+	acquired, appErr := p.API.KVSetWithOptions(key, holder, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(expiry / time.Second),
+	})
+	if appErr != nil {
+		return nil, appErr
+	}
+	if !acquired {
+		return nil, nil
+	}
+
+	return func() {
+		if _, appErr := p.API.KVCompareAndDelete(key, holder); appErr != nil {
+			p.API.LogError("Could not release the lock "+name, "err", appErr.Error())
+		}
+	}, nil
+}
+
+// tryLockMailbox acquires the lock of the mailbox, held while its changes are processed by any server of the cluster.
+// The returned function releases the lock; it is nil when the mailbox is processed elsewhere.
+func (p *Plugin) tryLockMailbox(emailAddress string) (func(), error) {
+	return p.tryLock("mailbox_"+emailAddress, mailboxLockExpiry)
+}
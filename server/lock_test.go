@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTryLock(t *testing.T) {
+	api := &plugintest.API{}
+	store := mockKVStore(api)
+	mockLogs(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	unlock, err := p.tryLock("name", time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, unlock)
+
+	// Held by another process
+	otherUnlock, err := p.tryLock("name", time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, otherUnlock)
+
+	unlock()
+	otherUnlock, err = p.tryLock("name", time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, otherUnlock)
+
+	// A holder whose lock expired and was taken over does not release it
+	unlock()
+	assert.NotNil(t, store.get(lockKeyPrefix+"name"))
+	otherUnlock()
+	assert.Nil(t, store.get(lockKeyPrefix+"name"))
+}
+
+func TestNotificationQueueWork(t *testing.T) {
+	for name, test := range map[string]struct {
+		lockedElsewhere bool
+		expectPostponed bool
+	}{
+		"mailbox processed by another server": {
+			lockedElsewhere: true,
+			expectPostponed: true,
+		},
+		"mailbox processed by this server": {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			store := mockKVStore(api)
+			mockLogs(api)
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			job := &notificationJob{ID: "job-id", EmailAddress: "me@example.com", Notifications: 1}
+			jobs, err := json.Marshal([]*notificationJob{job})
+			require.NoError(t, err)
+			store.set(notificationQueueKey, jobs)
+			if test.lockedElsewhere {
+				store.set(lockKeyPrefix+"mailbox_me@example.com", []byte("other-server"))
+			}
+
+			queue := &notificationQueue{p: p, wakeUp: make(chan struct{}, 1), jobs: make(chan *notificationJob, 1), running: map[string]bool{}}
+			queue.markRunning(job.EmailAddress)
+			queue.jobs <- job
+			close(queue.jobs)
+			queue.done.Add(1)
+			queue.work()
+
+			storedJobs, err := p.getJobList(notificationQueueKey)
+			require.NoError(t, err)
+			if test.expectPostponed {
+				require.Len(t, storedJobs, 1)
+				assert.Equal(t, 0, storedJobs[0].Attempts)
+				assert.NotZero(t, storedJobs[0].NextAttempt)
+				assert.Equal(t, []byte("other-server"), store.get(lockKeyPrefix+"mailbox_me@example.com"))
+			} else {
+				// No user is connected to the mailbox, the job completes
+				assert.Empty(t, storedJobs)
+				assert.Nil(t, store.get(lockKeyPrefix+"mailbox_me@example.com"))
+			}
+			assert.Empty(t, queue.running)
+		})
+	}
+}
+
+func TestPollMailbox(t *testing.T) {
+	for name, test := range map[string]struct {
+		lockedElsewhere bool
+		expectPolled    bool
+	}{
+		"mailbox processed by another server": {
+			lockedElsewhere: true,
+		},
+		"mailbox processed by this server": {
+			expectPolled: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			store := mockKVStore(api)
+			mockLogs(api)
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			if test.lockedElsewhere {
+				store.set(lockKeyPrefix+"mailbox_me@example.com", []byte("other-server"))
+			}
+
+			p.pollMailbox("me@example.com")
+
+			if test.expectPolled {
+				api.AssertCalled(t, "KVGet", "me@example.comusers")
+				assert.Nil(t, store.get(lockKeyPrefix+"mailbox_me@example.com"))
+			} else {
+				api.AssertNotCalled(t, "KVGet", "me@example.comusers")
+				assert.Equal(t, []byte("other-server"), store.get(lockKeyPrefix+"mailbox_me@example.com"))
+			}
+		})
+	}
+}
+
+func TestRenewExpiringWatchForUser(t *testing.T) {
+	for name, test := range map[string]struct {
+		lockedElsewhere bool
+		expectAttempted bool
+	}{
+		"watch renewed by another server": {
+			lockedElsewhere: true,
+		},
+		"watch renewed by this server": {
+			expectAttempted: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			store := mockKVStore(api)
+			mockLogs(api)
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			if test.lockedElsewhere {
+				store.set(lockKeyPrefix+"watch_user-id", []byte("other-server"))
+			}
+
+			// The user has no Gmail ID stored, so the renewal fails and is recorded
+			p.renewExpiringWatchForUser("user-id", time.Now())
+
+			state, err := p.getWatchStateForUser("user-id")
+			require.NoError(t, err)
+			if test.expectAttempted {
+				assert.Equal(t, 1, state.Failures)
+				assert.Nil(t, store.get(lockKeyPrefix+"watch_user-id"))
+			} else {
+				assert.Equal(t, 0, state.Failures)
+				assert.Equal(t, []byte("other-server"), store.get(lockKeyPrefix+"watch_user-id"))
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// props of the posts of the mails, holding what their cards show so that other tools can read it
+const (
+	propGmailFromName    = "gmail_from_name"
+	propGmailFromAddress = "gmail_from_address"
+	propGmailTo          = "gmail_to"
+	propGmailCc          = "gmail_cc"
+	propGmailSubject     = "gmail_subject"
+	propGmailDate        = "gmail_date"
+	propGmailLabels      = "gmail_labels"
+	propGmailURL         = "gmail_url"
+)
+
+// mailCardTimeFormat is the format of the time a mail was sent, on its card. The card is the same for everyone in the
+// channel, so the format names the time zone.
+const mailCardTimeFormat = "Mon, Jan 2, 2006 3:04 PM MST"
+
+// mailCardProps adds what the card of the mail shows to the props of its post. The labels are added by setMailAttachments.
+func mailCardProps(props model.StringInterface, email *parsedMail, gmailID string, threadID string) model.StringInterface {
+	if len(email.From) > 0 {
+		props[propGmailFromName] = email.From[0].Name
+		props[propGmailFromAddress] = email.From[0].Address
+	}
+	props[propGmailTo] = formatAddresses(email.To)
+	props[propGmailCc] = formatAddresses(email.Cc)
+	props[propGmailSubject] = email.Subject
+	props[propGmailDate] = email.Date.UTC().Format(time.RFC3339)
+	props[propGmailURL] = gmailThreadURL(gmailID, threadID)
+	return props
+}
+
+// gmailThreadURL returns the URL opening the thread in Gmail, in the given account if several are signed in
+func gmailThreadURL(gmailID string, threadID string) string {
+	return "https://mail.google.com/mail/?authuser=" + url.QueryEscape(gmailID) + "#all/" + threadID
+}
+
+// formatAddresses returns the addresses as `Name <address>`, or the address alone if there is no name
+func formatAddresses(addresses []*mail.Address) []string {
+	formatted := []string{}
+	for _, address := range addresses {
+		if address.Name == "" {
+			formatted = append(formatted, address.Address)
+			continue
+		}
+		formatted = append(formatted, address.Name+" <"+address.Address+">")
+	}
+	return formatted
+}
+
+// propStrings returns the list of strings of the prop, which is read back from the database as a list of interfaces
+func propStrings(value interface{}) []string {
+	switch values := value.(type) {
+	case []string:
+		return values
+	case []interface{}:
+		strs := []string{}
+		for _, value := range values {
+			if str, ok := value.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+	return []string{}
+}
+
+// mailCardAttachment returns the card of the mail of a post, built from its props, showing the time in the location.
+// Nil is returned for the posts of mails made before the cards.
+func mailCardAttachment(props model.StringInterface, location *time.Location) *model.SlackAttachment {
+	date, ok := props[propGmailDate].(string)
+	if !ok {
+		return nil
+	}
+
+	fromName, _ := props[propGmailFromName].(string)
+	fromAddress, _ := props[propGmailFromAddress].(string)
+	from := fromAddress
+	if fromName != "" {
+		from = fromName + " <" + fromAddress + ">"
+	}
+	subject, _ := props[propGmailSubject].(string)
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	gmailURL, _ := props[propGmailURL].(string)
+
+	sentAt := date
+	if parsedDate, err := time.Parse(time.RFC3339, date); err == nil {
+		sentAt = parsedDate.In(location).Format(mailCardTimeFormat)
+	}
+
+	card := &model.SlackAttachment{
+		AuthorName: from,
+		Title:      subject,
+		TitleLink:  gmailURL,
+		Fields: []*model.SlackAttachmentField{
+			{Title: "To", Value: strings.Join(propStrings(props[propGmailTo]), ", ")},
+		},
+	}
+	if cc := propStrings(props[propGmailCc]); len(cc) > 0 {
+		card.Fields = append(card.Fields, &model.SlackAttachmentField{Title: "Cc", Value: strings.Join(cc, ", ")})
+	}
+	card.Fields = append(card.Fields, &model.SlackAttachmentField{Title: "Date", Value: sentAt, Short: true})
+	if labels := propStrings(props[propGmailLabels]); len(labels) > 0 {
+		card.Fields = append(card.Fields, &model.SlackAttachmentField{Title: "Labels", Value: strings.Join(labels, ", "), Short: true})
+	}
+	// The Message ID imports the mail in other channels
+	if rfcID, _ := props[propGmailRFCMessageID].(string); rfcID != "" {
+		card.Fields = append(card.Fields, &model.SlackAttachmentField{Title: "Message ID", Value: "`<" + rfcID + ">`"})
+	}
+	if gmailURL != "" {
+		card.Text = "[Open in Gmail](" + gmailURL + ")"
+	}
+	return card
+}
+
+// mailLabelNames returns the names of the labels of a mail, sorted, leaving out UNREAD which the state of the mail shows
+func (p *Plugin) mailLabelNames(ownerID string, labelIDs []string) []string {
+	names := map[string]string{}
+	labels, err := p.getLabelsOfUser(ownerID, false)
+	if err != nil {
+		p.API.LogError("Could not get the labels of the card of the mail", "err", err.Error())
+	}
+	for _, label := range labels {
+		names[label.ID] = label.Name
+	}
+
+	labelNames := []string{}
+	for _, labelID := range labelIDs {
+		if labelID == "UNREAD" {
+			continue
+		}
+		if name, ok := names[labelID]; ok {
+			labelNames = append(labelNames, name)
+		} else {
+			labelNames = append(labelNames, labelID)
+		}
+	}
+	sort.Strings(labelNames)
+	return labelNames
+}
+
+// setMailAttachments sets the attachments of the post of a mail of the owner: its card showing the labels, followed by
+// the attachment showing its state in Gmail, if any
+func (p *Plugin) setMailAttachments(props model.StringInterface, ownerID string, labelIDs []string, state *model.SlackAttachment) model.StringInterface {
+	attachments := []*model.SlackAttachment{}
+	if _, ok := props[propGmailDate]; ok {
+		props[propGmailLabels] = p.mailLabelNames(ownerID, labelIDs)
+		if card := mailCardAttachment(props, p.getMailboxLocation(ownerID)); card != nil {
+			attachments = append(attachments, card)
+		}
+	}
+	if state != nil {
+		attachments = append(attachments, state)
+	}
+	if len(attachments) > 0 {
+		props["attachments"] = attachments
+	}
+	return props
+}
+
+// getMailboxLocation returns the time zone the cards of the mails of the mailbox are shown in: the one of its owner, or
+// for a shared mailbox the one of the channel admin who connected it. UTC is returned if none can be found.
+func (p *Plugin) getMailboxLocation(ownerID string) *time.Location {
+	if !isChannelMailbox(ownerID) {
+		return p.getUserLocation(ownerID)
+	}
+
+	mailbox, err := p.getChannelMailbox(channelIDOfMailbox(ownerID))
+	if err != nil || mailbox == nil {
+		return time.UTC
+	}
+	return p.getUserLocation(mailbox.ConnectedBy)
+}
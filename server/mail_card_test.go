@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailCardAttachment(t *testing.T) {
+	newYork := time.FixedZone("EDT", -4*60*60)
+
+	cardProps := func(update func(props model.StringInterface)) model.StringInterface {
+		props := model.StringInterface{
+			propGmailFromName:     "Jane Doe",
+			propGmailFromAddress:  "jane@example.com",
+			propGmailTo:           []interface{}{"me@example.com"},
+			propGmailSubject:      "Invoice",
+			propGmailDate:         "2020-07-01T14:05:00Z",
+			propGmailURL:          "https://mail.google.com/mail/?authuser=me%40example.com#all/17da1e9dae1dc6d9",
+			propGmailRFCMessageID: "CAF123@mail.example.com",
+		}
+		update(props)
+		return props
+	}
+
+	for name, test := range map[string]struct {
+		props        model.StringInterface
+		location     *time.Location
+		expectFields map[string]string
+		expectNil    bool
+	}{
+		"full card": {
+			props: cardProps(func(props model.StringInterface) {
+				props[propGmailCc] = []interface{}{"Bob <bob@example.com>", "carol@example.com"}
+				props[propGmailLabels] = []interface{}{"Customers", "INBOX"}
+			}),
+			location: newYork,
+			expectFields: map[string]string{
+				"To":         "me@example.com",
+				"Cc":         "Bob <bob@example.com>, carol@example.com",
+				"Date":       "Wed, Jul 1, 2020 10:05 AM EDT",
+				"Labels":     "Customers, INBOX",
+				"Message ID": "`<CAF123@mail.example.com>`",
+			},
+		},
+		"time sent from another zone is shown in the location": {
+			props: cardProps(func(props model.StringInterface) {
+				props[propGmailDate] = "2020-07-01T23:30:00+05:30"
+			}),
+			location: newYork,
+			expectFields: map[string]string{
+				"To":         "me@example.com",
+				"Date":       "Wed, Jul 1, 2020 2:00 PM EDT",
+				"Message ID": "`<CAF123@mail.example.com>`",
+			},
+		},
+		"unparsable time is shown as is": {
+			props: cardProps(func(props model.StringInterface) {
+				props[propGmailDate] = "yesterday"
+			}),
+			location: newYork,
+			expectFields: map[string]string{
+				"To":         "me@example.com",
+				"Date":       "yesterday",
+				"Message ID": "`<CAF123@mail.example.com>`",
+			},
+		},
+		"mail without Message ID": {
+			props: cardProps(func(props model.StringInterface) {
+				delete(props, propGmailRFCMessageID)
+			}),
+			location: time.UTC,
+			expectFields: map[string]string{
+				"To":   "me@example.com",
+				"Date": "Wed, Jul 1, 2020 2:05 PM UTC",
+			},
+		},
+		"post made before the cards": {
+			props: cardProps(func(props model.StringInterface) {
+				delete(props, propGmailDate)
+			}),
+			expectNil: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			card := mailCardAttachment(test.props, test.location)
+			if test.expectNil {
+				assert.Nil(t, card)
+				return
+			}
+			require.NotNil(t, card)
+			assert.Equal(t, "Jane Doe <jane@example.com>", card.AuthorName)
+			assert.Equal(t, "Invoice", card.Title)
+
+			fields := map[string]string{}
+			for _, field := range card.Fields {
+				fields[field.Title] = field.Value.(string)
+			}
+			assert.Equal(t, test.expectFields, fields)
+		})
+	}
+}
+
+func TestGetMailboxLocation(t *testing.T) {
+	for name, test := range map[string]struct {
+		ownerID        string
+		connectedBy    string
+		expectLocation string
+	}{
+		"personal mailbox": {
+			ownerID:        "owner-id",
+			expectLocation: "America/New_York",
+		},
+		"shared mailbox": {
+			ownerID:        channelMailboxOwnerID("channel-id"),
+			connectedBy:    "owner-id",
+			expectLocation: "America/New_York",
+		},
+		"shared mailbox without record": {
+			ownerID:        channelMailboxOwnerID("channel-id"),
+			expectLocation: "UTC",
+		},
+		"unknown user": {
+			ownerID:        "unknown-id",
+			expectLocation: "UTC",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			mockKVStore(api)
+			api.On("GetUser", "owner-id").Return(&model.User{Id: "owner-id", Timezone: model.StringMap{
+				"useAutomaticTimezone": "false",
+				"manualTimezone":       "America/New_York",
+			}}, nil)
+			api.On("GetUser", mock.Anything).Return(nil, &model.AppError{Message: "not found"})
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			if test.connectedBy != "" {
+				require.NoError(t, p.storeChannelMailbox(&channelMailbox{ChannelID: "channel-id", ConnectedBy: test.connectedBy}))
+			}
+			assert.Equal(t, test.expectLocation, p.getMailboxLocation(test.ownerID).String())
+		})
+	}
+}
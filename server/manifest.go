@@ -19,7 +19,7 @@ const manifestStr = `
   "support_url": "https://github.com/abdulsmapara/mattermost-plugin-gmail/issues",
   "release_notes_url": "https://github.com/abdulsmapara/mattermost-plugin-gmail/blob/master/CHANGELOG.md",
   "version": "0.1.1",
-  "min_server_version": "5.19.0",
+  "min_server_version": "5.20.0",
   "server": {
     "executables": {
       "linux-amd64": "server/dist/plugin-linux-amd64",
@@ -52,10 +52,64 @@ const manifestStr = `
         "key": "TopicName",
         "display_name": "Topic Name",
         "type": "text",
-        "help_text": "Topic Name is used to subscribe user for notifications from Gmail.",
+        "help_text": "Topic Name is used to subscribe user for notifications from Gmail. Not needed in Poll mode.",
         "placeholder": "Create a topic in Google Cloud pubsub",
         "default": null
       },
+      {
+        "key": "DeliveryMode",
+        "display_name": "Notification Delivery Mode",
+        "type": "dropdown",
+        "help_text": "How Gmail notifications reach the plugin. Use Pull if Google cannot reach your Mattermost server, or Poll if you cannot set up a Pub/Sub topic.",
+        "placeholder": "",
+        "default": "push",
+        "options": [
+          {
+            "display_name": "Push (Pub/Sub pushes to the plugin webhook)",
+            "value": "push"
+          },
+          {
+            "display_name": "Pull (plugin pulls from a Pub/Sub subscription)",
+            "value": "pull"
+          },
+          {
+            "display_name": "Poll (plugin polls Gmail, no Pub/Sub needed)",
+            "value": "poll"
+          }
+        ]
+      },
+      {
+        "key": "PollingIntervalSeconds",
+        "display_name": "Polling Interval (seconds)",
+        "type": "number",
+        "help_text": "How often the mailboxes of connected users are checked for new mails in Poll mode. The minimum is 15 seconds.",
+        "placeholder": "",
+        "default": 60
+      },
+      {
+        "key": "PullSubscriptionName",
+        "display_name": "Pull Subscription Name",
+        "type": "text",
+        "help_text": "The Pub/Sub pull subscription of the topic to receive notifications from. Used in Pull mode.",
+        "placeholder": "projects/\u003cproject-id\u003e/subscriptions/\u003csubscription-id\u003e",
+        "default": null
+      },
+      {
+        "key": "PubSubServiceAccountKey",
+        "display_name": "Pub/Sub Service Account Key",
+        "type": "longtext",
+        "help_text": "Credentials used to pull from the subscription in Pull mode. If empty, the application default credentials of the server are used.",
+        "placeholder": "Paste the JSON key of a service account with the Pub/Sub Subscriber role",
+        "default": null
+      },
+      {
+        "key": "PubSubEndpoint",
+        "display_name": "Pub/Sub Endpoint",
+        "type": "text",
+        "help_text": "Overrides the Pub/Sub API endpoint in Pull mode, for example to use the Pub/Sub emulator. Requests to this endpoint are not authenticated. Leave empty to use Google Cloud.",
+        "placeholder": "http://localhost:8085",
+        "default": null
+      },
       {
         "key": "EncryptionKey",
         "display_name": "Plugin Encryption Key",
@@ -63,6 +117,46 @@ const manifestStr = `
         "help_text": "The AES encryption key internally used in plugin to encrypt stored access tokens.",
         "placeholder": "Generate the key and store before connecting the account",
         "default": null
+      },
+      {
+        "key": "PushAuthServiceAccount",
+        "display_name": "Push Authentication Service Account",
+        "type": "text",
+        "help_text": "When set, notifications pushed to the plugin must carry an OIDC token issued by Google for this service account.",
+        "placeholder": "Service account email selected while enabling authentication on the Pub/Sub subscription",
+        "default": null
+      },
+      {
+        "key": "PushAuthAudience",
+        "display_name": "Push Authentication Audience",
+        "type": "text",
+        "help_text": "The audience expected in the OIDC token of pushed notifications. If empty, the push endpoint URL is expected.",
+        "placeholder": "Audience entered while enabling authentication on the Pub/Sub subscription",
+        "default": null
+      },
+      {
+        "key": "PushAuthJWKSURL",
+        "display_name": "Push Authentication Key Set URL",
+        "type": "text",
+        "help_text": "The URL of the JSON Web Key Set used to verify the OIDC token of pushed notifications.",
+        "placeholder": "",
+        "default": "https://www.googleapis.com/oauth2/v3/certs"
+      },
+      {
+        "key": "PushVerificationToken",
+        "display_name": "Push Verification Token",
+        "type": "generated",
+        "help_text": "Used when no service account is set. Pushed notifications are accepted only if the endpoint URL ends with ?token=\u003cPush Verification Token\u003e.",
+        "placeholder": "Generate the token and add it to the push endpoint URL",
+        "default": null
+      },
+      {
+        "key": "AllowUnauthenticatedPush",
+        "display_name": "Allow Unauthenticated Push",
+        "type": "bool",
+        "help_text": "When neither a service account nor a verification token is set, pushed notifications are rejected unless this is enabled. Only enable it if the webhook cannot be reached by others.",
+        "placeholder": "",
+        "default": false
       }
     ]
   }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+// actions of the buttons of the posts of the mails, triaging the mail in Gmail
+const (
+	ActionMarkRead    = "ActionMarkRead"
+	ActionMarkUnread  = "ActionMarkUnread"
+	ActionArchive     = "ActionArchive"
+	ActionMoveToInbox = "ActionMoveToInbox"
+	ActionStar        = "ActionStar"
+	ActionUnstar      = "ActionUnstar"
+	ActionTrash       = "ActionTrash"
+	ActionUntrash     = "ActionUntrash"
+	ActionApplyLabel  = "ActionApplyLabel"
+)
+
+// userLabelIDPrefix starts the IDs of the labels created by the user, as opposed to system labels
+const userLabelIDPrefix = "Label_"
+
+// labelMenuMaxOptions bounds the labels listed in the menu applying a label to a mail
+const labelMenuMaxOptions = 100
+
+// signAction returns the signature of the values of the context of a button, so that the context cannot be forged
+func (p *Plugin) signAction(values ...string) string {
+	mac := hmac.New(sha256.New, []byte(p.getConfiguration().EncryptionKey))
+	mac.Write([]byte(strings.Join(values, ":")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAction returns whether the signature is the one of the values, comparing them in constant time
+func (p *Plugin) verifyAction(signature string, values ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(p.signAction(values...)))
+}
+
+// signMessageAction returns the signature of the context of a button acting on a mail, so that the
+// context cannot be forged to act on the mails of another mailbox
+func (p *Plugin) signMessageAction(action string, ownerID string, messageID string) string {
+	return p.signAction(action, ownerID, messageID)
+}
+
+// verifyMessageAction returns the action, the owner of the mailbox and the mail of a signed context
+func (p *Plugin) verifyMessageAction(context map[string]interface{}) (string, string, string, bool) {
+	action, _ := context["action"].(string)
+	ownerID, _ := context["ownerId"].(string)
+	messageID, _ := context["messageId"].(string)
+	signature, _ := context["signature"].(string)
+	if action == "" || ownerID == "" || messageID == "" {
+		return "", "", "", false
+	}
+
+	if !p.verifyAction(signature, action, ownerID, messageID) {
+		return "", "", "", false
+	}
+	return action, ownerID, messageID, true
+}
+
+// mailActionsAttachment returns the attachment of the post of a mail showing its state in Gmail, with the buttons
+// changing it. Nil is returned if the buttons cannot be built.
+func (p *Plugin) mailActionsAttachment(ownerID string, messageID string, labelIDs []string) *model.SlackAttachment {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		return nil
+	}
+	actionURL := fmt.Sprintf("%s/plugins/%s/action/message", *siteURL, manifest.Id)
+
+	newAction := func(actionType string, name string, action string) *model.PostAction {
+		return &model.PostAction{
+			Type: actionType,
+			Name: name,
+			Integration: &model.PostActionIntegration{
+				URL: actionURL,
+				Context: map[string]interface{}{
+					"action":    action,
+					"ownerId":   ownerID,
+					"messageId": messageID,
+					"signature": p.signMessageAction(action, ownerID, messageID),
+				},
+			},
+		}
+	}
+
+	hasLabel := map[string]bool{}
+	for _, labelID := range labelIDs {
+		hasLabel[labelID] = true
+	}
+
+	if hasLabel["TRASH"] {
+		return &model.SlackAttachment{
+			Text:    ":wastebasket: In trash",
+			Actions: []*model.PostAction{newAction(model.POST_ACTION_TYPE_BUTTON, "Restore", ActionUntrash)},
+		}
+	}
+
+	state := []string{}
+	actions := []*model.PostAction{}
+	if hasLabel["UNREAD"] {
+		state = append(state, "Unread")
+		actions = append(actions, newAction(model.POST_ACTION_TYPE_BUTTON, "Mark read", ActionMarkRead))
+	} else {
+		state = append(state, "Read")
+		actions = append(actions, newAction(model.POST_ACTION_TYPE_BUTTON, "Mark unread", ActionMarkUnread))
+	}
+	if hasLabel["INBOX"] {
+		state = append(state, "In inbox")
+		actions = append(actions, newAction(model.POST_ACTION_TYPE_BUTTON, "Archive", ActionArchive))
+	} else {
+		state = append(state, "Archived")
+		actions = append(actions, newAction(model.POST_ACTION_TYPE_BUTTON, "Move to inbox", ActionMoveToInbox))
+	}
+	if hasLabel["STARRED"] {
+		state = append(state, ":star: Starred")
+		actions = append(actions, newAction(model.POST_ACTION_TYPE_BUTTON, "Unstar", ActionUnstar))
+	} else {
+		actions = append(actions, newAction(model.POST_ACTION_TYPE_BUTTON, "Star", ActionStar))
+	}
+	actions = append(actions, newAction(model.POST_ACTION_TYPE_BUTTON, "Move to trash", ActionTrash))
+
+	labels, err := p.getLabelsOfUser(ownerID, false)
+	if err != nil {
+		p.API.LogError("Could not get the labels of the menu of the mail", "err", err.Error())
+	}
+	options := []*model.PostActionOptions{}
+	for _, label := range labels {
+		if !strings.HasPrefix(label.ID, userLabelIDPrefix) || hasLabel[label.ID] {
+			continue
+		}
+		options = append(options, &model.PostActionOptions{Text: label.Name, Value: label.ID})
+	}
+	sort.Slice(options, func(i, j int) bool {
+		return strings.ToLower(options[i].Text) < strings.ToLower(options[j].Text)
+	})
+	if len(options) > labelMenuMaxOptions {
+		options = options[:labelMenuMaxOptions]
+	}
+	if len(options) > 0 {
+		labelMenu := newAction(model.POST_ACTION_TYPE_SELECT, "Apply label", ActionApplyLabel)
+		labelMenu.Options = options
+		actions = append(actions, labelMenu)
+	}
+
+	// The labels of the mail are shown on its card
+	return &model.SlackAttachment{
+		Text:    strings.Join(state, " · "),
+		Actions: actions,
+	}
+}
+
+// modifyMessage runs the action on the mail in Gmail and returns the labels of the mail afterwards
+func (p *Plugin) modifyMessage(ownerID string, messageID string, action string, selectedLabelID string) ([]string, error) {
+	gmailID, err := p.getGmailID(ownerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail ID")
+	}
+	gmailService, err := p.getGmailService(ownerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail service")
+	}
+
+	modify := func(addLabelIDs []string, removeLabelIDs []string) (*gmail.Message, error) {
+		return gmailService.Users.Messages.Modify(gmailID, messageID, &gmail.ModifyMessageRequest{
+			AddLabelIds:    addLabelIDs,
+			RemoveLabelIds: removeLabelIDs,
+		}).Do()
+	}
+
+	var message *gmail.Message
+	switch action {
+	case ActionMarkRead:
+		message, err = modify(nil, []string{"UNREAD"})
+	case ActionMarkUnread:
+		message, err = modify([]string{"UNREAD"}, nil)
+	case ActionArchive:
+		message, err = modify(nil, []string{"INBOX"})
+	case ActionMoveToInbox:
+		message, err = modify([]string{"INBOX"}, nil)
+	case ActionStar:
+		message, err = modify([]string{"STARRED"}, nil)
+	case ActionUnstar:
+		message, err = modify(nil, []string{"STARRED"})
+	case ActionTrash:
+		message, err = gmailService.Users.Messages.Trash(gmailID, messageID).Do()
+	case ActionUntrash:
+		message, err = gmailService.Users.Messages.Untrash(gmailID, messageID).Do()
+	case ActionApplyLabel:
+		if selectedLabelID == "" {
+			return nil, errors.New("No label selected")
+		}
+		if err = p.checkAssignableLabel(ownerID, selectedLabelID); err != nil {
+			return nil, err
+		}
+		message, err = modify([]string{selectedLabelID}, nil)
+	default:
+		return nil, errors.New("Unknown action " + action)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return message.LabelIds, nil
+}
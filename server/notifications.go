@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// resyncMaxAge bounds how far back messages are looked up when the history ID has expired
+	resyncMaxAge = 7 * 24 * time.Hour
+
+	// resyncMaxMessages bounds the number of messages posted when the history ID has expired
+	resyncMaxMessages = 100
+)
+
+// gmailNotification is the data of the Pub/Sub message published by Gmail on mailbox changes
+type gmailNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// processNotificationForMailbox posts the messages added to the mailbox to all the users connected to it,
+// and syncs the posts of the mails changed since.
+// The history of the mailbox is fetched once, from the oldest history ID processed by any of the users,
+// and each user gets the messages added after its own history ID that match its subscriptions.
+func (p *Plugin) processNotificationForMailbox(emailAddress string) error {
+	connectedUserIDs, err := p.getUsersForGmail(emailAddress)
+	if err != nil {
+		return errors.Wrap(err, "Could not get the users connected to the gmail ID")
+	}
+
+	userIDs := []string{}
+	lastHistoryIDs := map[string]uint64{}
+	startHistoryID := uint64(0)
+	for _, userID := range connectedUserIDs {
+		if p.isConnectionBroken(userID) {
+			p.API.LogInfo("Skipping user with revoked Gmail access, user ID: " + userID)
+			continue
+		}
+		lastHistoryID, historyErr := p.getHistoryIDForUser(userID)
+		if historyErr != nil {
+			p.API.LogError("Could not fetch history details for user with user ID: "+userID, "err", historyErr.Error())
+			continue
+		}
+		userIDs = append(userIDs, userID)
+		lastHistoryIDs[userID] = lastHistoryID
+		if startHistoryID == 0 || lastHistoryID < startHistoryID {
+			startHistoryID = lastHistoryID
+		}
+	}
+
+	if len(userIDs) < 1 {
+		p.API.LogInfo("No user to notify for gmail ID: " + emailAddress)
+		return nil
+	}
+	if len(userIDs) == 1 {
+		return p.processNotificationForUser(userIDs[0], emailAddress)
+	}
+
+	p.API.LogInfo(fmt.Sprintf("%d users connected to gmail ID: %s", len(userIDs), emailAddress))
+
+	// Any connected user can read the shared mailbox
+	var gmailService *gmail.Service
+	for _, userID := range userIDs {
+		if gmailService, err = p.getGmailService(userID); err == nil {
+			break
+		}
+	}
+	if gmailService == nil {
+		return errors.Wrap(err, "Could not get gmail service")
+	}
+
+	p.API.LogInfo("Fetching gmail messages using oldest history ID: " + strconv.Itoa(int(startHistoryID)))
+	history, historyID, err := listHistory(gmailService, emailAddress, startHistoryID)
+	if isNotFoundError(err) {
+		// The history IDs of some users have expired, let each user resync on its own
+		failures := 0
+		for _, userID := range userIDs {
+			if userErr := p.processNotificationForUser(userID, emailAddress); userErr != nil {
+				p.API.LogError("Could not process notification for user with user ID: "+userID, "err", userErr.Error())
+				failures++
+			}
+		}
+		if failures > 0 {
+			return fmt.Errorf("Notification could not be processed for %d of %d users", failures, len(userIDs))
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Could not fetch history response")
+	}
+
+	// Messages are fetched once and shared among the users
+	fetchedMessages := map[string]*gmail.Message{}
+	fetchErrors := map[string]error{}
+	failures := 0
+	for _, userID := range userIDs {
+		messages := []*gmail.Message{}
+		var fetchErr error
+		for _, historyElement := range history {
+			// The user has already processed this change
+			if historyElement.Id <= lastHistoryIDs[userID] {
+				continue
+			}
+			for _, addedMessage := range historyElement.MessagesAdded {
+				messageID := addedMessage.Message.Id
+				message, fetched := fetchedMessages[messageID]
+				if !fetched && fetchErrors[messageID] == nil {
+					var msgErr error
+					if message, msgErr = fetchAddedMessage(gmailService, emailAddress, messageID); msgErr != nil {
+						fetchErrors[messageID] = msgErr
+					} else {
+						fetchedMessages[messageID] = message
+					}
+				}
+				if fetchErrors[messageID] != nil {
+					fetchErr = fetchErrors[messageID]
+				}
+				if message != nil {
+					messages = append(messages, message)
+				}
+			}
+		}
+		if fetchErr != nil {
+			// Keep the history ID of the user so that the mails are fetched again when the job is retried
+			p.API.LogError("Could not fetch the messages of the notification for user with user ID: "+userID, "err", fetchErr.Error())
+			failures++
+			continue
+		}
+
+		p.API.LogInfo(fmt.Sprintf("%d messages received for user with user ID: %s, filtering based on user's subscriptions", len(messages), userID))
+		if userErr := p.deliverMessagesToUser(userID, messages); userErr != nil {
+			p.API.LogError("Could not process notification for user with user ID: "+userID, "err", userErr.Error())
+			failures++
+			continue
+		}
+		if userErr := p.syncMailStateForUser(userID, history, lastHistoryIDs[userID]); userErr != nil {
+			p.API.LogError("Could not sync the posts of the changed mails for user with user ID: "+userID, "err", userErr.Error())
+		}
+		if userErr := p.advanceHistoryIDForUser(userID, lastHistoryIDs[userID], historyID); userErr != nil {
+			p.API.LogError("Could not process notification for user with user ID: "+userID, "err", userErr.Error())
+			failures++
+		}
+	}
+	p.API.LogInfo(fmt.Sprintf("Processed notifications for %d users", len(userIDs)))
+
+	if failures > 0 {
+		return fmt.Errorf("Notification could not be processed for %d of %d users", failures, len(userIDs))
+	}
+	return nil
+}
+
+// fetchAddedMessage fetches a message added to the mailbox. Nil is returned if the message was deleted since.
+func fetchAddedMessage(gmailService *gmail.Service, emailAddress string, messageID string) (*gmail.Message, error) {
+	message, err := gmailService.Users.Messages.Get(emailAddress, messageID).Format("raw").Do()
+	if isNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not fetch message with ID: "+messageID)
+	}
+	return message, nil
+}
+
+// listHistory lists all the pages of the history of the mailbox after the start history ID.
+// It returns the history records along with the current history ID of the mailbox.
+func listHistory(gmailService *gmail.Service, emailAddress string, startHistoryID uint64) ([]*gmail.History, uint64, error) {
+	history := []*gmail.History{}
+	historyID := startHistoryID
+	pageToken := ""
+	for {
+		historyCall := gmailService.Users.History.List(emailAddress).StartHistoryId(startHistoryID)
+		if pageToken != "" {
+			historyCall = historyCall.PageToken(pageToken)
+		}
+		historyResponse, err := historyCall.Do()
+		if err != nil {
+			return nil, 0, err
+		}
+		history = append(history, historyResponse.History...)
+		if historyResponse.HistoryId > historyID {
+			historyID = historyResponse.HistoryId
+		}
+		pageToken = historyResponse.NextPageToken
+		if pageToken == "" {
+			return history, historyID, nil
+		}
+	}
+}
+
+// processNotificationForUser posts the messages added to the mailbox since the last processed history ID
+// to the user, if they match the subscriptions of the user
+func (p *Plugin) processNotificationForUser(userID string, emailAddress string) error {
+	p.API.LogInfo("Processing notification for userID: " + userID)
+
+	if p.isConnectionBroken(userID) {
+		p.API.LogInfo("Skipping user with revoked Gmail access, user ID: " + userID)
+		return nil
+	}
+
+	gmailService, err := p.getGmailService(userID)
+	if err != nil {
+		return errors.Wrap(err, "Could not get gmail service")
+	}
+
+	lastHistoryID, err := p.getHistoryIDForUser(userID)
+	if err != nil {
+		return errors.Wrap(err, "Could not fetch history details")
+	}
+
+	p.API.LogInfo("Fetching gmail messages using last used history ID: " + strconv.Itoa(int(lastHistoryID)))
+	history, historyID, err := listHistory(gmailService, emailAddress, lastHistoryID)
+	if isNotFoundError(err) {
+		// The stored history ID is too old to be used by Gmail
+		p.API.LogInfo("History ID " + strconv.Itoa(int(lastHistoryID)) + " has expired for user with user ID: " + userID)
+		return p.resyncMailboxForUser(userID, emailAddress, gmailService)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Could not fetch history response")
+	}
+
+	if len(history) < 1 {
+		p.API.LogInfo("Blank history response received for user with user ID: " + userID)
+		return p.advanceHistoryIDForUser(userID, lastHistoryID, historyID)
+	}
+
+	messages := []*gmail.Message{}
+
+	for _, historyElement := range history {
+		for _, addedMessage := range historyElement.MessagesAdded {
+			message, msgErr := fetchAddedMessage(gmailService, emailAddress, addedMessage.Message.Id)
+			if msgErr != nil {
+				// The job is retried, the history ID is only advanced once all the mails are fetched
+				return msgErr
+			}
+			if message != nil {
+				messages = append(messages, message)
+			}
+		}
+	}
+
+	p.API.LogInfo(fmt.Sprintf("%d messages received as a part of the notification, filtering based on user's subscriptions", len(messages)))
+	if err = p.deliverMessagesToUser(userID, messages); err != nil {
+		return err
+	}
+	if err = p.syncMailStateForUser(userID, history, lastHistoryID); err != nil {
+		p.API.LogError("Could not sync the posts of the changed mails for user with user ID: "+userID, "err", err.Error())
+	}
+
+	return p.advanceHistoryIDForUser(userID, lastHistoryID, historyID)
+}
+
+// deliverMessagesToUser posts the messages matching the subscriptions of the user, adds those of the threads
+// followed by the user and records the time of the latest processed message
+func (p *Plugin) deliverMessagesToUser(userID string, messages []*gmail.Message) error {
+	relevantMessages, matchedSubscriptions, err := p.getRelevantMessagesForUser(userID, messages)
+	if err != nil {
+		return errors.Wrap(err, "Could not filter messages based on user's subscriptions")
+	}
+	if len(relevantMessages) > 0 {
+		p.API.LogInfo(fmt.Sprintf("%d messages relevant based on user's subscriptions", len(relevantMessages)))
+		if err := p.deliverNewMessagesToUser(userID, relevantMessages, matchedSubscriptions); err != nil {
+			return err
+		}
+	} else {
+		p.API.LogInfo("No new relevant messages found for the user")
+	}
+
+	if err := p.deliverFollowedThreadsToUser(userID, messages); err != nil {
+		p.API.LogError("Could not add the new mails of the followed threads of the user", "err", err.Error())
+	}
+
+	lastMessageTime := int64(0)
+	for _, message := range messages {
+		if message.InternalDate > lastMessageTime {
+			lastMessageTime = message.InternalDate
+		}
+	}
+	if lastMessageTime > 0 {
+		if err := p.advanceLastMessageTimeForUser(userID, lastMessageTime); err != nil {
+			p.API.LogError("Could not update the time of the last processed message for the user", "err", err.Error())
+		}
+	}
+	return nil
+}
+
+// deliverNewMessagesToUser posts the messages to the user, or to the channels the matched subscriptions are
+// routed to, skipping those delivered before. Notifications overlap and are delivered at least once, so the same
+// message may be seen several times. Each message is claimed for each of its channels, and only the messages which
+// could not be posted in a channel are released for it.
+func (p *Plugin) deliverNewMessagesToUser(userID string, messages []*gmail.Message, matchedSubscriptions map[string][]string) error {
+	destinations := p.getDestinationsOfMessages(userID, matchedSubscriptions)
+	keys := []string{}
+	for _, message := range messages {
+		for _, channelID := range destinations[message.Id] {
+			keys = append(keys, deliveryKey(message.Id, channelID))
+		}
+	}
+
+	claimed, err := p.claimMessagesForDelivery(userID, keys)
+	if err != nil {
+		return errors.Wrap(err, "Could not record the messages as delivered")
+	}
+	if len(claimed) == 0 {
+		p.API.LogInfo("All the relevant messages were already delivered to the user")
+		return nil
+	}
+	if len(claimed) < len(keys) {
+		p.API.LogInfo(fmt.Sprintf("Skipping %d deliveries of messages already delivered to the user", len(keys)-len(claimed)))
+	}
+
+	// Group the claimed messages by the channel they are delivered to, keeping their order
+	channelIDs := []string{}
+	messagesOfChannel := map[string][]*gmail.Message{}
+	for _, message := range messages {
+		for _, channelID := range destinations[message.Id] {
+			if !claimed[deliveryKey(message.Id, channelID)] {
+				continue
+			}
+			if _, ok := messagesOfChannel[channelID]; !ok {
+				channelIDs = append(channelIDs, channelID)
+			}
+			messagesOfChannel[channelID] = append(messagesOfChannel[channelID], message)
+		}
+	}
+
+	unpostedKeys := []string{}
+	var postErr error
+	for _, channelID := range channelIDs {
+		postedIDs, err := p.postMessagesToChannel(userID, channelID, messagesOfChannel[channelID])
+		if err == nil {
+			continue
+		}
+		postErr = err
+		posted := map[string]bool{}
+		for _, messageID := range postedIDs {
+			posted[messageID] = true
+		}
+		for _, message := range messagesOfChannel[channelID] {
+			if !posted[message.Id] {
+				unpostedKeys = append(unpostedKeys, deliveryKey(message.Id, channelID))
+			}
+		}
+	}
+	if postErr != nil {
+		// Let the messages which were not posted be delivered again by a later notification
+		if releaseErr := p.releaseMessagesForDelivery(userID, unpostedKeys); releaseErr != nil {
+			p.API.LogError("Could not release the messages that were not delivered", "err", releaseErr.Error())
+		}
+		return errors.Wrap(postErr, "Message could not be posted to the user")
+	}
+	return nil
+}
+
+// postMessagesToChannel posts the messages to the channel, or to the channel of the mailbox if the channel ID is
+// empty. It returns the IDs of the messages posted.
+func (p *Plugin) postMessagesToChannel(userID string, channelID string, messages []*gmail.Message) ([]string, error) {
+	if channelID == "" {
+		mailboxChannelID, err := p.getMailboxChannelID(userID)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not fetch direct channel for the user")
+		}
+		channelID = mailboxChannelID
+	}
+	_, postedIDs, err := p.postMessages(messages, channelID, userID, true, "")
+	return postedIDs, err
+}
+
+// resyncMailboxForUser recovers from an expired history ID by listing the messages received since
+// the last processed message, posting them and starting again from the current history ID
+func (p *Plugin) resyncMailboxForUser(userID string, emailAddress string, gmailService *gmail.Service) error {
+	// Take the history ID first, so that no change is missed while resyncing
+	profile, err := gmailService.Users.GetProfile(emailAddress).Do()
+	if err != nil {
+		return errors.Wrap(err, "Could not get the current history ID")
+	}
+
+	lastMessageTime, err := p.getLastMessageTimeForUser(userID)
+	if err != nil {
+		return errors.Wrap(err, "Could not get the time of the last processed message")
+	}
+
+	// Without the time of the last processed message, the mails missed cannot be told apart from the ones
+	// already posted, so the mailbox starts again from now without reposting any of them
+	if lastMessageTime == 0 {
+		p.API.LogInfo("No message processed before for user with user ID: " + userID + ", resyncing without backfill")
+		p.notifyResyncWithoutBackfill(userID)
+		if err = p.updateHistoryIDForUser(profile.HistoryId, userID); err != nil {
+			return errors.Wrap(err, "Could not update history ID for the user")
+		}
+		return nil
+	}
+
+	// Look back a bounded amount of time only
+	oldestResyncTime := model.GetMillisForTime(time.Now().Add(-resyncMaxAge))
+	if lastMessageTime < oldestResyncTime {
+		lastMessageTime = oldestResyncTime
+	}
+
+	query := fmt.Sprintf("after:%d", lastMessageTime/1000)
+	p.API.LogInfo("Resyncing mailbox for user with user ID: " + userID + " using query: " + query)
+
+	messageIDs := []string{}
+	pageToken := ""
+	for len(messageIDs) < resyncMaxMessages {
+		listCall := gmailService.Users.Messages.List(emailAddress).Q(query).MaxResults(resyncMaxMessages)
+		if pageToken != "" {
+			listCall = listCall.PageToken(pageToken)
+		}
+		listResponse, listErr := listCall.Do()
+		if listErr != nil {
+			return errors.Wrap(listErr, "Could not list messages for resync")
+		}
+		for _, message := range listResponse.Messages {
+			messageIDs = append(messageIDs, message.Id)
+		}
+		pageToken = listResponse.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+	if len(messageIDs) > resyncMaxMessages {
+		messageIDs = messageIDs[:resyncMaxMessages]
+	}
+
+	// Messages are listed newest first, post them oldest first
+	messages := []*gmail.Message{}
+	for index := len(messageIDs) - 1; index >= 0; index-- {
+		message, msgErr := fetchAddedMessage(gmailService, emailAddress, messageIDs[index])
+		if msgErr != nil {
+			return msgErr
+		}
+		// The query has a granularity of seconds, skip messages already processed
+		if message == nil || message.InternalDate <= lastMessageTime {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	p.API.LogInfo(fmt.Sprintf("%d messages received since the last processed message, filtering based on user's subscriptions", len(messages)))
+	if err = p.deliverMessagesToUser(userID, messages); err != nil {
+		return err
+	}
+
+	p.API.LogInfo("Resync completed, updating history ID for the user to " + strconv.Itoa(int(profile.HistoryId)))
+	if err = p.updateHistoryIDForUser(profile.HistoryId, userID); err != nil {
+		return errors.Wrap(err, "Could not update history ID for the user")
+	}
+	return nil
+}
+
+// notifyResyncWithoutBackfill warns the owner of the mailbox, in the channel of the mailbox, that the mails received
+// while the notifications could not be processed were not posted
+func (p *Plugin) notifyResyncWithoutBackfill(ownerID string) {
+	mailboxChannelID, err := p.getMailboxChannelID(ownerID)
+	if err != nil {
+		p.API.LogError("Could not fetch the channel of the mailbox to warn about the resync", "err", err.Error())
+		return
+	}
+
+	message := ":warning: Gmail notifications could not be processed for a while and the mails received meanwhile were not posted. " +
+		"Use `/gmail search` or `/gmail import` to find them."
+	if _, err = p.sendMessageFromBot(mailboxChannelID, "", false, message); err != nil {
+		p.API.LogError("Could not warn about the resync", "err", err.Error())
+	}
+}
+
+// isNotFoundError reports whether the Gmail API responded with 404 Not Found
+func isNotFoundError(err error) bool {
+	apiErr, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// advanceHistoryIDForUser stores the history ID up to which the mailbox of the user has been processed
+func (p *Plugin) advanceHistoryIDForUser(userID string, lastHistoryID uint64, historyID uint64) error {
+	if historyID <= lastHistoryID {
+		return nil
+	}
+
+	p.API.LogInfo("Updating history ID for the user to " + strconv.Itoa(int(historyID)))
+	err := p.updateDeliveryLedger(userID, func(ledger *deliveryLedger) bool {
+		// Another notification may have processed the mailbox further meanwhile
+		if ledger.HistoryID >= historyID {
+			return false
+		}
+		ledger.HistoryID = historyID
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "Could not update history ID for the user")
+	}
+	p.API.LogInfo("History ID updated for the user")
+
+	return nil
+}
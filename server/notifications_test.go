@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// mockLogs accepts the log calls of the plugin, with up to two key value pairs
+func mockLogs(api *plugintest.API) {
+	for _, level := range []string{"LogDebug", "LogInfo", "LogWarn", "LogError"} {
+		api.On(level, mock.Anything).Maybe()
+		api.On(level, mock.Anything, mock.Anything, mock.Anything).Maybe()
+		api.On(level, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe()
+	}
+}
+
+// testMessage returns a Gmail message in the raw format, with the body as text
+func testMessage(id string, body string) *gmail.Message {
+	raw := "From: Jane <jane@example.com>\r\n" +
+		"To: me@example.com\r\n" +
+		"Subject: Test " + id + "\r\n" +
+		"Date: Wed, 01 Jul 2020 14:05:00 +0000\r\n" +
+		"Message-ID: <" + id + "@mail.example.com>\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		body + "\r\n"
+	return &gmail.Message{Id: id, Raw: base64.URLEncoding.EncodeToString([]byte(raw))}
+}
+
+func TestDeliverNewMessagesToUser(t *testing.T) {
+	const userID = "user-id"
+
+	// first goes to both channels, second to channel-b only and third to channel-a only
+	messages := []*gmail.Message{testMessage("first", "first mail"), testMessage("second", "second mail"), testMessage("third", "third mail")}
+	matchedSubscriptions := map[string][]string{
+		"first":  {"route-a", "route-b"},
+		"second": {"route-b"},
+		"third":  {"route-a"},
+	}
+
+	api := &plugintest.API{}
+	store := mockKVStore(api)
+	mockLogs(api)
+	api.On("GetChannelMember", mock.Anything, userID).Return(&model.ChannelMember{}, nil)
+	api.On("HasPermissionToChannel", userID, mock.Anything, model.PERMISSION_CREATE_POST).Return(true)
+	api.On("GetConfig").Return(&model.Config{})
+	api.On("GetUser", mock.Anything).Return(nil, &model.AppError{Message: "not found"})
+
+	failing := true
+	posted := map[string][]string{}
+	api.On("CreatePost", mock.Anything).Return(func(post *model.Post) *model.Post {
+		return &model.Post{Id: model.NewId(), ChannelId: post.ChannelId}
+	}, func(post *model.Post) *model.AppError {
+		// The second mail cannot be posted in channel-b, after the first one was
+		if failing && post.ChannelId == "channel-b" && strings.Contains(post.Message, "second mail") {
+			return &model.AppError{Message: "database unavailable"}
+		}
+		posted[post.ChannelId] = append(posted[post.ChannelId], strings.TrimSpace(post.Message))
+		return nil
+	})
+
+	p := &Plugin{gmailBotID: "bot-id"}
+	p.SetAPI(api)
+	p.setConfiguration(&configuration{})
+	store.set(userID+"gmailID", []byte("me@example.com"))
+	routes, err := json.Marshal(map[string]string{"route-a": "channel-a", "route-b": "channel-b"})
+	require.NoError(t, err)
+	store.set(userID+"subscriptionRoutes", routes)
+
+	deliveredKeys := func() []string {
+		ledger, _, err := p.getDeliveryLedger(userID)
+		require.NoError(t, err)
+		keys := []string{}
+		for key := range ledger.Delivered {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+
+	// Only the mail which could not be posted in channel-b is released
+	err = p.deliverNewMessagesToUser(userID, messages, matchedSubscriptions)
+	assert.Error(t, err)
+	assert.Equal(t, map[string][]string{
+		"channel-a": {"first mail", "third mail"},
+		"channel-b": {"first mail"},
+	}, posted)
+	assert.ElementsMatch(t, []string{"first/channel-a", "third/channel-a", "first/channel-b"}, deliveredKeys())
+
+	// The next notification posts it, and only it
+	failing = false
+	posted = map[string][]string{}
+	require.NoError(t, p.deliverNewMessagesToUser(userID, messages, matchedSubscriptions))
+	assert.Equal(t, map[string][]string{"channel-b": {"second mail"}}, posted)
+	assert.ElementsMatch(t, []string{"first/channel-a", "third/channel-a", "first/channel-b", "second/channel-b"}, deliveredKeys())
+
+	// Overlapping notifications post nothing again
+	posted = map[string][]string{}
+	require.NoError(t, p.deliverNewMessagesToUser(userID, messages, matchedSubscriptions))
+	assert.Empty(t, posted)
+}
+
+func TestClaimMessagesForDelivery(t *testing.T) {
+	const userID = "user-id"
+
+	api := &plugintest.API{}
+	store := mockKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	// Ledgers of earlier versions recorded the messages delivered to any channel by their ID alone
+	ledger, err := json.Marshal(&deliveryLedger{Delivered: map[string]int64{"legacy": model.GetMillis() + 60*1000}})
+	require.NoError(t, err)
+	store.set(userID+"deliveryLedger", ledger)
+
+	claimed, err := p.claimMessagesForDelivery(userID, []string{deliveryKey("legacy", ""), deliveryKey("new", ""), deliveryKey("new", "channel-id")})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"new/": true, "new/channel-id": true}, claimed)
+
+	claimed, err = p.claimMessagesForDelivery(userID, []string{deliveryKey("new", ""), deliveryKey("new", "channel-id")})
+	require.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	require.NoError(t, p.releaseMessagesForDelivery(userID, []string{deliveryKey("new", "channel-id")}))
+	claimed, err = p.claimMessagesForDelivery(userID, []string{deliveryKey("new", ""), deliveryKey("new", "channel-id")})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"new/channel-id": true}, claimed)
+}
+
+func TestResyncMailboxForUser(t *testing.T) {
+	const userID = "user-id"
+
+	for name, test := range map[string]struct {
+		lastMessageTime string
+		expectListed    bool
+		expectWarning   bool
+	}{
+		"time of the last processed message is known": {
+			lastMessageTime: strconv.FormatInt(model.GetMillis()-60*1000, 10),
+			expectListed:    true,
+		},
+		"time of the last processed message was never recorded": {
+			expectWarning: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			listed := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/gmail/v1/users/me@example.com/profile":
+					_ = json.NewEncoder(w).Encode(&gmail.Profile{EmailAddress: "me@example.com", HistoryId: 5678})
+				case "/gmail/v1/users/me@example.com/messages":
+					listed = true
+					assert.Contains(t, r.URL.Query().Get("q"), "after:")
+					_ = json.NewEncoder(w).Encode(&gmail.ListMessagesResponse{})
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+			gmailService, err := gmail.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithoutAuthentication())
+			require.NoError(t, err)
+
+			api := &plugintest.API{}
+			store := mockKVStore(api)
+			mockLogs(api)
+			api.On("GetDirectChannel", userID, "bot-id").Return(&model.Channel{Id: "direct-channel-id"}, nil)
+			warnings := []string{}
+			api.On("CreatePost", mock.Anything).Return(func(post *model.Post) *model.Post {
+				warnings = append(warnings, post.ChannelId)
+				return &model.Post{Id: model.NewId(), ChannelId: post.ChannelId}
+			}, nil)
+
+			p := &Plugin{gmailBotID: "bot-id"}
+			p.SetAPI(api)
+			if test.lastMessageTime != "" {
+				store.set(userID+"lastMessageTime", []byte(test.lastMessageTime))
+			}
+
+			require.NoError(t, p.resyncMailboxForUser(userID, "me@example.com", gmailService))
+
+			assert.Equal(t, test.expectListed, listed)
+			if test.expectWarning {
+				assert.Equal(t, []string{"direct-channel-id"}, warnings)
+			} else {
+				assert.Empty(t, warnings)
+			}
+			historyID, err := p.getHistoryIDForUser(userID)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(5678), historyID)
+		})
+	}
+}
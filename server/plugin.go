@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
 	"github.com/pkg/errors"
@@ -22,6 +23,44 @@ type Plugin struct {
 	// configuration is the active plugin configuration. Consult getConfiguration and
 	// setConfiguration for usage.
 	configuration *configuration
+
+	// previousEncryptionKey is the encryption key replaced by the last change of the configuration. Consult
+	// getPreviousEncryptionKey for usage.
+	previousEncryptionKey string
+
+	// pushKeySourceLock synchronizes access to pushKeySource.
+	pushKeySourceLock sync.Mutex
+
+	// pushKeySource provides the keys verifying the tokens of Pub/Sub push requests.
+	// Consult getPushKeySource for usage.
+	pushKeySource keySource
+
+	// workersLock synchronizes starting and stopping the background jobs.
+	workersLock sync.Mutex
+
+	// workersRunning is set while the background jobs are started.
+	workersRunning bool
+
+	// watchRenewalStop and watchRenewalDone control the background job renewing Gmail watches
+	watchRenewalStop chan struct{}
+	watchRenewalDone chan struct{}
+
+	// pullWorkerCancel and pullWorkerDone control the background job pulling notifications
+	pullWorkerCancel context.CancelFunc
+	pullWorkerDone   chan struct{}
+
+	// notificationQueue processes the received notifications in the background
+	notificationQueue *notificationQueue
+
+	// pollerStop and pollerDone control the background job polling the mailboxes
+	pollerStop chan struct{}
+	pollerDone chan struct{}
+
+	// bulkImportStop and bulkImportDone control the background job running the bulk imports,
+	// bulkImportWakeUp makes it look for new ones
+	bulkImportStop   chan struct{}
+	bulkImportDone   chan struct{}
+	bulkImportWakeUp chan struct{}
 }
 
 // OnActivate is invoked when the plugin is activated. If an error is returned, the plugin will be terminated.
@@ -36,12 +75,18 @@ func (p *Plugin) OnActivate() error {
 		return err
 	}
 
+	// Encrypt tokens stored in plain text by earlier versions of the plugin
+	if err = p.encryptPlainTextTokens(); err != nil {
+		p.API.LogError("Failed to encrypt stored tokens", "err", err.Error())
+		return errors.Wrap(err, "failed to encrypt stored tokens")
+	}
+
 	// Register the command commandGmail
 	if err = p.API.RegisterCommand(&model.Command{
 		Trigger:          commandGmail,
 		AutoComplete:     true,
 		AutoCompleteHint: "[command]",
-		AutoCompleteDesc: "Available Commands: connect, disconnect, subscribe, unsubscribe, import, subscriptions, help",
+		AutoCompleteDesc: "Available Commands: connect, disconnect, subscribe, unsubscribe, import, search, subscriptions, following, sync, send, forward-thread, deadletters, help",
 	}); err != nil {
 		errorMessage := "failed to register command " + commandGmail
 		p.API.LogError(errorMessage, "err", err.Error())
@@ -88,5 +133,97 @@ func (p *Plugin) OnActivate() error {
 		return errors.Wrap(err, "Could not set the profile image")
 	}
 
+	p.workersLock.Lock()
+	defer p.workersLock.Unlock()
+	p.startNotificationWorkers()
+	p.startBulkImports()
+
 	return nil
 }
+
+// OnDeactivate is invoked when the plugin is deactivated.
+// https://developers.mattermost.com/extend/plugins/server/reference/#Hooks.OnDeactivate
+func (p *Plugin) OnDeactivate() error {
+	p.workersLock.Lock()
+	defer p.workersLock.Unlock()
+	p.stopNotificationWorkers()
+	p.stopBulkImports()
+
+	return nil
+}
+
+// UserHasLeftChannel is invoked after the membership has been removed from the database.
+// The subscriptions of the user delivered to the channel are delivered to the bot DM instead.
+// https://developers.mattermost.com/extend/plugins/server/reference/#Hooks.UserHasLeftChannel
+func (p *Plugin) UserHasLeftChannel(c *plugin.Context, channelMember *model.ChannelMember, actor *model.User) {
+	p.dropRoutesToChannel(channelMember.UserId, channelMember.ChannelId, "you left the channel")
+	p.unfollowThreadsOfChannel(channelMember.UserId, channelMember.ChannelId)
+}
+
+// UserHasLeftTeam is invoked after the membership has been removed from the database.
+// The subscriptions of the user delivered to the channels of the team are delivered to the bot DM instead.
+// https://developers.mattermost.com/extend/plugins/server/reference/#Hooks.UserHasLeftTeam
+func (p *Plugin) UserHasLeftTeam(c *plugin.Context, teamMember *model.TeamMember, actor *model.User) {
+	routes, err := p.getRoutesOfUser(teamMember.UserId)
+	if err != nil {
+		p.API.LogError("Could not get the subscription routes of user with user ID: "+teamMember.UserId, "err", err.Error())
+		return
+	}
+
+	dropped := map[string]bool{}
+	for _, channelID := range routes {
+		if dropped[channelID] {
+			continue
+		}
+		channel, appErr := p.API.GetChannel(channelID)
+		if appErr == nil && channel.TeamId != teamMember.TeamId {
+			continue
+		}
+		dropped[channelID] = true
+		p.dropRoutesToChannel(teamMember.UserId, channelID, "you left its team")
+	}
+}
+
+// startNotificationWorkers starts the background jobs needed by the configured delivery mode.
+// The caller must hold workersLock.
+func (p *Plugin) startNotificationWorkers() {
+	p.startNotificationQueue()
+
+	switch p.getConfiguration().getDeliveryMode() {
+	case deliveryModePoll:
+		p.startPoller()
+	case deliveryModePull:
+		if err := p.startPullWorker(); err != nil {
+			p.API.LogError("Could not start pulling Gmail notifications", "err", err.Error())
+		}
+		// The pull subscription receives the notifications of the same Gmail watches as the push one
+		p.startWatchRenewal()
+	default:
+		// Gmail watches expire after seven days, keep renewing them in the background
+		p.startWatchRenewal()
+	}
+
+	p.workersRunning = true
+}
+
+// stopNotificationWorkers stops all the background jobs. The caller must hold workersLock.
+func (p *Plugin) stopNotificationWorkers() {
+	p.stopPoller()
+	p.stopPullWorker()
+	p.stopWatchRenewal()
+	p.stopNotificationQueue()
+
+	p.workersRunning = false
+}
+
+// restartNotificationWorkers restarts the background jobs, if they are running, to apply a new configuration
+func (p *Plugin) restartNotificationWorkers() {
+	p.workersLock.Lock()
+	defer p.workersLock.Unlock()
+
+	if !p.workersRunning {
+		return
+	}
+	p.stopNotificationWorkers()
+	p.startNotificationWorkers()
+}
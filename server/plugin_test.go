@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+)
+
+// testKVStore is an in memory KV store backing the KV methods of a mocked API
+type testKVStore struct {
+	lock   sync.Mutex
+	values map[string][]byte
+}
+
+// mockKVStore makes the KV methods of the API read and write an in memory store, which is returned
+func mockKVStore(api *plugintest.API) *testKVStore {
+	store := &testKVStore{values: map[string][]byte{}}
+
+	api.On("KVGet", mock.Anything).Return(func(key string) []byte {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		return store.values[key]
+	}, nil)
+	api.On("KVSet", mock.Anything, mock.Anything).Return(func(key string, value []byte) *model.AppError {
+		store.set(key, value)
+		return nil
+	})
+	api.On("KVDelete", mock.Anything).Return(func(key string) *model.AppError {
+		store.set(key, nil)
+		return nil
+	})
+	api.On("KVCompareAndSet", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, oldValue []byte, newValue []byte) bool {
+		return store.compareAndSet(key, oldValue, newValue)
+	}, nil)
+	api.On("KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, value []byte, options model.PluginKVSetOptions) bool {
+		if options.Atomic {
+			return store.compareAndSet(key, options.OldValue, value)
+		}
+		store.set(key, value)
+		return true
+	}, nil)
+	api.On("KVCompareAndDelete", mock.Anything, mock.Anything).Return(func(key string, oldValue []byte) bool {
+		return store.compareAndSet(key, oldValue, nil)
+	}, nil)
+	api.On("KVList", mock.Anything, mock.Anything).Return(func(page int, perPage int) []string {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		keys := []string{}
+		for key := range store.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if page*perPage >= len(keys) {
+			return []string{}
+		}
+		keys = keys[page*perPage:]
+		if len(keys) > perPage {
+			keys = keys[:perPage]
+		}
+		return keys
+	}, nil)
+	return store
+}
+
+// get returns the stored value of the key, nil if there is none
+func (s *testKVStore) get(key string) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.values[key]
+}
+
+// set stores the value of the key, deleting it if the value is nil
+func (s *testKVStore) set(key string, value []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if value == nil {
+		delete(s.values, key)
+		return
+	}
+	s.values[key] = value
+}
+
+// compareAndSet stores the value of the key if the current value is the old one, nil meaning none
+func (s *testKVStore) compareAndSet(key string, oldValue []byte, newValue []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current, exists := s.values[key]
+	if (oldValue == nil && exists) || (oldValue != nil && !bytes.Equal(current, oldValue)) {
+		return false
+	}
+	if newValue == nil {
+		delete(s.values, key)
+	} else {
+		s.values[key] = newValue
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// defaultPollingInterval is used when no valid polling interval is configured
+	defaultPollingInterval = time.Minute
+
+	// minPollingInterval protects the Gmail API quota from too frequent polling
+	minPollingInterval = 15 * time.Second
+)
+
+// getPollingInterval returns the configured interval between two polls of the mailboxes
+func (c *configuration) getPollingInterval() time.Duration {
+	interval := time.Duration(c.PollingIntervalSeconds) * time.Second
+	if interval <= 0 {
+		return defaultPollingInterval
+	}
+	if interval < minPollingInterval {
+		return minPollingInterval
+	}
+	return interval
+}
+
+// startPoller starts the background job polling the history of every connected mailbox
+func (p *Plugin) startPoller() {
+	p.pollerStop = make(chan struct{})
+	p.pollerDone = make(chan struct{})
+
+	go func(stop <-chan struct{}, done chan<- struct{}, interval time.Duration) {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.pollMailboxes(stop)
+			}
+		}
+	}(p.pollerStop, p.pollerDone, p.getConfiguration().getPollingInterval())
+
+	p.API.LogInfo("Started polling Gmail every " + p.getConfiguration().getPollingInterval().String())
+}
+
+// stopPoller stops the polling job and waits for it to finish
+func (p *Plugin) stopPoller() {
+	if p.pollerStop == nil {
+		return
+	}
+	close(p.pollerStop)
+	<-p.pollerDone
+	p.pollerStop = nil
+}
+
+// pollMailboxes processes the changes of every connected mailbox since the stored history IDs.
+// The history of a mailbox connected by several users is fetched once for all of them.
+func (p *Plugin) pollMailboxes(stop <-chan struct{}) {
+	userIDs, err := p.getConnectedUserIDs()
+	if err != nil {
+		p.API.LogError("Could not list connected users for polling", "err", err.Error())
+		return
+	}
+
+	polled := map[string]bool{}
+	for _, userID := range userIDs {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if p.isConnectionBroken(userID) {
+			continue
+		}
+
+		gmailID, err := p.getGmailID(userID)
+		if err != nil {
+			p.API.LogError("Could not get gmail ID for user with user ID: "+userID, "err", err.Error())
+			continue
+		}
+		if polled[gmailID] {
+			continue
+		}
+		polled[gmailID] = true
+
+		p.pollMailbox(gmailID)
+	}
+}
+
+// pollMailbox processes the changes of the mailbox, unless another server of the cluster is processing them
+func (p *Plugin) pollMailbox(gmailID string) {
+	unlock, err := p.tryLockMailbox(gmailID)
+	if err != nil {
+		p.API.LogError("Could not lock the mailbox for polling, gmail ID: "+gmailID, "err", err.Error())
+		return
+	}
+	if unlock == nil {
+		p.API.LogDebug("Skipping the poll of gmail ID: " + gmailID + " processed by another server")
+		return
+	}
+	defer unlock()
+
+	if err = p.processNotificationForMailbox(gmailID); err != nil {
+		p.API.LogError("Could not poll Gmail for gmail ID: "+gmailID, "err", err.Error())
+	}
+}
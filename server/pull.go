@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	// pullMaxMessages is the maximum number of messages received with a single pull
+	pullMaxMessages = 10
+
+	// pullRetryBaseDelay is the delay before pulling again after a failure, doubled on every failure
+	pullRetryBaseDelay = 5 * time.Second
+
+	// pullRetryMaxDelay caps the delay between pulls after failures
+	pullRetryMaxDelay = 5 * time.Minute
+)
+
+// pubsubPuller receives messages from a Pub/Sub pull subscription.
+// It can be pointed to the Pub/Sub emulator using the Pub/Sub Endpoint setting.
+type pubsubPuller interface {
+	pull(ctx context.Context, maxMessages int64) ([]*pubsub.ReceivedMessage, error)
+	acknowledge(ctx context.Context, ackIDs []string) error
+}
+
+// restPuller pulls messages using the Pub/Sub REST API
+type restPuller struct {
+	service      *pubsub.Service
+	subscription string
+}
+
+// newPubsubPuller creates a puller for the subscription configured in the plugin settings
+func newPubsubPuller(ctx context.Context, config *configuration) (pubsubPuller, error) {
+	options := []option.ClientOption{}
+	if config.PubSubEndpoint != "" {
+		// The emulator does not authenticate the requests
+		options = append(options, option.WithEndpoint(strings.TrimRight(config.PubSubEndpoint, "/")+"/"), option.WithoutAuthentication())
+	} else if config.PubSubServiceAccountKey != "" {
+		options = append(options, option.WithCredentialsJSON([]byte(config.PubSubServiceAccountKey)))
+	}
+
+	service, err := pubsub.NewService(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &restPuller{
+		service:      service,
+		subscription: config.PullSubscriptionName,
+	}, nil
+}
+
+func (r *restPuller) pull(ctx context.Context, maxMessages int64) ([]*pubsub.ReceivedMessage, error) {
+	response, err := r.service.Projects.Subscriptions.Pull(r.subscription, &pubsub.PullRequest{
+		MaxMessages: maxMessages,
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return response.ReceivedMessages, nil
+}
+
+func (r *restPuller) acknowledge(ctx context.Context, ackIDs []string) error {
+	_, err := r.service.Projects.Subscriptions.Acknowledge(r.subscription, &pubsub.AcknowledgeRequest{
+		AckIds: ackIDs,
+	}).Context(ctx).Do()
+	return err
+}
+
+// startPullWorker starts the background job consuming Gmail notifications from the pull subscription
+func (p *Plugin) startPullWorker() error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	puller, err := newPubsubPuller(ctx, p.getConfiguration())
+	if err != nil {
+		cancel()
+		return errors.Wrap(err, "Could not create Pub/Sub client")
+	}
+
+	p.pullWorkerCancel = cancel
+	p.pullWorkerDone = make(chan struct{})
+
+	go func(done chan<- struct{}) {
+		defer close(done)
+		p.runPullWorker(ctx, puller)
+	}(p.pullWorkerDone)
+
+	p.API.LogInfo("Started pulling Gmail notifications from " + p.getConfiguration().PullSubscriptionName)
+	return nil
+}
+
+// stopPullWorker stops the pull subscription worker and waits for it to finish
+func (p *Plugin) stopPullWorker() {
+	if p.pullWorkerCancel == nil {
+		return
+	}
+	p.pullWorkerCancel()
+	<-p.pullWorkerDone
+	p.pullWorkerCancel = nil
+}
+
+// runPullWorker pulls messages until the context is cancelled
+func (p *Plugin) runPullWorker(ctx context.Context, puller pubsubPuller) {
+	failures := 0
+	for ctx.Err() == nil {
+		receivedMessages, err := puller.pull(ctx, pullMaxMessages)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			delay := pullRetryBaseDelay << uint(failures-1)
+			if delay > pullRetryMaxDelay || delay <= 0 {
+				delay = pullRetryMaxDelay
+			}
+			p.API.LogError("Could not pull Gmail notifications", "err", err.Error(), "retryIn", delay.String())
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		failures = 0
+
+		ackIDs := []string{}
+		for _, receivedMessage := range receivedMessages {
+			if p.handlePulledMessage(receivedMessage.Message) {
+				ackIDs = append(ackIDs, receivedMessage.AckId)
+			}
+		}
+
+		if len(ackIDs) > 0 {
+			if err := puller.acknowledge(ctx, ackIDs); err != nil {
+				p.API.LogError("Could not acknowledge Gmail notifications", "err", err.Error())
+			}
+		}
+	}
+}
+
+// handlePulledMessage queues the processing of a pulled message and reports whether it can be acknowledged
+func (p *Plugin) handlePulledMessage(message *pubsub.PubsubMessage) bool {
+	if message == nil {
+		return true
+	}
+
+	publishTime, _ := time.Parse(time.RFC3339Nano, message.PublishTime)
+	fresh, err := p.checkPubsubMessageIsFresh(message.MessageId, publishTime)
+	if err != nil {
+		// Leave the message to be delivered again
+		p.API.LogError("Could not check if the Gmail notification was received before", "err", err.Error())
+		return false
+	}
+	if !fresh {
+		return true
+	}
+
+	decodedData, err := p.decodeBase64URL(message.Data)
+	if err != nil {
+		p.API.LogError("Cannot decode pulled message data", "err", err.Error())
+		return true
+	}
+
+	var notification gmailNotification
+	if err = json.Unmarshal([]byte(decodedData), &notification); err != nil || notification.EmailAddress == "" {
+		p.API.LogError("Cannot unmarshal pulled message data")
+		return true
+	}
+
+	if err = p.enqueueGmailNotification(&notification); err != nil {
+		// Leave the message to be delivered again
+		p.API.LogError("Gmail notification could not be queued", "err", err.Error())
+		p.forgetPubsubMessage(message.MessageId)
+		return false
+	}
+	return true
+}
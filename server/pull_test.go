@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const testPullSubscription = "projects/project/subscriptions/gmail"
+
+// testPubsubServer serves the pull and acknowledge requests of the Pub/Sub REST API for a single subscription.
+// The messages are returned by the first pull, the next one cancels the worker.
+type testPubsubServer struct {
+	lock     sync.Mutex
+	messages []*pubsub.ReceivedMessage
+	pulls    int
+	ackIDs   []string
+	cancel   context.CancelFunc
+}
+
+func (s *testPubsubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch r.URL.Path {
+	case "/v1/" + testPullSubscription + ":pull":
+		s.pulls++
+		response := &pubsub.PullResponse{}
+		if s.pulls == 1 {
+			response.ReceivedMessages = s.messages
+		} else {
+			s.cancel()
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	case "/v1/" + testPullSubscription + ":acknowledge":
+		var request pubsub.AcknowledgeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ackIDs = append(s.ackIDs, request.AckIds...)
+		_, _ = w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// testPulledMessage returns a received Gmail notification of the mailbox
+func testPulledMessage(ackID string, messageID string, emailAddress string) *pubsub.ReceivedMessage {
+	data, _ := json.Marshal(&gmailNotification{EmailAddress: emailAddress, HistoryID: 1234})
+	return &pubsub.ReceivedMessage{
+		AckId: ackID,
+		Message: &pubsub.PubsubMessage{
+			MessageId:   messageID,
+			PublishTime: time.Now().Format(time.RFC3339Nano),
+			Data:        base64.StdEncoding.EncodeToString(data),
+		},
+	}
+}
+
+func TestRunPullWorker(t *testing.T) {
+	for name, test := range map[string]struct {
+		usersLookupFails bool
+		receivedBefore   bool
+		expectAcked      bool
+		expectQueued     bool
+	}{
+		"queued notification is acknowledged": {
+			expectAcked:  true,
+			expectQueued: true,
+		},
+		"notification which could not be queued is not acknowledged": {
+			usersLookupFails: true,
+		},
+		"notification received before is acknowledged without being queued": {
+			receivedBefore: true,
+			expectAcked:    true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			if test.usersLookupFails {
+				api.On("KVGet", "me@example.comusers").Return(nil, &model.AppError{Message: "database unavailable"})
+			}
+			store := mockKVStore(api)
+			mockLogs(api)
+			store.set("me@example.comusers", []byte("user-id"))
+			if test.receivedBefore {
+				store.set(pushMessageKeyPrefix+"message-id", []byte("1"))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pubsubServer := &testPubsubServer{
+				messages: []*pubsub.ReceivedMessage{testPulledMessage("ack-id", "message-id", "me@example.com")},
+				cancel:   cancel,
+			}
+			server := httptest.NewServer(pubsubServer)
+			defer server.Close()
+
+			p := &Plugin{}
+			p.SetAPI(api)
+			config := &configuration{PullSubscriptionName: testPullSubscription, PubSubEndpoint: server.URL}
+			p.setConfiguration(config)
+
+			puller, err := newPubsubPuller(ctx, config)
+			require.NoError(t, err)
+			p.runPullWorker(ctx, puller)
+
+			assert.Equal(t, 2, pubsubServer.pulls)
+			if test.expectAcked {
+				assert.Equal(t, []string{"ack-id"}, pubsubServer.ackIDs)
+			} else {
+				assert.Empty(t, pubsubServer.ackIDs)
+				// The message is accepted again when it is redelivered
+				assert.Nil(t, store.get(pushMessageKeyPrefix+"message-id"))
+			}
+
+			jobs, err := p.getJobList(notificationQueueKey)
+			require.NoError(t, err)
+			if test.expectQueued {
+				require.Len(t, jobs, 1)
+				assert.Equal(t, "me@example.com", jobs[0].EmailAddress)
+			} else {
+				assert.Empty(t, jobs)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// querySubscriptionsMaxCount bounds the Gmail searches run for every notification of a user
+	querySubscriptionsMaxCount = 20
+
+	// queryMatchMaxPages bounds the pages of search results read to match the new messages against a query
+	queryMatchMaxPages = 5
+)
+
+// querySubscription notifies the user of the new messages matching a Gmail search query
+type querySubscription struct {
+	Name  string
+	Query string
+}
+
+// getQuerySubscriptionsOfUser returns the query subscriptions of the user
+func (p *Plugin) getQuerySubscriptionsOfUser(userID string) ([]*querySubscription, error) {
+	subscriptions := []*querySubscription{}
+	storedSubscriptions, appErr := p.API.KVGet(userID + "querySubscriptions")
+	if appErr != nil {
+		return nil, appErr
+	}
+	if storedSubscriptions == nil {
+		return subscriptions, nil
+	}
+	if err := json.Unmarshal(storedSubscriptions, &subscriptions); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// updateQuerySubscriptionsOfUser stores the query subscriptions of the user
+func (p *Plugin) updateQuerySubscriptionsOfUser(userID string, subscriptions []*querySubscription) error {
+	if len(subscriptions) == 0 {
+		if appErr := p.API.KVDelete(userID + "querySubscriptions"); appErr != nil {
+			return appErr
+		}
+		return nil
+	}
+
+	subscriptionsJSON, err := json.Marshal(subscriptions)
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(userID+"querySubscriptions", subscriptionsJSON); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// getMessagesMatchingQuery returns the IDs of the messages matching the Gmail search query.
+// The search is scoped to the time of the oldest message so that only a few results are read.
+func getMessagesMatchingQuery(gmailService *gmail.Service, gmailID string, query string, messages []*gmail.Message) (map[string]bool, error) {
+	candidates := map[string]bool{}
+	oldestMessageTime := int64(0)
+	for _, message := range messages {
+		candidates[message.Id] = true
+		if oldestMessageTime == 0 || (message.InternalDate > 0 && message.InternalDate < oldestMessageTime) {
+			oldestMessageTime = message.InternalDate
+		}
+	}
+
+	scopedQuery := "(" + query + ")"
+	if oldestMessageTime > 0 {
+		scopedQuery += " after:" + strconv.FormatInt(oldestMessageTime/1000-1, 10)
+	}
+
+	matched := map[string]bool{}
+	pageToken := ""
+	for page := 0; page < queryMatchMaxPages; page++ {
+		listCall := gmailService.Users.Messages.List(gmailID).Q(scopedQuery)
+		if pageToken != "" {
+			listCall = listCall.PageToken(pageToken)
+		}
+		listResponse, err := listCall.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range listResponse.Messages {
+			if candidates[message.Id] {
+				matched[message.Id] = true
+			}
+		}
+
+		pageToken = listResponse.NextPageToken
+		if pageToken == "" || len(matched) == len(candidates) {
+			break
+		}
+	}
+	return matched, nil
+}
+
+// parseQuerySubscriptionArgs splits `"<query>" --name <name> --channel ~channel-name` into the query, the name
+// and the options. The name defaults to the query.
+func parseQuerySubscriptionArgs(text string) (string, string, map[string]string) {
+	query, options := parseCommandOptions(text, "--name", "--channel")
+	query = trimQuotes(query)
+
+	name := options["--name"]
+	if name == "" {
+		name = query
+	}
+	return query, name, options
+}
+
+// trimQuotes removes a pair of straight or curly quotes around the text
+func trimQuotes(text string) string {
+	for _, quotes := range [][2]string{{`"`, `"`}, {"“", "”"}} {
+		if len(text) >= len(quotes[0])+len(quotes[1]) && strings.HasPrefix(text, quotes[0]) && strings.HasSuffix(text, quotes[1]) {
+			return strings.TrimSpace(text[len(quotes[0]) : len(text)-len(quotes[1])])
+		}
+	}
+	return text
+}
+
+// handleSubscribeQueryCommand adds a query subscription for the user
+func (p *Plugin) handleSubscribeQueryCommand(c *plugin.Context, args *model.CommandArgs, ownerID string, text string) (*model.CommandResponse, *model.AppError) {
+	// `/gmail subscribe query "<Gmail search query>" [--name <name>] [--channel ~channel-name]`
+	query, name, options := parseQuerySubscriptionArgs(text)
+	if query == "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please specify a Gmail search query, for eg. `/"+commandGmail+" subscribe query \"from:pagerduty.com subject:(P1 OR P2)\" --name pagerduty`.")
+		return &model.CommandResponse{}, nil
+	}
+
+	var channel *model.Channel
+	if channelName, routed := options["--channel"]; routed {
+		if isChannelMailbox(ownerID) {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "The mails of a shared mailbox are always delivered to its channel.")
+			return &model.CommandResponse{}, nil
+		}
+		var errMessage string
+		if channel, errMessage = p.getRouteChannel(args.UserId, args.TeamId, channelName); channel == nil {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, errMessage)
+			return &model.CommandResponse{}, nil
+		}
+	}
+
+	subscriptions, err := p.getQuerySubscriptionsOfUser(ownerID)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to get your query subscriptions: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+
+	replaced := false
+	for _, subscription := range subscriptions {
+		if strings.EqualFold(subscription.Name, name) {
+			subscription.Query = query
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		if len(subscriptions) >= querySubscriptionsMaxCount {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, fmt.Sprintf("You can have at most %d query subscriptions. Use `/%s unsubscribe query <name>` to remove one.", querySubscriptionsMaxCount, commandGmail))
+			return &model.CommandResponse{}, nil
+		}
+		subscriptions = append(subscriptions, &querySubscription{Name: name, Query: query})
+	}
+
+	// Check the query with Gmail before storing it
+	gmailService, err := p.getGmailService(ownerID)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to connect to Gmail: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	gmailID, err := p.getGmailID(ownerID)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to get your Gmail ID: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	if _, err = gmailService.Users.Messages.List(gmailID).Q(query).MaxResults(1).Do(); err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Gmail could not run the query: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+
+	err = p.updateRoutesOfUser(ownerID, func(routes map[string]string) {
+		if channel != nil {
+			routes[queryRouteKey(name)] = channel.Id
+		} else {
+			delete(routes, queryRouteKey(name))
+		}
+	})
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to save the channel of the query subscription: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	if err = p.updateQuerySubscriptionsOfUser(ownerID, subscriptions); err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to save the query subscription: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	p.applySubscriptionsOfUser(ownerID)
+
+	message := "You have subscribed to the query `" + query + "` as **" + name + "** successfully."
+	if replaced {
+		message = "The query subscription **" + name + "** has been updated to `" + query + "`."
+	}
+	if channel != nil {
+		message += " Matching mails will be delivered to ~" + channel.Name + "."
+	}
+	p.sendMessageFromBot(args.ChannelId, args.UserId, true, message)
+	return &model.CommandResponse{}, nil
+}
+
+// handleUnsubscribeQueryCommand removes a query subscription of the user, or all of them if no name is given
+func (p *Plugin) handleUnsubscribeQueryCommand(c *plugin.Context, args *model.CommandArgs, ownerID string, text string) (*model.CommandResponse, *model.AppError) {
+	// `/gmail unsubscribe query [<name>]`
+	name := trimQuotes(strings.TrimSpace(text))
+
+	subscriptions, err := p.getQuerySubscriptionsOfUser(ownerID)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to get your query subscriptions: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	if len(subscriptions) == 0 {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have not subscribed to any query. Use `/"+commandGmail+" subscribe query \"<query>\"` to subscribe.")
+		return &model.CommandResponse{}, nil
+	}
+
+	remainSubscribed := []*querySubscription{}
+	unsubscribedFrom := []string{}
+	for _, subscription := range subscriptions {
+		if name == "" || strings.EqualFold(subscription.Name, name) {
+			unsubscribedFrom = append(unsubscribedFrom, subscription.Name)
+			continue
+		}
+		remainSubscribed = append(remainSubscribed, subscription)
+	}
+	if len(unsubscribedFrom) == 0 {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have no query subscription named **"+name+"**. Use `/"+commandGmail+" subscriptions` to list them.")
+		return &model.CommandResponse{}, nil
+	}
+
+	if err = p.updateQuerySubscriptionsOfUser(ownerID, remainSubscribed); err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to remove the query subscription: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	err = p.updateRoutesOfUser(ownerID, func(routes map[string]string) {
+		for _, unsubscribedName := range unsubscribedFrom {
+			delete(routes, queryRouteKey(unsubscribedName))
+		}
+	})
+	if err != nil {
+		p.API.LogError("Could not remove the query routes of user with user ID: "+ownerID, "err", err.Error())
+	}
+	p.applySubscriptionsOfUser(ownerID)
+
+	p.sendMessageFromBot(args.ChannelId, args.UserId, true, "You have successfully unsubscribed from the queries: "+strings.Join(unsubscribedFrom, ", ")+".")
+	return &model.CommandResponse{}, nil
+}
+
+// matchQuerySubscriptionsOfUser returns the names of the query subscriptions of the user matched by each message, by message ID
+func (p *Plugin) matchQuerySubscriptionsOfUser(userID string, messages []*gmail.Message) (map[string][]string, error) {
+	matched := map[string][]string{}
+	if len(messages) == 0 {
+		return matched, nil
+	}
+
+	subscriptions, err := p.getQuerySubscriptionsOfUser(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get query subscriptions")
+	}
+	if len(subscriptions) == 0 {
+		return matched, nil
+	}
+
+	gmailID, err := p.getGmailID(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail ID")
+	}
+	gmailService, err := p.getGmailService(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail service")
+	}
+
+	for _, subscription := range subscriptions {
+		queryMatched, err := getMessagesMatchingQuery(gmailService, gmailID, subscription.Query, messages)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not search messages for the query subscription "+subscription.Name)
+		}
+		for messageID := range queryMatched {
+			matched[messageID] = append(matched[messageID], subscription.Name)
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuerySubscriptionArgs(t *testing.T) {
+	for name, test := range map[string]struct {
+		text          string
+		expectQuery   string
+		expectName    string
+		expectChannel string
+	}{
+		"query named after itself": {
+			text:        `"from:pagerduty.com subject:(P1 OR P2)"`,
+			expectQuery: "from:pagerduty.com subject:(P1 OR P2)",
+			expectName:  "from:pagerduty.com subject:(P1 OR P2)",
+		},
+		"name and channel": {
+			text:          `"from:pagerduty.com" --name pagerduty --channel ~incidents`,
+			expectQuery:   "from:pagerduty.com",
+			expectName:    "pagerduty",
+			expectChannel: "~incidents",
+		},
+		"whitespace within the quotes is kept": {
+			text:        `"subject:(weekly  report)" --name "weekly  report"`,
+			expectQuery: "subject:(weekly  report)",
+			expectName:  "weekly  report",
+		},
+		"options within the quotes are part of the query": {
+			text:        `"subject:(--name) --channel" --name flags`,
+			expectQuery: "subject:(--name) --channel",
+			expectName:  "flags",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			query, name, options := parseQuerySubscriptionArgs(test.text)
+			assert.Equal(t, test.expectQuery, query)
+			assert.Equal(t, test.expectName, name)
+			assert.Equal(t, test.expectChannel, options["--channel"])
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// queueWorkers is the number of notification jobs processed concurrently
+	queueWorkers = 4
+
+	// queuePollInterval is how often the queue is checked for jobs due for a retry
+	queuePollInterval = 5 * time.Second
+
+	// queueMaxAttempts is the number of failed attempts after which a job is moved to the dead letters
+	queueMaxAttempts = 6
+
+	// queueRetryBaseDelay is the delay before retrying a failed job, doubled on every failure
+	queueRetryBaseDelay = 30 * time.Second
+
+	// queueRetryMaxDelay caps the delay between retries of a failed job
+	queueRetryMaxDelay = time.Hour
+
+	// deadLettersMaxJobs bounds the number of dead letters kept for inspection
+	deadLettersMaxJobs = 100
+
+	// queueMaxRetries bounds the attempts to update the queue when it is modified concurrently
+	queueMaxRetries = 10
+
+	notificationQueueKey = "notificationQueue"
+	deadLettersKey       = "notificationDeadLetters"
+)
+
+// notificationJob is the processing of the changes of a mailbox for all the users connected to it
+type notificationJob struct {
+	ID           string
+	EmailAddress string
+	// Notifications counts the notifications received for the job, used to know if it must run again
+	Notifications int
+	Attempts      int
+	// NextAttempt is when the job is due, in milliseconds since epoch
+	NextAttempt int64
+	LastError   string
+	CreatedAt   int64
+}
+
+// notificationQueue dispatches the queued jobs to the workers, never running two jobs of the same mailbox at once
+type notificationQueue struct {
+	p *Plugin
+
+	wakeUp chan struct{}
+	jobs   chan *notificationJob
+	stop   chan struct{}
+	done   sync.WaitGroup
+
+	// mutex guards running
+	mutex   sync.Mutex
+	running map[string]bool
+}
+
+// updateJobList applies the update to the list of jobs stored at the key using compare-and-set
+func (p *Plugin) updateJobList(key string, update func(jobs []*notificationJob) []*notificationJob) error {
+	for attempt := 0; attempt < queueMaxRetries; attempt++ {
+		storedJobs, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return appErr
+		}
+
+		jobs := []*notificationJob{}
+		if storedJobs != nil {
+			if err := json.Unmarshal(storedJobs, &jobs); err != nil {
+				return err
+			}
+		}
+
+		updatedJobs, err := json.Marshal(update(jobs))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(updatedJobs, storedJobs) {
+			return nil
+		}
+
+		updated, appErr := p.API.KVCompareAndSet(key, storedJobs, updatedJobs)
+		if appErr != nil {
+			return appErr
+		}
+		if updated {
+			return nil
+		}
+	}
+	return errors.New("Could not update " + key + ", too many concurrent updates")
+}
+
+// getJobList returns the list of jobs stored at the key
+func (p *Plugin) getJobList(key string) ([]*notificationJob, error) {
+	jobs := []*notificationJob{}
+	storedJobs, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if storedJobs == nil {
+		return jobs, nil
+	}
+	if err := json.Unmarshal(storedJobs, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// enqueueNotificationForMailbox queues the processing of the mailbox changes.
+// Notifications for a mailbox already queued are merged into the queued job.
+func (p *Plugin) enqueueNotificationForMailbox(emailAddress string) error {
+	err := p.updateJobList(notificationQueueKey, func(jobs []*notificationJob) []*notificationJob {
+		for _, job := range jobs {
+			if job.EmailAddress == emailAddress {
+				job.Notifications++
+				return jobs
+			}
+		}
+		return append(jobs, &notificationJob{
+			ID:            model.NewId(),
+			EmailAddress:  emailAddress,
+			Notifications: 1,
+			CreatedAt:     model.GetMillis(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.notificationQueue != nil {
+		p.notificationQueue.notify()
+	}
+	return nil
+}
+
+// enqueueGmailNotification queues the processing of the notification, once for all the users connected to the mailbox
+func (p *Plugin) enqueueGmailNotification(notification *gmailNotification) error {
+	userIDs, err := p.getUsersForGmail(notification.EmailAddress)
+	if err != nil {
+		return err
+	}
+
+	if len(userIDs) < 1 {
+		p.API.LogInfo("No user connected to gmail ID: " + notification.EmailAddress)
+		return nil
+	}
+
+	if err := p.enqueueNotificationForMailbox(notification.EmailAddress); err != nil {
+		return errors.Wrap(err, "Could not queue notification for gmail ID: "+notification.EmailAddress)
+	}
+	return nil
+}
+
+// startNotificationQueue starts the workers processing the queued notification jobs
+func (p *Plugin) startNotificationQueue() {
+	queue := &notificationQueue{
+		p:       p,
+		wakeUp:  make(chan struct{}, 1),
+		jobs:    make(chan *notificationJob),
+		stop:    make(chan struct{}),
+		running: map[string]bool{},
+	}
+
+	for worker := 0; worker < queueWorkers; worker++ {
+		queue.done.Add(1)
+		go queue.work()
+	}
+	queue.done.Add(1)
+	go queue.dispatch()
+
+	p.notificationQueue = queue
+}
+
+// stopNotificationQueue stops the workers, waiting for the jobs being processed. Queued jobs are kept for the next start.
+func (p *Plugin) stopNotificationQueue() {
+	if p.notificationQueue == nil {
+		return
+	}
+	close(p.notificationQueue.stop)
+	p.notificationQueue.done.Wait()
+	p.notificationQueue = nil
+}
+
+// notify wakes up the dispatcher to look for due jobs
+func (q *notificationQueue) notify() {
+	select {
+	case q.wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands the due jobs over to the workers
+func (q *notificationQueue) dispatch() {
+	defer q.done.Done()
+	defer close(q.jobs)
+
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		jobs, err := q.p.getJobList(notificationQueueKey)
+		if err != nil {
+			q.p.API.LogError("Could not read the notification queue", "err", err.Error())
+		}
+
+		now := model.GetMillis()
+		for _, job := range jobs {
+			if job.NextAttempt > now || !q.markRunning(job.EmailAddress) {
+				continue
+			}
+
+			select {
+			case q.jobs <- job:
+			case <-q.stop:
+				q.markDone(job.EmailAddress)
+				return
+			}
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case <-q.wakeUp:
+		case <-ticker.C:
+		}
+	}
+}
+
+// work processes the jobs handed over by the dispatcher
+func (q *notificationQueue) work() {
+	defer q.done.Done()
+
+	for job := range q.jobs {
+		// Other servers of the cluster may dispatch the same job
+		unlock, err := q.p.tryLockMailbox(job.EmailAddress)
+		if err == nil && unlock == nil {
+			q.p.API.LogDebug("Notification for gmail ID: " + job.EmailAddress + " is processed by another server")
+			q.p.postponeNotificationJob(job)
+			q.markDone(job.EmailAddress)
+			continue
+		}
+		if err == nil {
+			err = q.processJob(job)
+			unlock()
+		}
+		if err != nil {
+			q.p.API.LogError("Could not process notification for gmail ID: "+job.EmailAddress, "err", err.Error())
+			q.p.failNotificationJob(job, err)
+		} else {
+			q.p.completeNotificationJob(job)
+		}
+		q.markDone(job.EmailAddress)
+		q.notify()
+	}
+}
+
+// processJob processes the job, turning a panic into an error so that only this job fails and is retried
+func (q *notificationQueue) processJob(job *notificationJob) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = errors.Errorf("Panic while processing the notification: %v", recovered)
+		}
+	}()
+	return q.p.processNotificationForMailbox(job.EmailAddress)
+}
+
+// markRunning records that a job of the mailbox is being processed, failing if one already is
+func (q *notificationQueue) markRunning(emailAddress string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.running[emailAddress] {
+		return false
+	}
+	q.running[emailAddress] = true
+	return true
+}
+
+func (q *notificationQueue) markDone(emailAddress string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.running, emailAddress)
+}
+
+// completeNotificationJob removes a processed job, unless notifications were received while it was processed
+func (p *Plugin) completeNotificationJob(processedJob *notificationJob) {
+	err := p.updateJobList(notificationQueueKey, func(jobs []*notificationJob) []*notificationJob {
+		remainingJobs := []*notificationJob{}
+		for _, job := range jobs {
+			if job.ID != processedJob.ID {
+				remainingJobs = append(remainingJobs, job)
+				continue
+			}
+			if job.Notifications > processedJob.Notifications {
+				job.Notifications -= processedJob.Notifications
+				job.Attempts = 0
+				job.NextAttempt = 0
+				job.LastError = ""
+				remainingJobs = append(remainingJobs, job)
+			}
+		}
+		return remainingJobs
+	})
+	if err != nil {
+		p.API.LogError("Could not remove the processed job from the notification queue", "err", err.Error())
+	}
+}
+
+// postponeNotificationJob delays a job which could not be started, without counting it as a failed attempt
+func (p *Plugin) postponeNotificationJob(postponedJob *notificationJob) {
+	err := p.updateJobList(notificationQueueKey, func(jobs []*notificationJob) []*notificationJob {
+		for _, job := range jobs {
+			if job.ID == postponedJob.ID {
+				job.NextAttempt = model.GetMillisForTime(time.Now().Add(queuePollInterval))
+			}
+		}
+		return jobs
+	})
+	if err != nil {
+		p.API.LogError("Could not postpone the notification job", "err", err.Error())
+	}
+}
+
+// failNotificationJob schedules a retry of the failed job with exponential backoff, or moves it to the dead letters
+func (p *Plugin) failNotificationJob(failedJob *notificationJob, jobErr error) {
+	var deadJob *notificationJob
+	err := p.updateJobList(notificationQueueKey, func(jobs []*notificationJob) []*notificationJob {
+		deadJob = nil
+		remainingJobs := []*notificationJob{}
+		for _, job := range jobs {
+			if job.ID != failedJob.ID {
+				remainingJobs = append(remainingJobs, job)
+				continue
+			}
+
+			job.Attempts++
+			job.LastError = jobErr.Error()
+			if job.Attempts >= queueMaxAttempts {
+				deadJob = job
+				continue
+			}
+
+			delay := queueRetryBaseDelay << uint(job.Attempts-1)
+			if delay > queueRetryMaxDelay || delay <= 0 {
+				delay = queueRetryMaxDelay
+			}
+			job.NextAttempt = model.GetMillisForTime(time.Now().Add(delay))
+			remainingJobs = append(remainingJobs, job)
+		}
+		return remainingJobs
+	})
+	if err != nil {
+		p.API.LogError("Could not schedule a retry of the failed notification job", "err", err.Error())
+		return
+	}
+
+	if deadJob == nil {
+		return
+	}
+
+	p.API.LogError("Notification job failed too many times, moving it to the dead letters", "jobId", deadJob.ID, "gmailId", deadJob.EmailAddress)
+	err = p.updateJobList(deadLettersKey, func(jobs []*notificationJob) []*notificationJob {
+		jobs = append(jobs, deadJob)
+		if len(jobs) > deadLettersMaxJobs {
+			jobs = jobs[len(jobs)-deadLettersMaxJobs:]
+		}
+		return jobs
+	})
+	if err != nil {
+		p.API.LogError("Could not store the dead letter", "err", err.Error())
+	}
+}
+
+// retryDeadLetters moves all the dead letters back to the notification queue and returns how many were moved
+func (p *Plugin) retryDeadLetters() (int, error) {
+	deadJobs, err := p.getJobList(deadLettersKey)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, job := range deadJobs {
+		if err = p.enqueueNotificationForMailbox(job.EmailAddress); err != nil {
+			return 0, err
+		}
+	}
+
+	retried := map[string]bool{}
+	for _, job := range deadJobs {
+		retried[job.ID] = true
+	}
+	err = p.updateJobList(deadLettersKey, func(jobs []*notificationJob) []*notificationJob {
+		remainingJobs := []*notificationJob{}
+		for _, job := range jobs {
+			if !retried[job.ID] {
+				remainingJobs = append(remainingJobs, job)
+			}
+		}
+		return remainingJobs
+	})
+	return len(deadJobs), err
+}
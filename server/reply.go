@@ -0,0 +1,293 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+// props of the posts of the mails, identifying the mail and the mailbox it belongs to
+const (
+	propGmailMessageID    = "gmail_message_id"
+	propGmailThreadID     = "gmail_thread_id"
+	propGmailRFCMessageID = "gmail_rfc_message_id"
+	propGmailOwnerID      = "gmail_owner_id"
+)
+
+// markers starting a thread reply which is sent as a reply to the mail
+const (
+	replyMarker    = "!reply"
+	replyAllMarker = "!replyall"
+)
+
+// mailPostProps returns the props identifying the mail of a post
+func mailPostProps(message *gmail.Message, rfcID string, ownerID string) model.StringInterface {
+	return model.StringInterface{
+		propGmailMessageID:    message.Id,
+		propGmailThreadID:     message.ThreadId,
+		propGmailRFCMessageID: rfcID,
+		propGmailOwnerID:      ownerID,
+	}
+}
+
+// parseReplyMarker tells if the message asks to reply to the mail, and returns the text of the reply
+func parseReplyMarker(message string) (bool, bool, string) {
+	message = strings.TrimSpace(message)
+	for _, marker := range []string{replyAllMarker, replyMarker} {
+		if message == marker || strings.HasPrefix(message, marker+" ") || strings.HasPrefix(message, marker+"\n") {
+			return true, marker == replyAllMarker, strings.TrimSpace(strings.TrimPrefix(message, marker))
+		}
+	}
+	return false, false, ""
+}
+
+// MessageHasBeenPosted is invoked after the message has been committed to the database.
+// A reply starting with !reply or !replyall in the thread of a mail is sent as a reply to the mail.
+// https://developers.mattermost.com/extend/plugins/server/reference/#Hooks.MessageHasBeenPosted
+func (p *Plugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post) {
+	if post.RootId == "" || post.UserId == p.gmailBotID || post.IsSystemMessage() {
+		return
+	}
+
+	isReply, replyAll, text := parseReplyMarker(post.Message)
+	if !isReply {
+		return
+	}
+
+	mailPost, err := p.findRepliedMailPost(post)
+	if err != nil {
+		p.API.LogError("Could not get the thread of the reply", "err", err.Error())
+		return
+	}
+	// Not the thread of a mail
+	if mailPost == nil {
+		return
+	}
+
+	if text == "" && len(post.FileIds) == 0 {
+		p.sendReplyFeedback(post, "Please write your reply after `"+replyMarker+"` or `"+replyAllMarker+"`.")
+		return
+	}
+
+	ownerID, _ := mailPost.GetProp(propGmailOwnerID).(string)
+	if errMessage := p.checkCanUseMailbox(post.UserId, post.ChannelId, ownerID); errMessage != "" {
+		p.sendReplyFeedback(post, errMessage)
+		return
+	}
+
+	recipients, err := p.replyToMail(ownerID, mailPost, replyAll, text, post.FileIds)
+	if err != nil {
+		p.API.LogError("Could not send the reply to the mail", "err", err.Error())
+		p.sendReplyFeedback(post, "Your reply could not be sent: "+err.Error())
+		return
+	}
+
+	if _, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: post.ChannelId,
+		RootId:    post.RootId,
+		ParentId:  post.Id,
+		Message:   ":email: Reply sent to " + strings.Join(recipients, ", ") + ".",
+	}); appErr != nil {
+		p.API.LogError("Could not confirm the reply to the mail", "err", appErr.Error())
+	}
+}
+
+// findRepliedMailPost returns the post of the mail the post replies to: its parent if it is a mail, or else
+// the latest mail of the thread posted before it. Nil is returned if the thread has no mail.
+func (p *Plugin) findRepliedMailPost(post *model.Post) (*model.Post, error) {
+	thread, appErr := p.API.GetPostThread(post.RootId)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	if parent, ok := thread.Posts[post.ParentId]; ok && p.isMailPost(parent) {
+		return parent, nil
+	}
+
+	var mailPost *model.Post
+	for _, threadPost := range thread.Posts {
+		if !p.isMailPost(threadPost) || threadPost.CreateAt > post.CreateAt {
+			continue
+		}
+		if mailPost == nil || threadPost.CreateAt > mailPost.CreateAt {
+			mailPost = threadPost
+		}
+	}
+	return mailPost, nil
+}
+
+// isMailPost tells if the post is a mail posted by the bot. The props of the posts of users are not trusted, as they
+// can be set through the REST API to point at the mails of another mailbox.
+func (p *Plugin) isMailPost(post *model.Post) bool {
+	return post.UserId == p.gmailBotID && post.GetProp(propGmailMessageID) != nil
+}
+
+// checkCanUseMailbox returns an error message for the user if the user cannot reply to or triage the mails of the mailbox.
+// A personal mailbox is used by its owner only, a channel mailbox by the members of its channel.
+func (p *Plugin) checkCanUseMailbox(userID string, channelID string, ownerID string) string {
+	if ownerID == "" {
+		return "This mail was posted by an earlier version of the plugin and cannot be used from Mattermost."
+	}
+
+	if isChannelMailbox(ownerID) {
+		if channelIDOfMailbox(ownerID) != channelID || !p.canPostToChannel(userID, channelID) {
+			return "Only the members of the channel of the shared mailbox can use its mails."
+		}
+	} else if ownerID != userID {
+		return "Only the owner of the mailbox can use this mail."
+	}
+
+	if p.checkIfConnected(ownerID) == false || p.isConnectionBroken(ownerID) {
+		return "The Gmail account of this mail is not connected anymore. Please reconnect it using `/gmail connect`."
+	}
+	return ""
+}
+
+// replyToMail sends the text as a reply to the mail of the post, from the mailbox of the owner, in the same Gmail thread.
+// It returns the recipients of the reply.
+func (p *Plugin) replyToMail(ownerID string, mailPost *model.Post, replyAll bool, text string, fileIDs []string) ([]string, error) {
+	messageID, _ := mailPost.GetProp(propGmailMessageID).(string)
+	threadID, _ := mailPost.GetProp(propGmailThreadID).(string)
+
+	gmailID, err := p.getGmailID(ownerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail ID")
+	}
+	gmailService, err := p.getGmailService(ownerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get gmail service")
+	}
+
+	original, err := gmailService.Users.Messages.Get(gmailID, messageID).Format("metadata").
+		MetadataHeaders("From", "To", "Cc", "Reply-To", "Subject", "Message-ID", "References").Do()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get the mail to reply to")
+	}
+	headers := original.Payload.Headers
+
+	to, cc := replyRecipients(headers, gmailID, replyAll)
+	if len(to) == 0 {
+		return nil, errors.New("No recipient found for the reply")
+	}
+
+	subject := getHeader(headers, "Subject")
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	rfcID := getHeader(headers, "Message-ID")
+	references := strings.TrimSpace(getHeader(headers, "References") + " " + rfcID)
+
+	attachments, err := p.getPostAttachments(fileIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sendMail(gmailService, gmailID, &outgoingMail{
+		To:          to,
+		Cc:          cc,
+		Subject:     subject,
+		TextBody:    text,
+		InReplyTo:   rfcID,
+		References:  references,
+		Attachments: attachments,
+	}, threadID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(to, cc...), nil
+}
+
+// getHeader returns the value of the header of a Gmail message, ignoring the case of the name
+func getHeader(headers []*gmail.MessagePartHeader, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// replyRecipients returns the recipients of a reply to the mail sent with the headers, excluding the mailbox itself.
+// A reply to a mail sent from the mailbox goes to the recipients of that mail.
+func replyRecipients(headers []*gmail.MessagePartHeader, ownAddress string, replyAll bool) ([]string, []string) {
+	parseAddresses := func(header string) []*mail.Address {
+		addresses, err := mail.ParseAddressList(getHeader(headers, header))
+		if err != nil {
+			return nil
+		}
+		return addresses
+	}
+
+	added := map[string]bool{strings.ToLower(ownAddress): true}
+	addRecipients := func(recipients []string, addresses []*mail.Address) []string {
+		for _, address := range addresses {
+			if !added[strings.ToLower(address.Address)] {
+				added[strings.ToLower(address.Address)] = true
+				recipients = append(recipients, address.String())
+			}
+		}
+		return recipients
+	}
+
+	sender := parseAddresses("Reply-To")
+	if len(sender) == 0 {
+		sender = parseAddresses("From")
+	}
+	sentByMailbox := false
+	for _, address := range parseAddresses("From") {
+		if strings.EqualFold(address.Address, ownAddress) {
+			sentByMailbox = true
+		}
+	}
+
+	to := []string{}
+	cc := []string{}
+	if sentByMailbox {
+		to = addRecipients(to, parseAddresses("To"))
+	} else {
+		to = addRecipients(to, sender)
+	}
+	if replyAll {
+		to = addRecipients(to, parseAddresses("To"))
+		cc = addRecipients(cc, parseAddresses("Cc"))
+	}
+	return to, cc
+}
+
+// getPostAttachments returns the files of a post as mail attachments
+func (p *Plugin) getPostAttachments(fileIDs []string) ([]*outgoingAttachment, error) {
+	attachments := []*outgoingAttachment{}
+	for _, fileID := range fileIDs {
+		fileInfo, appErr := p.API.GetFileInfo(fileID)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "Could not get the attached file")
+		}
+		data, appErr := p.API.GetFile(fileID)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "Could not read the attached file "+fileInfo.Name)
+		}
+		attachments = append(attachments, &outgoingAttachment{
+			Name:        fileInfo.Name,
+			ContentType: fileInfo.MimeType,
+			Data:        data,
+		})
+	}
+	return attachments, nil
+}
+
+// sendReplyFeedback tells the author of the reply, in the thread, why the reply could not be sent
+func (p *Plugin) sendReplyFeedback(post *model.Post, message string) {
+	p.API.SendEphemeralPost(post.UserId, &model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: post.ChannelId,
+		RootId:    post.RootId,
+		Message:   message,
+	})
+}
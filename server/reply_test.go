@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseReplyMarker(t *testing.T) {
+	for name, test := range map[string]struct {
+		message         string
+		expectIsReply   bool
+		expectReplyAll  bool
+		expectReplyText string
+	}{
+		"reply":                       {"!reply Thanks, see you then", true, false, "Thanks, see you then"},
+		"reply all":                   {"!replyall Thanks all", true, true, "Thanks all"},
+		"marker alone":                {"!reply", true, false, ""},
+		"reply all marker alone":      {"!replyall", true, true, ""},
+		"text on the next line":       {"!reply\nThanks,\nJane", true, false, "Thanks,\nJane"},
+		"surrounding spaces":          {"  !replyall  Sounds good  ", true, true, "Sounds good"},
+		"no marker":                   {"Thanks, see you then", false, false, ""},
+		"marker not at the start":     {"Please !reply to this", false, false, ""},
+		"marker glued to the text":    {"!replying now", false, false, ""},
+		"reply all glued to the text": {"!replyallnow", false, false, ""},
+		"empty message":               {"", false, false, ""},
+		"marker with different case":  {"!Reply Thanks", false, false, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			isReply, replyAll, text := parseReplyMarker(test.message)
+			assert.Equal(t, test.expectIsReply, isReply)
+			assert.Equal(t, test.expectReplyAll, replyAll)
+			assert.Equal(t, test.expectReplyText, text)
+		})
+	}
+}
+
+func TestReplyRecipients(t *testing.T) {
+	const ownAddress = "me@example.com"
+
+	headers := func(values map[string]string) []*gmail.MessagePartHeader {
+		messageHeaders := []*gmail.MessagePartHeader{}
+		for name, value := range values {
+			messageHeaders = append(messageHeaders, &gmail.MessagePartHeader{Name: name, Value: value})
+		}
+		return messageHeaders
+	}
+
+	for name, test := range map[string]struct {
+		headers  map[string]string
+		replyAll bool
+		expectTo []string
+		expectCc []string
+	}{
+		"reply to the sender": {
+			headers:  map[string]string{"From": "Jane Doe <jane@example.com>", "To": "me@example.com, bob@example.com"},
+			expectTo: []string{`"Jane Doe" <jane@example.com>`},
+			expectCc: []string{},
+		},
+		"reply to the Reply-To address": {
+			headers:  map[string]string{"From": "Jane Doe <jane@example.com>", "Reply-To": "support@example.com", "To": "me@example.com"},
+			expectTo: []string{"<support@example.com>"},
+			expectCc: []string{},
+		},
+		"reply all to the sender, the recipients and the copies": {
+			headers:  map[string]string{"From": "jane@example.com", "To": "me@example.com, bob@example.com", "Cc": "carol@example.com"},
+			replyAll: true,
+			expectTo: []string{"<jane@example.com>", "<bob@example.com>"},
+			expectCc: []string{"<carol@example.com>"},
+		},
+		"reply all leaves out the own address whatever its case": {
+			headers:  map[string]string{"From": "jane@example.com", "To": "Me <ME@Example.com>", "Cc": "me@example.com, carol@example.com"},
+			replyAll: true,
+			expectTo: []string{"<jane@example.com>"},
+			expectCc: []string{"<carol@example.com>"},
+		},
+		"reply all deduplicates addresses": {
+			headers:  map[string]string{"From": "jane@example.com", "Reply-To": "jane@example.com", "To": "bob@example.com, Jane <JANE@example.com>", "Cc": "bob@example.com, carol@example.com"},
+			replyAll: true,
+			expectTo: []string{"<jane@example.com>", "<bob@example.com>"},
+			expectCc: []string{"<carol@example.com>"},
+		},
+		"reply to a mail sent by the mailbox goes to its recipients": {
+			headers:  map[string]string{"From": "Me <me@example.com>", "To": "bob@example.com", "Cc": "carol@example.com"},
+			expectTo: []string{"<bob@example.com>"},
+			expectCc: []string{},
+		},
+		"reply all to a mail sent by the mailbox": {
+			headers:  map[string]string{"From": "me@example.com", "To": "bob@example.com", "Cc": "carol@example.com, me@example.com"},
+			replyAll: true,
+			expectTo: []string{"<bob@example.com>"},
+			expectCc: []string{"<carol@example.com>"},
+		},
+		"invalid Cc header is ignored": {
+			headers:  map[string]string{"From": "jane@example.com", "To": "me@example.com", "Cc": "not an address"},
+			replyAll: true,
+			expectTo: []string{"<jane@example.com>"},
+			expectCc: []string{},
+		},
+		"encoded names": {
+			headers:  map[string]string{"From": "=?utf-8?q?Zo=C3=AB?= <zoe@example.com>", "To": "me@example.com"},
+			expectTo: []string{"=?utf-8?q?Zo=C3=AB?= <zoe@example.com>"},
+			expectCc: []string{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			to, cc := replyRecipients(headers(test.headers), ownAddress, test.replyAll)
+			assert.Equal(t, test.expectTo, to)
+			assert.Equal(t, test.expectCc, cc)
+		})
+	}
+}
+
+func TestFindRepliedMailPost(t *testing.T) {
+	mailPost := func(id string, userID string, createAt int64) *model.Post {
+		post := &model.Post{Id: id, UserId: userID, RootId: "root-id", CreateAt: createAt}
+		post.AddProp(propGmailMessageID, "message-"+id)
+		post.AddProp(propGmailOwnerID, "owner-id")
+		return post
+	}
+
+	for name, test := range map[string]struct {
+		posts        []*model.Post
+		parentID     string
+		expectPostID string
+	}{
+		"parent mail": {
+			posts:        []*model.Post{mailPost("root-id", "bot-id", 1), mailPost("parent-id", "bot-id", 2)},
+			parentID:     "root-id",
+			expectPostID: "root-id",
+		},
+		"latest mail of the thread": {
+			posts:        []*model.Post{mailPost("root-id", "bot-id", 1), mailPost("latest-id", "bot-id", 2), mailPost("later-id", "bot-id", 20)},
+			expectPostID: "latest-id",
+		},
+		"parent with the props of a mail set by a user": {
+			posts:        []*model.Post{mailPost("root-id", "bot-id", 1), mailPost("forged-id", "user-id", 2)},
+			parentID:     "forged-id",
+			expectPostID: "root-id",
+		},
+		"thread without mail posted by the bot": {
+			posts: []*model.Post{mailPost("root-id", "user-id", 1)},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			thread := model.NewPostList()
+			for _, post := range test.posts {
+				thread.AddPost(post)
+			}
+			api := &plugintest.API{}
+			api.On("GetPostThread", "root-id").Return(thread, nil)
+
+			p := &Plugin{gmailBotID: "bot-id"}
+			p.SetAPI(api)
+
+			reply := &model.Post{Id: "reply-id", UserId: "user-id", RootId: "root-id", ParentId: test.parentID, CreateAt: 10}
+			repliedPost, err := p.findRepliedMailPost(reply)
+			require.NoError(t, err)
+			if test.expectPostID == "" {
+				assert.Nil(t, repliedPost)
+				return
+			}
+			require.NotNil(t, repliedPost)
+			assert.Equal(t, test.expectPostID, repliedPost.Id)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+// routesMaxRetries bounds the attempts to update the routes of a user when they are modified concurrently
+const routesMaxRetries = 10
+
+// labelRouteKey identifies the label subscription in the routes of a user
+func labelRouteKey(labelID string) string {
+	return "label:" + labelID
+}
+
+// queryRouteKey identifies the query subscription in the routes of a user. Query names are not case sensitive.
+func queryRouteKey(name string) string {
+	return "query:" + strings.ToLower(name)
+}
+
+// getRoutesOfUser returns the channels the subscriptions of the user are delivered to, by route key.
+// Subscriptions without a route are delivered to the direct channel with the bot.
+func (p *Plugin) getRoutesOfUser(userID string) (map[string]string, error) {
+	routes, _, err := p.getStoredRoutesOfUser(userID)
+	return routes, err
+}
+
+// getStoredRoutesOfUser returns the routes of the user along with their stored value, nil if there are none
+func (p *Plugin) getStoredRoutesOfUser(userID string) (map[string]string, []byte, error) {
+	routes := map[string]string{}
+	storedRoutes, appErr := p.API.KVGet(userID + "subscriptionRoutes")
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	if storedRoutes == nil {
+		return routes, nil, nil
+	}
+	if err := json.Unmarshal(storedRoutes, &routes); err != nil {
+		return nil, nil, err
+	}
+	return routes, storedRoutes, nil
+}
+
+// updateRoutesOfUser applies the update to the routes of the user using compare-and-set, retrying if they were
+// modified concurrently
+func (p *Plugin) updateRoutesOfUser(userID string, update func(routes map[string]string)) error {
+	for attempt := 0; attempt < routesMaxRetries; attempt++ {
+		routes, storedRoutes, err := p.getStoredRoutesOfUser(userID)
+		if err != nil {
+			return err
+		}
+		update(routes)
+
+		var updated bool
+		var appErr *model.AppError
+		if len(routes) == 0 {
+			if storedRoutes == nil {
+				return nil
+			}
+			updated, appErr = p.API.KVCompareAndDelete(userID+"subscriptionRoutes", storedRoutes)
+		} else {
+			routesJSON, err := json.Marshal(routes)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(routesJSON, storedRoutes) {
+				return nil
+			}
+			updated, appErr = p.API.KVCompareAndSet(userID+"subscriptionRoutes", storedRoutes, routesJSON)
+		}
+		if appErr != nil {
+			return appErr
+		}
+		if updated {
+			return nil
+		}
+	}
+
+	return errors.New("Could not update the subscription routes, too many concurrent updates")
+}
+
+// canPostToChannel checks that the user is a member of the channel and is allowed to post in it
+func (p *Plugin) canPostToChannel(userID string, channelID string) bool {
+	if _, appErr := p.API.GetChannelMember(channelID, userID); appErr != nil {
+		return false
+	}
+	return p.API.HasPermissionToChannel(userID, channelID, model.PERMISSION_CREATE_POST)
+}
+
+// getRouteChannel finds the channel given as `~channel-name` in the team, and checks that the user can
+// deliver mails into it. An error message for the user is returned if the channel cannot be used.
+func (p *Plugin) getRouteChannel(userID string, teamID string, channelName string) (*model.Channel, string) {
+	channelName = strings.TrimPrefix(strings.TrimSpace(channelName), "~")
+	if channelName == "" {
+		return nil, "Please specify the channel as `--channel ~channel-name`."
+	}
+
+	channel, appErr := p.API.GetChannelByName(teamID, channelName, false)
+	if appErr != nil {
+		return nil, "Channel ~" + channelName + " not found in this team."
+	}
+	if channel.Type != model.CHANNEL_OPEN && channel.Type != model.CHANNEL_PRIVATE {
+		return nil, "Mails can only be delivered to public or private channels."
+	}
+	if !p.canPostToChannel(userID, channel.Id) {
+		return nil, "You must be a member of ~" + channelName + " and be allowed to post in it."
+	}
+	return channel, ""
+}
+
+// getChannelDisplayName returns the channel as `~name` for the messages to the user
+func (p *Plugin) getChannelDisplayName(channelID string) string {
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return "a deleted channel"
+	}
+	return "~" + channel.Name
+}
+
+// getDestinationsOfMessages returns the channels each message is delivered to, given the subscriptions
+// it matched. An empty channel ID stands for the direct channel with the bot. Routes to channels the user
+// cannot post in anymore are dropped, and the messages are delivered to the direct channel instead.
+func (p *Plugin) getDestinationsOfMessages(userID string, matchedSubscriptions map[string][]string) map[string][]string {
+	routes, err := p.getRoutesOfUser(userID)
+	if err != nil {
+		p.API.LogError("Could not get the subscription routes of user with user ID: "+userID, "err", err.Error())
+		routes = map[string]string{}
+	}
+
+	allowed := map[string]bool{}
+	for _, channelID := range routes {
+		if _, checked := allowed[channelID]; !checked {
+			allowed[channelID] = p.canPostToChannel(userID, channelID)
+		}
+	}
+	for channelID, canPost := range allowed {
+		if !canPost {
+			p.dropRoutesToChannel(userID, channelID, "you cannot post in it anymore")
+		}
+	}
+
+	destinations := map[string][]string{}
+	for messageID, routeKeys := range matchedSubscriptions {
+		added := map[string]bool{}
+		for _, routeKey := range routeKeys {
+			channelID := routes[routeKey]
+			if channelID != "" && !allowed[channelID] {
+				channelID = ""
+			}
+			if !added[channelID] {
+				added[channelID] = true
+				destinations[messageID] = append(destinations[messageID], channelID)
+			}
+		}
+	}
+	return destinations
+}
+
+// dropRoutesToChannel removes the routes of the user to the channel, and tells the user about it
+func (p *Plugin) dropRoutesToChannel(userID string, channelID string, reason string) {
+	dropped := 0
+	err := p.updateRoutesOfUser(userID, func(routes map[string]string) {
+		for routeKey, routeChannelID := range routes {
+			if routeChannelID == channelID {
+				delete(routes, routeKey)
+				dropped++
+			}
+		}
+	})
+	if err != nil {
+		p.API.LogError("Could not drop the subscription routes of user with user ID: "+userID, "err", err.Error())
+		return
+	}
+	if dropped == 0 {
+		return
+	}
+
+	p.API.LogInfo("Dropped subscription routes of user with user ID: " + userID + " to channel with channel ID: " + channelID)
+	if _, err := p.CreateBotDMPost(userID, "Mails of your subscriptions will no longer be delivered to "+p.getChannelDisplayName(channelID)+" as "+reason+". They will be delivered here instead."); err != nil {
+		p.API.LogError("Could not notify the user about the dropped subscription routes", "err", err.Error())
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateRoutesOfUser(t *testing.T) {
+	const userID = "user-id"
+
+	api := &plugintest.API{}
+	store := mockKVStore(api)
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	require.NoError(t, p.updateRoutesOfUser(userID, func(routes map[string]string) {
+		routes[labelRouteKey("INBOX")] = "channel-a"
+	}))
+
+	// A route added concurrently, between reading the routes and storing them, is kept
+	attempts := 0
+	require.NoError(t, p.updateRoutesOfUser(userID, func(routes map[string]string) {
+		attempts++
+		if attempts == 1 {
+			concurrentRoutes, err := json.Marshal(map[string]string{labelRouteKey("INBOX"): "channel-a", queryRouteKey("Alerts"): "channel-b"})
+			require.NoError(t, err)
+			store.set(userID+"subscriptionRoutes", concurrentRoutes)
+		}
+		routes[labelRouteKey("Customers")] = "channel-c"
+	}))
+	assert.Equal(t, 2, attempts)
+	routes, err := p.getRoutesOfUser(userID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		labelRouteKey("INBOX"):     "channel-a",
+		queryRouteKey("Alerts"):    "channel-b",
+		labelRouteKey("Customers"): "channel-c",
+	}, routes)
+
+	// Removing all the routes deletes them
+	require.NoError(t, p.updateRoutesOfUser(userID, func(routes map[string]string) {
+		for key := range routes {
+			delete(routes, key)
+		}
+	}))
+	assert.Nil(t, store.get(userID+"subscriptionRoutes"))
+}
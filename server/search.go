@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ActionSearchPage is used in Post action to identify the buttons moving between the pages of `/gmail search`
+	ActionSearchPage = "ActionSearchPage"
+
+	// ActionSearchImport is used in Post action to identify the buttons importing a result of `/gmail search`
+	ActionSearchImport = "ActionSearchImport"
+
+	// searchPageSize is the number of mails listed on a page of `/gmail search`
+	searchPageSize = 5
+
+	// searchSnippetMaxLength bounds the snippets of the mails listed by `/gmail search`
+	searchSnippetMaxLength = 200
+)
+
+// handleSearchCommand lists the mails matching a Gmail search query, with buttons importing them in the channel
+func (p *Plugin) handleSearchCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	// `/gmail search <query>`
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args.Command), "/"+commandGmail))
+	query := trimQuotes(strings.TrimSpace(strings.TrimPrefix(text, "search")))
+	if query == "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please specify a Gmail search query, for eg. `/"+commandGmail+" search from:jane@example.com invoice`.")
+		return &model.CommandResponse{}, nil
+	}
+
+	if p.checkIfConnected(args.UserId) == false || p.isConnectionBroken(args.UserId) {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please connect yourself to Gmail using `/gmail connect`.")
+		return &model.CommandResponse{}, nil
+	}
+
+	post, err := p.searchResultsPost(args.UserId, args.ChannelId, query, "", nil)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to search Gmail: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+	p.API.SendEphemeralPost(args.UserId, post)
+	return &model.CommandResponse{}, nil
+}
+
+// searchResultsPost returns the ephemeral post listing a page of the mails matching the query. The page starts at the
+// page token, empty for the first page, and the tokens of the previous pages after the first one let the user go back to them.
+func (p *Plugin) searchResultsPost(userID string, channelID string, query string, pageToken string, previousTokens []string) (*model.Post, error) {
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		return nil, errors.New("Site URL is not defined in the App")
+	}
+	gmailID, err := p.getGmailID(userID)
+	if err != nil {
+		return nil, err
+	}
+	gmailService, err := p.getGmailService(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	listCall := gmailService.Users.Messages.List(gmailID).Q(query).MaxResults(searchPageSize)
+	if pageToken != "" {
+		listCall = listCall.PageToken(pageToken)
+	}
+	listResponse, err := listCall.Do()
+	if err != nil {
+		return nil, errors.Wrap(err, "Gmail could not run the query")
+	}
+
+	post := &model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: channelID,
+	}
+	if len(listResponse.Messages) == 0 {
+		post.Message = "No mails match `" + query + "`."
+		return post, nil
+	}
+	first := 1
+	if pageToken != "" {
+		first += (len(previousTokens) + 1) * searchPageSize
+	}
+	post.Message = fmt.Sprintf("Mails %d to %d matching `%s`:", first, first+len(listResponse.Messages)-1, query)
+
+	actionURL := fmt.Sprintf("%s/plugins/%s/command/search", *siteURL, manifest.Id)
+	importAction := func(name string, queryType string, id string) *model.PostAction {
+		return &model.PostAction{
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Name: name,
+			Integration: &model.PostActionIntegration{
+				URL: actionURL,
+				Context: map[string]interface{}{
+					"action":    ActionSearchImport,
+					"queryType": queryType,
+					"id":        id,
+					"signature": p.signAction(ActionSearchImport, userID, queryType, id),
+				},
+			},
+		}
+	}
+
+	location := p.getUserLocation(userID)
+	attachments := []*model.SlackAttachment{}
+	for _, result := range listResponse.Messages {
+		attachment := &model.SlackAttachment{
+			Title: "(no subject)",
+			Actions: []*model.PostAction{
+				importAction("Import here", "mail", result.Id),
+				importAction("Import thread here", "thread", result.ThreadId),
+			},
+		}
+
+		message, err := gmailService.Users.Messages.Get(gmailID, result.Id).Format("metadata").MetadataHeaders("From", "Subject").Do()
+		if err != nil {
+			p.API.LogError("Could not get the mail with ID: "+result.Id, "err", err.Error())
+			attachment.Text = "Unable to get the mail."
+			attachments = append(attachments, attachment)
+			continue
+		}
+		if message.Payload != nil {
+			if subject := getHeader(message.Payload.Headers, "Subject"); subject != "" {
+				attachment.Title = subject
+			}
+			attachment.AuthorName = getHeader(message.Payload.Headers, "From")
+		}
+		receivedAt := time.Unix(0, message.InternalDate*int64(time.Millisecond)).In(location).Format("Jan 2, 2006 3:04 PM MST")
+		attachment.Text = receivedAt + "\n" + truncateRunes(message.Snippet, searchSnippetMaxLength)
+		attachments = append(attachments, attachment)
+	}
+
+	pageAction := func(name string, token string, tokens []string) *model.PostAction {
+		joinedTokens := strings.Join(tokens, ",")
+		return &model.PostAction{
+			Type: model.POST_ACTION_TYPE_BUTTON,
+			Name: name,
+			Integration: &model.PostActionIntegration{
+				URL: actionURL,
+				Context: map[string]interface{}{
+					"action":         ActionSearchPage,
+					"query":          query,
+					"pageToken":      token,
+					"previousTokens": joinedTokens,
+					"signature":      p.signAction(ActionSearchPage, userID, query, token, joinedTokens),
+				},
+			},
+		}
+	}
+	pageActions := []*model.PostAction{}
+	switch {
+	case len(previousTokens) > 0:
+		pageActions = append(pageActions, pageAction("Previous", previousTokens[len(previousTokens)-1], previousTokens[:len(previousTokens)-1]))
+	case pageToken != "":
+		pageActions = append(pageActions, pageAction("Previous", "", nil))
+	}
+	if listResponse.NextPageToken != "" {
+		nextPreviousTokens := append([]string{}, previousTokens...)
+		if pageToken != "" {
+			nextPreviousTokens = append(nextPreviousTokens, pageToken)
+		}
+		pageActions = append(pageActions, pageAction("Next", listResponse.NextPageToken, nextPreviousTokens))
+	}
+	if len(pageActions) > 0 {
+		attachments = append(attachments, &model.SlackAttachment{Actions: pageActions})
+	}
+
+	post.AddProp("attachments", attachments)
+	return post, nil
+}
+
+// truncateRunes cuts the text to the number of characters, marking the cut with an ellipsis
+func truncateRunes(text string, maxLength int) string {
+	runes := []rune(text)
+	if len(runes) <= maxLength {
+		return text
+	}
+	return string(runes[:maxLength]) + "…"
+}
+
+// splitPageTokens splits the page tokens joined in the context of the buttons of `/gmail search`
+func splitPageTokens(joinedTokens string) []string {
+	tokens := []string{}
+	for _, token := range strings.Split(joinedTokens, ",") {
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// handleSearchAction runs the action of a button of `/gmail search`. It returns the updated list, if it changed, and
+// a message for the user, if any.
+func (p *Plugin) handleSearchAction(userID string, channelID string, context map[string]interface{}) (*model.Post, string, error) {
+	action, _ := context["action"].(string)
+	signature, _ := context["signature"].(string)
+
+	switch action {
+	case ActionSearchPage:
+		query, _ := context["query"].(string)
+		pageToken, _ := context["pageToken"].(string)
+		previousTokens, _ := context["previousTokens"].(string)
+		if !p.verifyAction(signature, ActionSearchPage, userID, query, pageToken, previousTokens) {
+			return nil, "", errors.New("Unauthorized or unknown search action detected")
+		}
+		post, err := p.searchResultsPost(userID, channelID, query, pageToken, splitPageTokens(previousTokens))
+		if err != nil {
+			return nil, "Unable to search Gmail: " + err.Error(), nil
+		}
+		return post, "", nil
+
+	case ActionSearchImport:
+		queryType, _ := context["queryType"].(string)
+		id, _ := context["id"].(string)
+		if (queryType != "thread" && queryType != "mail") || !p.verifyAction(signature, ActionSearchImport, userID, queryType, id) {
+			return nil, "", errors.New("Unauthorized or unknown search action detected")
+		}
+		if !p.canPostToChannel(userID, channelID) {
+			return nil, "You cannot post in this channel.", nil
+		}
+		message, err := p.importFromGmail(userID, channelID, queryType, id, false)
+		if err != nil {
+			return nil, "Unable to import the " + queryType + ": " + err.Error(), nil
+		}
+		if message == "" {
+			message = "The " + queryType + " has been imported."
+		}
+		return nil, message, nil
+	}
+	return nil, "", errors.New("Unknown search action " + action)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/mattermost/mattermost-server/v5/utils/markdown"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sendDialogCallbackID identifies the submissions of the dialog composing a mail
+	sendDialogCallbackID = "gmailSend"
+
+	// sendDialogBodyMaxLength is the longest body accepted by the dialog
+	sendDialogBodyMaxLength = 3000
+)
+
+// sendDialogState is kept in the dialog composing a mail, between opening and submitting it
+type sendDialogState struct {
+	// PostID is the post of the thread the command was run from, whose files are attached to the mail
+	PostID string `json:"post_id"`
+	RootID string `json:"root_id"`
+}
+
+// handleSendCommand opens the dialog composing a new mail
+func (p *Plugin) handleSendCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	if p.checkIfConnected(args.UserId) == false || p.isConnectionBroken(args.UserId) {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please connect yourself to Gmail using `/gmail connect`.")
+		return &model.CommandResponse{}, nil
+	}
+
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Error! Site URL is not defined in the App")
+		return &model.CommandResponse{}, nil
+	}
+
+	// The files of the post the command replies to are attached to the mail
+	state := sendDialogState{PostID: args.ParentId, RootID: args.RootId}
+	if state.PostID == "" {
+		state.PostID = args.RootId
+	}
+	introduction := ""
+	if state.PostID != "" {
+		if post, appErr := p.API.GetPost(state.PostID); appErr == nil && len(post.FileIds) > 0 {
+			introduction = fmt.Sprintf("The %d files of the post you are replying to will be attached to the mail.", len(post.FileIds))
+		}
+	}
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return nil, model.NewAppError("handleSendCommand", "", nil, err.Error(), 500)
+	}
+
+	appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: args.TriggerId,
+		URL:       fmt.Sprintf("%s/plugins/%s/dialog/send", *siteURL, manifest.Id),
+		Dialog: model.Dialog{
+			CallbackId:       sendDialogCallbackID,
+			Title:            "Send an email",
+			IntroductionText: introduction,
+			SubmitLabel:      "Send",
+			State:            string(stateJSON),
+			Elements: []model.DialogElement{{
+				DisplayName: "To",
+				Name:        "to",
+				Type:        "text",
+				Placeholder: "jane@example.com, John <john@example.com>",
+				Optional:    true,
+			}, {
+				DisplayName: "Cc",
+				Name:        "cc",
+				Type:        "text",
+				Optional:    true,
+			}, {
+				DisplayName: "Bcc",
+				Name:        "bcc",
+				Type:        "text",
+				Optional:    true,
+			}, {
+				DisplayName: "Subject",
+				Name:        "subject",
+				Type:        "text",
+			}, {
+				DisplayName: "Body",
+				Name:        "body",
+				Type:        "textarea",
+				HelpText:    "Markdown is sent as formatted text.",
+				MaxLength:   sendDialogBodyMaxLength,
+			}},
+		},
+	})
+	if appErr != nil {
+		p.API.LogError("Could not open the dialog to send a mail", "err", appErr.Error())
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to open the dialog to send a mail.")
+	}
+	return &model.CommandResponse{}, nil
+}
+
+// parseAddressField parses the comma-separated addresses of a field of the dialog
+func parseAddressField(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := []string{}
+	for _, address := range addresses {
+		recipients = append(recipients, address.String())
+	}
+	return recipients, nil
+}
+
+// sendMailFromDialog sends the mail composed in the dialog. Errors of the fields are returned to be shown in the dialog.
+func (p *Plugin) sendMailFromDialog(request *model.SubmitDialogRequest) (*outgoingMail, map[string]string, error) {
+	submission := func(name string) string {
+		value, _ := request.Submission[name].(string)
+		return strings.TrimSpace(value)
+	}
+
+	composedMail := &outgoingMail{
+		Subject: submission("subject"),
+	}
+	fieldErrors := map[string]string{}
+	for _, field := range []struct {
+		name       string
+		recipients *[]string
+	}{
+		{"to", &composedMail.To},
+		{"cc", &composedMail.Cc},
+		{"bcc", &composedMail.Bcc},
+	} {
+		recipients, err := parseAddressField(submission(field.name))
+		if err != nil {
+			fieldErrors[field.name] = "Invalid email address: " + err.Error()
+			continue
+		}
+		*field.recipients = recipients
+	}
+	if len(fieldErrors) == 0 && len(composedMail.To)+len(composedMail.Cc)+len(composedMail.Bcc) == 0 {
+		fieldErrors["to"] = "Please enter at least one recipient."
+	}
+	if len(fieldErrors) > 0 {
+		return nil, fieldErrors, nil
+	}
+
+	body := submission("body")
+	composedMail.TextBody = body
+	composedMail.HTMLBody = markdown.RenderHTML(body)
+
+	var state sendDialogState
+	if request.State != "" {
+		if err := json.Unmarshal([]byte(request.State), &state); err != nil {
+			return nil, nil, errors.Wrap(err, "Invalid dialog state")
+		}
+	}
+	if state.PostID != "" {
+		post, appErr := p.API.GetPost(state.PostID)
+		if appErr != nil {
+			return nil, nil, errors.Wrap(appErr, "Could not get the post to attach the files of")
+		}
+		// Only the files the user can read are attached
+		if !p.API.HasPermissionToChannel(request.UserId, post.ChannelId, model.PERMISSION_READ_CHANNEL) {
+			return nil, nil, errors.New("You cannot access the files of the post")
+		}
+		attachments, err := p.getPostAttachments(post.FileIds)
+		if err != nil {
+			return nil, nil, err
+		}
+		composedMail.Attachments = attachments
+	}
+
+	gmailID, err := p.getGmailID(request.UserId)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Could not get gmail ID")
+	}
+	gmailService, err := p.getGmailService(request.UserId)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Could not get gmail service")
+	}
+	if _, err = sendMail(gmailService, gmailID, composedMail, ""); err != nil {
+		return nil, nil, err
+	}
+	return composedMail, nil, nil
+}
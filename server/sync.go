@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+// mailPostsTTL is how long the posts of a mail are kept in sync with the mail in Gmail
+const mailPostsTTL = 30 * 24 * time.Hour
+
+// kinds of changes of the mails in Gmail which can be synced to their posts
+const (
+	syncKindRead    = "read"
+	syncKindArchive = "archive"
+	syncKindStar    = "star"
+	syncKindLabels  = "labels"
+	syncKindDelete  = "delete"
+)
+
+// syncKinds lists the kinds of changes in the order they are displayed
+var syncKinds = []string{syncKindRead, syncKindArchive, syncKindStar, syncKindLabels, syncKindDelete}
+
+// mailPosts records the posts of a mail, along with the state of the mail they show
+type mailPosts struct {
+	PostIDs  []string
+	LabelIDs []string
+	Deleted  bool
+}
+
+// syncPreferences holds the kinds of changes the user does not want synced. All kinds are synced by default.
+type syncPreferences struct {
+	Disabled map[string]bool
+}
+
+// isSynced tells if the kind of changes is synced to the posts of the mails
+func (preferences *syncPreferences) isSynced(kind string) bool {
+	return !preferences.Disabled[kind]
+}
+
+// mailPostsKey returns the key of the posts of a mail of the mailbox. Gmail message IDs are 16 hex digits, which
+// keeps the key within the 50 characters allowed even for a channel mailbox.
+func mailPostsKey(ownerID string, messageID string) string {
+	return ownerID + "mp_" + messageID
+}
+
+// getMailPosts returns the posts of a mail of the mailbox, or nil if none is recorded
+func (p *Plugin) getMailPosts(ownerID string, messageID string) (*mailPosts, error) {
+	storedPosts, appErr := p.API.KVGet(mailPostsKey(ownerID, messageID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	if storedPosts == nil {
+		return nil, nil
+	}
+
+	posts := &mailPosts{}
+	if err := json.Unmarshal(storedPosts, posts); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// storeMailPosts stores the posts of a mail of the mailbox, for as long as they are kept in sync
+func (p *Plugin) storeMailPosts(ownerID string, messageID string, posts *mailPosts) error {
+	postsJSON, err := json.Marshal(posts)
+	if err != nil {
+		return err
+	}
+	_, appErr := p.API.KVSetWithOptions(mailPostsKey(ownerID, messageID), postsJSON, model.PluginKVSetOptions{
+		ExpireInSeconds: int64(mailPostsTTL / time.Second),
+	})
+	if appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// recordMailPost records that the post shows the mail, so that the post follows the changes of the mail in Gmail
+func (p *Plugin) recordMailPost(ownerID string, message *gmail.Message, postID string) {
+	posts, err := p.getMailPosts(ownerID, message.Id)
+	if err != nil {
+		p.API.LogError("Could not get the posts of the mail with ID: "+message.Id, "err", err.Error())
+	}
+	if posts == nil {
+		posts = &mailPosts{}
+	}
+	posts.PostIDs = append(posts.PostIDs, postID)
+	posts.LabelIDs = message.LabelIds
+
+	if err = p.storeMailPosts(ownerID, message.Id, posts); err != nil {
+		p.API.LogError("Could not record the post of the mail with ID: "+message.Id, "err", err.Error())
+	}
+}
+
+// getSyncPreferencesOfUser returns the kinds of changes synced to the posts of the mails of the user
+func (p *Plugin) getSyncPreferencesOfUser(userID string) (*syncPreferences, error) {
+	preferences := &syncPreferences{Disabled: map[string]bool{}}
+	storedPreferences, appErr := p.API.KVGet(userID + "syncPreferences")
+	if appErr != nil {
+		return nil, appErr
+	}
+	if storedPreferences == nil {
+		return preferences, nil
+	}
+	if err := json.Unmarshal(storedPreferences, preferences); err != nil {
+		return nil, err
+	}
+	if preferences.Disabled == nil {
+		preferences.Disabled = map[string]bool{}
+	}
+	return preferences, nil
+}
+
+// updateSyncPreferencesOfUser stores the kinds of changes synced to the posts of the mails of the user
+func (p *Plugin) updateSyncPreferencesOfUser(userID string, preferences *syncPreferences) error {
+	preferencesJSON, err := json.Marshal(preferences)
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(userID+"syncPreferences", preferencesJSON); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// syncKindOfLabel returns the kind of changes adding or removing the label is, or an empty string for
+// the labels which are not shown on the posts
+func syncKindOfLabel(labelID string) string {
+	switch {
+	case labelID == "UNREAD":
+		return syncKindRead
+	case labelID == "INBOX":
+		return syncKindArchive
+	case labelID == "STARRED":
+		return syncKindStar
+	case labelID == "TRASH":
+		return syncKindDelete
+	case strings.HasPrefix(labelID, userLabelIDPrefix):
+		return syncKindLabels
+	}
+	return ""
+}
+
+// applySyncedLabels returns the labels shown on the posts of a mail: the current labels of the mail for the kinds
+// of changes which are synced, and the labels shown so far for the others
+func applySyncedLabels(shownLabelIDs []string, currentLabelIDs []string, preferences *syncPreferences) []string {
+	labelIDs := []string{}
+	for _, labelID := range shownLabelIDs {
+		if kind := syncKindOfLabel(labelID); kind != "" && !preferences.isSynced(kind) {
+			labelIDs = append(labelIDs, labelID)
+		}
+	}
+	for _, labelID := range currentLabelIDs {
+		if kind := syncKindOfLabel(labelID); kind == "" || preferences.isSynced(kind) {
+			labelIDs = append(labelIDs, labelID)
+		}
+	}
+	return labelIDs
+}
+
+// mailStateAttachment returns the attachment of the posts of a mail showing its state in Gmail
+func (p *Plugin) mailStateAttachment(ownerID string, messageID string, posts *mailPosts) *model.SlackAttachment {
+	if posts.Deleted {
+		return &model.SlackAttachment{
+			Text: ":wastebasket: ~~Deleted in Gmail~~",
+		}
+	}
+	return p.mailActionsAttachment(ownerID, messageID, posts.LabelIDs)
+}
+
+// updateMailPosts records the new state of the mail and updates its posts, except the one given which is updated by the caller
+func (p *Plugin) updateMailPosts(ownerID string, messageID string, posts *mailPosts, skipPostID string) error {
+	if err := p.storeMailPosts(ownerID, messageID, posts); err != nil {
+		return err
+	}
+
+	attachment := p.mailStateAttachment(ownerID, messageID, posts)
+	if attachment == nil {
+		return nil
+	}
+	for _, postID := range posts.PostIDs {
+		if postID == skipPostID {
+			continue
+		}
+		post, appErr := p.API.GetPost(postID)
+		if appErr != nil {
+			// The post may have been deleted in Mattermost
+			continue
+		}
+		post.SetProps(p.setMailAttachments(post.GetProps(), ownerID, posts.LabelIDs, attachment))
+		if _, appErr = p.API.UpdatePost(post); appErr != nil {
+			p.API.LogError("Could not update the post of the mail with ID: "+messageID, "err", appErr.Error())
+		}
+	}
+	return nil
+}
+
+// syncMailStateForUser updates the posts of the mails of the user changed in the history records after the history ID:
+// mails read, archived, starred, labelled or deleted in Gmail, as far as the user syncs these changes
+func (p *Plugin) syncMailStateForUser(userID string, history []*gmail.History, afterHistoryID uint64) error {
+	// The latest labels of each changed mail, in the order of the changes
+	changedMessageIDs := []string{}
+	currentLabelIDs := map[string][]string{}
+	deleted := map[string]bool{}
+	recordChange := func(message *gmail.Message) {
+		if _, ok := currentLabelIDs[message.Id]; !ok && !deleted[message.Id] {
+			changedMessageIDs = append(changedMessageIDs, message.Id)
+		}
+		currentLabelIDs[message.Id] = message.LabelIds
+	}
+	for _, historyElement := range history {
+		if historyElement.Id <= afterHistoryID {
+			continue
+		}
+		for _, labelAdded := range historyElement.LabelsAdded {
+			recordChange(labelAdded.Message)
+		}
+		for _, labelRemoved := range historyElement.LabelsRemoved {
+			recordChange(labelRemoved.Message)
+		}
+		for _, messageDeleted := range historyElement.MessagesDeleted {
+			recordChange(messageDeleted.Message)
+			deleted[messageDeleted.Message.Id] = true
+		}
+	}
+	if len(changedMessageIDs) == 0 {
+		return nil
+	}
+
+	preferences, err := p.getSyncPreferencesOfUser(userID)
+	if err != nil {
+		return errors.Wrap(err, "Could not get the sync preferences")
+	}
+
+	for _, messageID := range changedMessageIDs {
+		posts, err := p.getMailPosts(userID, messageID)
+		if err != nil {
+			p.API.LogError("Could not get the posts of the mail with ID: "+messageID, "err", err.Error())
+			continue
+		}
+		// The mail was not posted, or too long ago
+		if posts == nil || posts.Deleted {
+			continue
+		}
+
+		if deleted[messageID] {
+			if !preferences.isSynced(syncKindDelete) {
+				continue
+			}
+			posts.Deleted = true
+		} else {
+			posts.LabelIDs = applySyncedLabels(posts.LabelIDs, currentLabelIDs[messageID], preferences)
+		}
+		if err = p.updateMailPosts(userID, messageID, posts, ""); err != nil {
+			p.API.LogError("Could not sync the posts of the mail with ID: "+messageID, "err", err.Error())
+		}
+	}
+	return nil
+}
+
+// handleSyncCommand lists the kinds of changes of the mails in Gmail synced to their posts, or turns one on or off
+func (p *Plugin) handleSyncCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	// `/gmail sync [<kind> <on|off>] [--shared]`
+	text, shared := removeSharedFlag(strings.TrimPrefix(strings.TrimSpace(args.Command), "/"+commandGmail+" sync"))
+	arguments := strings.Fields(text)
+
+	ownerID, errMessage := p.getSubscriptionOwnerID(args, shared, len(arguments) > 0)
+	if errMessage != "" {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, errMessage)
+		return &model.CommandResponse{}, nil
+	}
+
+	preferences, err := p.getSyncPreferencesOfUser(ownerID)
+	if err != nil {
+		p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to get the sync preferences: "+err.Error())
+		return &model.CommandResponse{}, nil
+	}
+
+	if len(arguments) > 0 {
+		kind := strings.ToLower(arguments[0])
+		known := false
+		for _, syncKind := range syncKinds {
+			known = known || syncKind == kind
+		}
+		if !known || len(arguments) != 2 || (arguments[1] != "on" && arguments[1] != "off") {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Please use `/"+commandGmail+" sync <"+strings.Join(syncKinds, "|")+"> <on|off>`.")
+			return &model.CommandResponse{}, nil
+		}
+
+		if arguments[1] == "on" {
+			delete(preferences.Disabled, kind)
+		} else {
+			preferences.Disabled[kind] = true
+		}
+		if err = p.updateSyncPreferencesOfUser(ownerID, preferences); err != nil {
+			p.sendMessageFromBot(args.ChannelId, args.UserId, true, "Unable to save the sync preferences: "+err.Error())
+			return &model.CommandResponse{}, nil
+		}
+	}
+
+	synced := []string{}
+	notSynced := []string{}
+	for _, kind := range syncKinds {
+		if preferences.isSynced(kind) {
+			synced = append(synced, kind)
+		} else {
+			notSynced = append(notSynced, kind)
+		}
+	}
+	message := "Changes made in Gmail are shown on the posts of the mails."
+	if len(synced) > 0 {
+		message += "\n* Synced: " + strings.Join(synced, ", ")
+	}
+	if len(notSynced) > 0 {
+		message += "\n* Not synced: " + strings.Join(notSynced, ", ")
+	}
+	message += "\n\nUse `/" + commandGmail + " sync <kind> <on|off>` to change it."
+	p.sendMessageFromBot(args.ChannelId, args.UserId, true, message)
+	return &model.CommandResponse{}, nil
+}
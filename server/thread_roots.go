@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// threadRootsTTL is how long a Gmail thread keeps being continued in the same Mattermost thread after its last mail
+const threadRootsTTL = 90 * 24 * time.Hour
+
+// threadRootKey returns the key of the root post of a Gmail thread in a channel. Gmail thread IDs are 16 hex digits,
+// which keeps the key within the 50 characters allowed.
+func threadRootKey(channelID string, threadID string) string {
+	return "t_" + channelID + "_" + threadID
+}
+
+// getThreadRootPostID returns the root post created in the channel for the Gmail thread, or an empty string if there is
+// none or if it was deleted
+func (p *Plugin) getThreadRootPostID(channelID string, threadID string) string {
+	if threadID == "" {
+		return ""
+	}
+
+	storedRootID, appErr := p.API.KVGet(threadRootKey(channelID, threadID))
+	if appErr != nil {
+		p.API.LogError("Could not get the root post of the Gmail thread with ID: "+threadID, "err", appErr.Error())
+		return ""
+	}
+	if storedRootID == nil {
+		return ""
+	}
+
+	rootPost, appErr := p.API.GetPost(string(storedRootID))
+	if appErr != nil || rootPost.DeleteAt != 0 || rootPost.ChannelId != channelID {
+		return ""
+	}
+	return rootPost.Id
+}
+
+// storeThreadRootPostID records the root post created in the channel for the Gmail thread, so that its next mails are
+// posted as replies
+func (p *Plugin) storeThreadRootPostID(channelID string, threadID string, rootID string) {
+	if threadID == "" {
+		return
+	}
+
+	_, appErr := p.API.KVSetWithOptions(threadRootKey(channelID, threadID), []byte(rootID), model.PluginKVSetOptions{
+		ExpireInSeconds: int64(threadRootsTTL / time.Second),
+	})
+	if appErr != nil {
+		p.API.LogError("Could not record the root post of the Gmail thread with ID: "+threadID, "err", appErr.Error())
+	}
+}
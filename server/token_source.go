@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// connectionBrokenKeySuffix is appended to the user ID to form the KV key marking a revoked connection
+const connectionBrokenKeySuffix = "gmailBroken"
+
+// persistingTokenSource wraps the OAuth token source of a user so that refreshed tokens
+// are written back to the KV store and revoked grants are detected
+type persistingTokenSource struct {
+	p      *Plugin
+	userID string
+	source oauth2.TokenSource
+
+	// mutex guards accessToken
+	mutex       sync.Mutex
+	accessToken string
+}
+
+// Token returns a valid token, refreshing and persisting it if the previous one expired
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		if isInvalidGrantError(err) {
+			s.p.markConnectionBroken(s.userID)
+		}
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if token.AccessToken != s.accessToken {
+		if storeErr := s.p.storeTokenForUser(s.userID, token); storeErr != nil {
+			s.p.API.LogError("Could not store refreshed token for user with user ID: "+s.userID, "err", storeErr.Error())
+		}
+		s.accessToken = token.AccessToken
+	}
+
+	return token, nil
+}
+
+// isInvalidGrantError reports whether Google refused to refresh the token because the grant was revoked or expired
+func isInvalidGrantError(err error) bool {
+	retrieveErr, ok := errors.Cause(err).(*oauth2.RetrieveError)
+	if !ok {
+		return false
+	}
+	return strings.Contains(string(retrieveErr.Body), "invalid_grant")
+}
+
+// getTokenSource creates a token source for the user which persists refreshed tokens
+func (p *Plugin) getTokenSource(ctx context.Context, userID string) (oauth2.TokenSource, error) {
+	token, err := p.getTokenForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	config := p.getOAuthConfig()
+	return oauth2.ReuseTokenSource(token, &persistingTokenSource{
+		p:           p,
+		userID:      userID,
+		source:      config.TokenSource(ctx, token),
+		accessToken: token.AccessToken,
+	}), nil
+}
+
+// isConnectionBroken reports whether the Gmail grant of the user was found to be revoked
+func (p *Plugin) isConnectionBroken(userID string) bool {
+	broken, err := p.API.KVGet(userID + connectionBrokenKeySuffix)
+	return err == nil && broken != nil
+}
+
+// markConnectionBroken records that the Gmail grant of the user has been revoked and lets the user know, once
+func (p *Plugin) markConnectionBroken(userID string) {
+	marked, appErr := p.API.KVCompareAndSet(userID+connectionBrokenKeySuffix, nil, []byte("true"))
+	if appErr != nil {
+		p.API.LogError("Could not mark the Gmail connection as broken for user with user ID: "+userID, "err", appErr.Error())
+		return
+	}
+
+	// The user has already been notified
+	if !marked {
+		return
+	}
+
+	p.API.LogInfo("Gmail access has been revoked for user with user ID: " + userID)
+
+	siteURL := p.API.GetConfig().ServiceSettings.SiteURL
+	if siteURL == nil {
+		p.CreateBotDMPost(userID, "Your Gmail access has expired or was revoked. Please use `/gmail connect` to reconnect.")
+		return
+	}
+
+	reconnectButton := &model.PostAction{
+		Type: model.POST_ACTION_TYPE_BUTTON,
+		Name: "Reconnect",
+		Integration: &model.PostActionIntegration{
+			URL: fmt.Sprintf("%s/plugins/%s/command/reconnect", *siteURL, manifest.Id),
+		},
+	}
+	if isChannelMailbox(userID) {
+		reconnectButton.Integration.Context = map[string]interface{}{
+			"mailboxChannelId": channelIDOfMailbox(userID),
+		}
+	}
+
+	mailboxChannelID, channelErr := p.getMailboxChannelID(userID)
+	if channelErr != nil {
+		p.API.LogError("Could not fetch direct channel for the user", "err", channelErr.Error())
+		return
+	}
+
+	if _, postErr := p.API.CreatePost(&model.Post{
+		UserId:    p.gmailBotID,
+		ChannelId: mailboxChannelID,
+		Props: map[string]interface{}{
+			"attachments": []*model.SlackAttachment{{
+				Title: "Gmail connection lost",
+				Text: ":warning: Your Gmail access has expired or was revoked, for example because your Google password was changed. " +
+					"You will not receive any notifications until you reconnect.",
+				Actions: []*model.PostAction{reconnectButton},
+			}},
+		},
+	}); postErr != nil {
+		p.API.LogError("Could not notify the user about the broken Gmail connection", "err", postErr.Error())
+	}
+}
+
+// clearConnectionBroken removes the broken connection mark once the user reconnects
+func (p *Plugin) clearConnectionBroken(userID string) {
+	p.API.KVDelete(userID + connectionBrokenKeySuffix)
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net/mail"
 	"strconv"
 	"strings"
+	"time"
 	// "github.com/mattermost/mattermost-server/v5/mlog"
 	"github.com/DusanKasan/parsemail"
 	html2markdown "github.com/JohannesKaufmann/html-to-markdown"
@@ -21,8 +22,11 @@ import (
 	"google.golang.org/api/option"
 )
 
-// CreateBotDMPost creates a post as gmail bot to the user directly
+// CreateBotDMPost creates a post as gmail bot to the user directly, or in the channel of a channel mailbox
 func (p *Plugin) CreateBotDMPost(userID, message string) (string, error) {
+	if isChannelMailbox(userID) {
+		return p.sendMessageFromBot(channelIDOfMailbox(userID), "", false, message)
+	}
 	return p.sendMessageFromBot("", userID, false, message)
 }
 
@@ -69,7 +73,7 @@ func (p *Plugin) sendMessageFromBot(_channelID string, userID string, isEphemera
 }
 
 func (p *Plugin) checkIfConnected(userID string) bool {
-	accessTokenInBytes, err := p.API.KVGet(userID + "gmailToken")
+	accessTokenInBytes, err := p.API.KVGet(userID + tokenKeySuffix)
 	if err != nil || accessTokenInBytes == nil {
 		return false
 	}
@@ -89,24 +93,20 @@ func (p *Plugin) getOAuthConfig() *oauth2.Config {
 		Scopes: []string{
 			emailScope,
 			gmail.MailGoogleComScope,
+			gmail.GmailSendScope,
 		},
 	}
 }
 
 // getGmailService retrieves the token stored in database and then generates a gmail service
 func (p *Plugin) getGmailService(userID string) (*gmail.Service, error) {
-	var token oauth2.Token
-
-	tokenInByte, appErr := p.API.KVGet(userID + "gmailToken")
-	if appErr != nil || tokenInByte == nil {
-		p.API.LogError("Error occured while getting gmail token", "err", appErr)
-		return nil, errors.New(appErr.DetailedError)
+	ctx := context.Background()
+	tokenSource, err := p.getTokenSource(ctx, userID)
+	if err != nil {
+		p.API.LogError("Error occured while getting gmail token", "err", err.Error())
+		return nil, err
 	}
 
-	json.Unmarshal(tokenInByte, &token)
-	config := p.getOAuthConfig()
-	ctx := context.Background()
-	tokenSource := config.TokenSource(ctx, &token)
 	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(tokenSource))
 	if err != nil {
 		return nil, err
@@ -117,16 +117,12 @@ func (p *Plugin) getGmailService(userID string) (*gmail.Service, error) {
 
 // getOAuthService generates OAuth Service
 func (p *Plugin) getOAuthService(userID string) (*accessAPI.Service, error) {
-	var token oauth2.Token
-
-	tokenInByte, appErr := p.API.KVGet(userID + "gmailToken")
-	if appErr != nil {
-		return nil, errors.New(appErr.DetailedError)
-	}
-	json.Unmarshal(tokenInByte, &token)
 	ctx := context.Background()
-	config := p.getOAuthConfig()
-	tokenSource := config.TokenSource(ctx, &token)
+	tokenSource, err := p.getTokenSource(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
 	oauth2Service, err := accessAPI.NewService(ctx, option.WithTokenSource(tokenSource))
 	if err != nil {
 		return nil, err
@@ -165,6 +161,12 @@ func (p *Plugin) addUserForGmail(gmailID string, userID string) error {
 	if userIDs == nil {
 		userIDs = []string{}
 	}
+	for _, existingUserID := range userIDs {
+		// The user is reconnecting the same Gmail ID
+		if existingUserID == userID {
+			return nil
+		}
+	}
 	userIDs = append(userIDs, userID)
 
 	p.API.KVSet(gmailID+"users", []byte(strings.Join(userIDs, ",")))
@@ -199,13 +201,19 @@ func (p *Plugin) removeUserForGmail(gmailID string, userID string) error {
 }
 
 // onboardUser onboards user to the plugin when connected to a Gmail account
-func (p *Plugin) onboardUser(userID string, tokenJSON []byte) error {
+func (p *Plugin) onboardUser(userID string, token *oauth2.Token) error {
 
-	err := p.API.KVSet(userID+"gmailToken", tokenJSON)
-	if err != nil {
-		p.API.LogError("Error in setting gmail token", "err", err.Error())
-		return err
+	tokenErr := p.storeTokenForUser(userID, token)
+	if tokenErr != nil {
+		p.API.LogError("Error in setting gmail token", "err", tokenErr.Error())
+		return tokenErr
 	}
+	p.clearConnectionBroken(userID)
+
+	// The user may be reconnecting after the access was revoked, possibly with a different Gmail ID
+	previousGmailID, _ := p.API.KVGet(userID + "gmailID")
+	p.API.KVDelete(userID + "gmailID")
+	p.API.KVDelete(userID + "labels")
 
 	gmailID, gmailErr := p.getGmailID(userID)
 	if gmailErr != nil {
@@ -213,19 +221,23 @@ func (p *Plugin) onboardUser(userID string, tokenJSON []byte) error {
 		return gmailErr
 	}
 
-	err = p.API.KVSet(userID+"gmailID", []byte(gmailID))
+	err := p.API.KVSet(userID+"gmailID", []byte(gmailID))
 	if err != nil {
 		p.API.LogError("Error in setting gmail ID as "+gmailID+" for the user with user ID: "+userID, "err", err.Error())
 		return err
 	}
 
+	if previousGmailID != nil && string(previousGmailID) != gmailID {
+		p.removeUserForGmail(string(previousGmailID), userID)
+	}
+
 	gmailErr = p.addUserForGmail(gmailID, userID)
 	if gmailErr != nil {
 		p.API.LogError("Error in adding user with user ID: "+userID+" to list of users connected to gmail ID: "+gmailID, "err", gmailErr.Error())
 		return gmailErr
 	}
 
-	labelErr := p.subscribeToLabels(userID, gmailID, p.getSupportedLabels())
+	labelErr := p.subscribeToLabels(userID, gmailID, p.getDefaultLabels())
 	if labelErr != nil {
 		p.API.LogError("Error in subscribing user with user ID: "+userID+" to all supported labels", "err", labelErr.Error())
 		return labelErr
@@ -249,13 +261,75 @@ func (p *Plugin) offboardUser(userID string) error {
 
 	p.API.KVDelete(userID + "gmailID")
 
-	p.API.KVDelete(userID + "gmailToken")
+	p.API.KVDelete(userID + "watchState")
+
+	p.API.KVDelete(userID + "historyID")
+
+	p.API.KVDelete(userID + "deliveryLedger")
+
+	p.API.KVDelete(userID + "lastMessageTime")
+
+	p.API.KVDelete(userID + "labels")
+
+	p.API.KVDelete(userID + "querySubscriptions")
+
+	p.API.KVDelete(userID + "subscriptionRoutes")
+
+	p.API.KVDelete(userID + "channelMailbox")
+
+	p.API.KVDelete(userID + "syncPreferences")
+
+	p.API.KVDelete(userID + "followedThreads")
+
+	p.API.KVDelete(userID + tokenKeySuffix)
+
+	p.clearConnectionBroken(userID)
+
+	// The posts of the mails are no longer kept in sync with Gmail, and the mails of a shared mailbox connected
+	// again start new threads in its channel
+	prefixes := []string{mailPostsKey(userID, "")}
+	if isChannelMailbox(userID) {
+		prefixes = append(prefixes, threadRootKey(channelIDOfMailbox(userID), ""))
+	}
+	if err = p.deleteKeysWithPrefixes(prefixes); err != nil {
+		p.API.LogError("Could not delete the posts of the mails of user with userID: "+userID, "err", err.Error())
+	}
 
 	p.API.LogInfo("Offboarding successfully completed for the user")
 
 	return nil
 }
 
+// deleteKeysWithPrefixes deletes the keys of the KV store starting with any of the prefixes
+func (p *Plugin) deleteKeysWithPrefixes(prefixes []string) error {
+	// Keys are listed first, as deleting them while listing would shift the pages
+	keysToDelete := []string{}
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, keysPerPage)
+		if appErr != nil {
+			return appErr
+		}
+		for _, key := range keys {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					keysToDelete = append(keysToDelete, key)
+					break
+				}
+			}
+		}
+		if len(keys) < keysPerPage {
+			break
+		}
+	}
+
+	for _, key := range keysToDelete {
+		if appErr := p.API.KVDelete(key); appErr != nil {
+			return appErr
+		}
+	}
+	return nil
+}
+
 // getUsersForGmail returns array of user IDs connected with the given Gmail ID
 func (p *Plugin) getUsersForGmail(gmailID string) ([]string, error) {
 	users, err := p.API.KVGet(gmailID + "users")
@@ -276,7 +350,13 @@ func (p *Plugin) updateSubscriptionsOfUser(userID string, labelIDs []string) *mo
 // getSubscriptionsOfUser returns subscriptions of the user
 func (p *Plugin) getSubscriptionsOfUser(userID string) ([]string, error) {
 	subscriptions, err := p.API.KVGet(userID + "subscriptions")
-	return strings.Split(string(subscriptions), ","), err
+	if err != nil {
+		return []string{}, err
+	}
+	if len(subscriptions) == 0 {
+		return []string{}, nil
+	}
+	return strings.Split(string(subscriptions), ","), nil
 }
 
 // removeAllSubscriptionsOfUser
@@ -285,52 +365,50 @@ func (p *Plugin) removeAllSubscriptionsOfUser(userID string) error {
 }
 
 // updateHistoryIDForGmail updates historyID of the user
-func (p *Plugin) updateHistoryIDForUser(historyID uint64, userID string) *model.AppError {
-	return p.API.KVSet(userID+"historyID", []byte(strconv.Itoa(int(historyID))))
+func (p *Plugin) updateHistoryIDForUser(historyID uint64, userID string) error {
+	return p.updateDeliveryLedger(userID, func(ledger *deliveryLedger) bool {
+		ledger.HistoryID = historyID
+		return true
+	})
 }
 
 // getHistoryIDForGmail returns history ID of the user
 func (p *Plugin) getHistoryIDForUser(userID string) (uint64, error) {
-	historyID, err := p.API.KVGet(userID + "historyID")
-	if err == nil {
-		histID, err := strconv.Atoi(string(historyID))
-		return uint64(histID), err
+	ledger, _, err := p.getDeliveryLedger(userID)
+	if err != nil {
+		return uint64(0), err
 	}
-	return uint64(0), err
+	if ledger.HistoryID == 0 {
+		return uint64(0), errors.New("History ID not found")
+	}
+	return ledger.HistoryID, nil
 }
 
-// getThreadID generates ID of thread from rfcID of the mail in the thread
-func (p *Plugin) getThreadID(userID string, gmailID string, rfcID string) (string, error) {
-	gmailService, err := p.getGmailService(userID)
+// advanceLastMessageTimeForUser stores the receive time (ms) of the latest message processed for the user
+func (p *Plugin) advanceLastMessageTimeForUser(userID string, lastMessageTime int64) error {
+	storedTime, err := p.getLastMessageTimeForUser(userID)
 	if err != nil {
-		return "", err
+		return err
 	}
-	listCall := gmailService.Users.Messages.List(gmailID).Q("rfc822msgid:" + rfcID)
-	listResponse, err := listCall.Do()
-	if err != nil {
-		return "", err
+	if lastMessageTime <= storedTime {
+		return nil
 	}
-	if len(listResponse.Messages) != 1 {
-		return "", errors.New("Invalid ID. Please provide ID of some mail in the thread")
+	if appErr := p.API.KVSet(userID+"lastMessageTime", []byte(strconv.FormatInt(lastMessageTime, 10))); appErr != nil {
+		return appErr
 	}
-	return listResponse.Messages[0].ThreadId, nil
+	return nil
 }
 
-// getMessageID generates ID of mail/message from rfcID of the mail/message
-func (p *Plugin) getMessageID(userID string, gmailID string, rfcID string) (string, error) {
-	gmailService, err := p.getGmailService(userID)
-	if err != nil {
-		return "", err
-	}
-	listCall := gmailService.Users.Messages.List(gmailID).Q("rfc822msgid:" + rfcID)
-	listResponse, err := listCall.Do()
-	if err != nil {
-		return "", err
+// getLastMessageTimeForUser returns the receive time (ms) of the latest message processed for the user
+func (p *Plugin) getLastMessageTimeForUser(userID string) (int64, error) {
+	lastMessageTime, appErr := p.API.KVGet(userID + "lastMessageTime")
+	if appErr != nil {
+		return 0, appErr
 	}
-	if len(listResponse.Messages) != 1 {
-		return "", errors.New("Invalid ID. Please provide a valid mail ID")
+	if lastMessageTime == nil {
+		return 0, nil
 	}
-	return listResponse.Messages[0].Id, nil
+	return strconv.ParseInt(string(lastMessageTime), 10, 64)
 }
 
 func (p *Plugin) decodeBase64URL(urlInBase64 string) (string, error) {
@@ -357,7 +435,19 @@ func (p *Plugin) decodeBase64URL(urlInBase64 string) (string, error) {
 	return string(decoded), nil
 }
 
-func (p *Plugin) parseMessage(message string) (string, string, string, string, string, []parsemail.Attachment, error) {
+// parsedMail is a mail parsed from its raw form
+type parsedMail struct {
+	Subject     string
+	Body        string
+	Date        time.Time
+	From        []*mail.Address
+	To          []*mail.Address
+	Cc          []*mail.Address
+	MessageID   string
+	Attachments []parsemail.Attachment
+}
+
+func (p *Plugin) parseMessage(message string) (*parsedMail, error) {
 	// Use parser for email
 	reader := strings.NewReader(message)
 
@@ -365,38 +455,31 @@ func (p *Plugin) parseMessage(message string) (string, string, string, string, s
 	if err != nil {
 		// return details from self parsed message
 		p.API.LogError("Error in using parsemail package", "err", err.Error())
-		return "", "", "", "", "", nil, err
-	}
-	year, month, day := email.Date.Date()
-	date := fmt.Sprintf("%v %v, %v", month, day, year)
-
-	emailFrom := email.From
-	fromNames := ""
-	totalNames := len(emailFrom)
-	for fromIndex, fromDetails := range emailFrom {
-		if fromDetails.Name != "" {
-			fromNames += fromDetails.Name + " "
-			if fromIndex != (totalNames - 1) {
-				fromNames += ","
-			}
-		}
+		return nil, err
 	}
-	attachments := []parsemail.Attachment{}
-	// Attachments
-	for _, attachment := range email.Attachments {
-		attachments = append(attachments, attachment)
+
+	parsed := &parsedMail{
+		Subject:     email.Subject,
+		Body:        email.TextBody,
+		Date:        email.Date,
+		From:        email.From,
+		To:          email.To,
+		Cc:          email.Cc,
+		MessageID:   email.MessageID,
+		Attachments: email.Attachments,
 	}
 
 	// Prefer HTML if available
 	if email.HTMLBody != "" {
 		mailBody, html2mdErr := html2markdown.NewConverter("", true, nil).ConvertString(email.HTMLBody)
 		if html2mdErr == nil {
-			return email.Subject, mailBody, date, fromNames, email.MessageID, attachments, nil
+			parsed.Body = mailBody
+			return parsed, nil
 		}
 		p.API.LogError("Error in converting html to markdown", "err", html2mdErr.Error())
 	}
 
-	return email.Subject, email.TextBody, date, fromNames, email.MessageID, attachments, nil
+	return parsed, nil
 }
 
 func (p *Plugin) getAttachmentDetails(attachment parsemail.Attachment) (string, []byte) {
@@ -409,8 +492,17 @@ func (p *Plugin) getAttachmentDetails(attachment parsemail.Attachment) (string,
 }
 
 func (p *Plugin) handleMessages(messages []*gmail.Message, channelID string, userID string, notify bool) error {
+	_, _, err := p.postMessages(messages, channelID, userID, notify, "")
+	return err
+}
+
+// postMessages posts the messages to the channel, as replies to the root post if given, or else in a new thread.
+// It returns the root post of the thread of the messages, and the IDs of the messages posted, also when an error
+// stops it partway. A message counts as posted once its post is created, even if its files could not be posted.
+func (p *Plugin) postMessages(messages []*gmail.Message, channelID string, userID string, notify bool, rootID string) (string, []string, error) {
+	postedIDs := []string{}
 	if len(messages) == 0 {
-		return errors.New("No message found")
+		return "", postedIDs, errors.New("No message found")
 	}
 
 	postAsID := userID
@@ -418,70 +510,99 @@ func (p *Plugin) handleMessages(messages []*gmail.Message, channelID string, use
 		postAsID = p.gmailBotID
 	}
 
-	parentID := ""
-	rootID := ""
-	for messageIndex, message := range messages {
+	gmailID, err := p.getGmailID(userID)
+	if err != nil {
+		return rootID, postedIDs, err
+	}
+
+	parentID := rootID
+	for _, message := range messages {
 		base64URLMessage := message.Raw
 		plainTextMessage, err := p.decodeBase64URL(base64URLMessage)
 		if err != nil {
 			p.API.LogError("Error occured in decoding base64 URL message", "err", err.Error())
-			return err
+			return rootID, postedIDs, err
 		}
 
 		// Extract Subject and Body (base64url) from the message.
-		subject, body, date, from, rfcID, attachments, err := p.parseMessage(plainTextMessage)
-		sharingInfo := ""
-		if notify {
-			sharingInfo = "**Message ID: <" + rfcID + ">**. _(Import in any channel using `/gmail import <mail/thread> <ID>`)_\n\n"
-		}
+		email, err := p.parseMessage(plainTextMessage)
 		if err != nil {
 			p.API.LogError("An error has occured while trying to parse the mail", "err", err.Error())
-			return err
+			return rootID, postedIDs, err
 		}
-		if from == "" {
-			from = "_Could not fetch names_"
-		}
-
 		fileIDArray := []string{}
 		fileNameArray := []string{}
-		for _, attachment := range attachments {
+		for _, attachment := range email.Attachments {
 			fileName, fileData := p.getAttachmentDetails(attachment)
 			fileInfo, fileErr := p.API.UploadFile(fileData, channelID, fileName)
 			if fileErr != nil {
-				p.API.LogError("Attachment "+fileName+" could not be uploaded", "err", err.Error())
+				p.API.LogError("Attachment "+fileName+" could not be uploaded", "err", fileErr.Error())
+				continue
 			}
 			fileNameArray = append(fileNameArray, fileName)
 			fileIDArray = append(fileIDArray, fileInfo.Id)
 		}
-		// Prepare post for posting as a response
+		// Prepare post for posting as a response, with the card of the mail and, when notified, the buttons triaging it
+		props := mailCardProps(mailPostProps(message, email.MessageID, userID), email, gmailID, message.ThreadId)
+		var state *model.SlackAttachment
+		if notify {
+			state = p.mailActionsAttachment(userID, message.Id, message.LabelIds)
+		}
+		props = p.setMailAttachments(props, userID, message.LabelIds, state)
 
-		if messageIndex == 0 {
+		// A notified mail continues the Mattermost thread of the earlier mails of its Gmail thread in the channel,
+		// or starts a new one. Imported mails all go in a new thread.
+		if notify {
+			rootID = p.getThreadRootPostID(channelID, message.ThreadId)
+			parentID = rootID
+		}
+
+		if rootID == "" {
 			rootPost := &model.Post{
 				UserId:    postAsID,
 				ChannelId: channelID,
-				Message:   "###### Email from : " + from + "\n\n" + sharingInfo + "**Date: " + date + "** \n\n" + "**Subject: " + subject + "**\n\n" + body,
+				Message:   email.Body,
+				Props:     props,
+			}
+			rootPost, appErr := p.API.CreatePost(rootPost)
+			if appErr != nil {
+				p.API.LogError("Could not create post", "err", appErr.Error())
+				return rootID, postedIDs, appErr
 			}
-			rootPost, _ = p.API.CreatePost(rootPost)
 			rootID = rootPost.Id
 			parentID = rootID
+			if notify {
+				p.recordMailPost(userID, message, rootID)
+				p.storeThreadRootPostID(channelID, message.ThreadId, rootID)
+			}
 		} else {
-			// Can assume that rootID is not ""
 			post := &model.Post{
 				UserId:    postAsID,
 				ChannelId: channelID,
 				RootId:    rootID,
 				ParentId:  parentID,
-				Message:   "###### Email from: " + from + "\n\n" + sharingInfo + "**Date: " + date + "** \n\n" + "**Subject: " + subject + "**\n\n" + body,
+				Message:   email.Body,
+				Props:     props,
+			}
+			postInfo, appErr := p.API.CreatePost(post)
+			if appErr != nil {
+				p.API.LogError("Could not create post", "err", appErr.Error())
+				return rootID, postedIDs, appErr
 			}
-			postInfo, _ := p.API.CreatePost(post)
 			parentID = postInfo.Id
+			if notify {
+				p.recordMailPost(userID, message, parentID)
+				// Keep the thread going for its next mails
+				p.storeThreadRootPostID(channelID, message.ThreadId, rootID)
+			}
 		}
+		postedIDs = append(postedIDs, message.Id)
 
 		// Post attachments
 		if len(fileIDArray) > 0 {
 			countFiles := 0
 			// One Post can contain atmost 5 attachments
-			for countFiles = 0; countFiles <= len(fileIDArray); countFiles += 5 {
+			for countFiles = 0; countFiles < len(fileIDArray); countFiles += 5 {
 				post := &model.Post{
 					UserId:    postAsID,
 					ChannelId: channelID,
@@ -489,65 +610,100 @@ func (p *Plugin) handleMessages(messages []*gmail.Message, channelID string, use
 					ParentId:  parentID,
 					FileIds:   fileIDArray[countFiles:int(math.Min(float64(countFiles+5), float64(len(fileIDArray))))],
 				}
-				postInfo, err := p.API.CreatePost(post)
-				parentID = postInfo.Id
-				if err != nil {
-					p.API.LogError("Could not create post", "err", err.Error())
-					return err
+				postInfo, appErr := p.API.CreatePost(post)
+				if appErr != nil {
+					p.API.LogError("Could not create post", "err", appErr.Error())
+					return rootID, postedIDs, appErr
 				}
+				parentID = postInfo.Id
 			}
 		}
 	}
-	return nil
+	return rootID, postedIDs, nil
 }
 
 // subscribeToLabels
 func (p *Plugin) subscribeToLabels(userID string, gmailID string, labelIDs []string) error {
-	gmailService, _ := p.getGmailService(userID)
-	watchRequest := &gmail.WatchRequest{
-		LabelFilterAction: "include",
-		LabelIds:          labelIDs,
-		TopicName:         p.getConfiguration().TopicName,
+	// No watch is needed when the history of the mailboxes is polled
+	if p.getConfiguration().getDeliveryMode() == deliveryModePoll {
+		gmailService, err := p.getGmailService(userID)
+		if err != nil {
+			return err
+		}
+		profile, err := gmailService.Users.GetProfile(gmailID).Do()
+		if err != nil {
+			p.API.LogError("Could not get the current history ID of the user", "err", err.Error())
+			return err
+		}
+		p.updateHistoryIDForUser(profile.HistoryId, userID)
+		p.updateSubscriptionsOfUser(userID, labelIDs)
+		return nil
 	}
-	watchResponse, err := gmailService.Users.Watch(gmailID, watchRequest).Do()
+
+	p.updateSubscriptionsOfUser(userID, labelIDs)
+	watchResponse, err := p.watchMailbox(userID, gmailID, p.getWatchedLabelsOfMailbox(gmailID))
 	if err != nil {
-		p.API.LogError("Could not subscribe user to the supported labels", "err", err.Error())
+		p.API.LogError("Could not subscribe user to the default labels", "err", err.Error())
 		return err
 	}
 	p.updateHistoryIDForUser(uint64(watchResponse.HistoryId), userID)
-	p.updateSubscriptionsOfUser(userID, labelIDs)
 	return nil
 }
 
-// getRelevantMessagesForUser filters messages that have a label the user is subscribed to
-func (p *Plugin) getRelevantMessagesForUser(userID string, messages []*gmail.Message) []*gmail.Message {
+// getRelevantMessagesForUser filters messages that have a label the user is subscribed to, or match a query subscription.
+// It also returns the route keys of the subscriptions matched by each relevant message, by message ID.
+func (p *Plugin) getRelevantMessagesForUser(userID string, messages []*gmail.Message) ([]*gmail.Message, map[string][]string, error) {
 	subscriptions, _ := p.getSubscriptionsOfUser(userID)
-	relevantMessages := []*gmail.Message{}
-	// TODO: OPTIMIZATION
-	messageAdded := false
+	matchedSubscriptions := map[string][]string{}
 	for _, message := range messages {
-		messageAdded = false
 		for _, subscription := range subscriptions {
 			for _, messageLabel := range message.LabelIds {
 				if messageLabel == subscription {
-					relevantMessages = append(relevantMessages, message)
-					messageAdded = true
+					matchedSubscriptions[message.Id] = append(matchedSubscriptions[message.Id], labelRouteKey(subscription))
 					break
 				}
 			}
-			if messageAdded {
-				break
-			}
 		}
 	}
-	return relevantMessages
+
+	// Queries are checked for all messages, as they may be delivered to other channels than the labels
+	matchedQueries, err := p.matchQuerySubscriptionsOfUser(userID, messages)
+	if err != nil {
+		return nil, nil, err
+	}
+	for messageID, queryNames := range matchedQueries {
+		for _, queryName := range queryNames {
+			matchedSubscriptions[messageID] = append(matchedSubscriptions[messageID], queryRouteKey(queryName))
+		}
+	}
+
+	relevantMessages := []*gmail.Message{}
+	for _, message := range messages {
+		if len(matchedSubscriptions[message.Id]) > 0 {
+			relevantMessages = append(relevantMessages, message)
+		}
+	}
+	return relevantMessages, matchedSubscriptions, nil
 }
 
-// getSupportedLabels
-func (p *Plugin) getSupportedLabels() []string {
+// getDefaultLabels
+func (p *Plugin) getDefaultLabels() []string {
 	labels := []string{}
-	for label := range supportedLabelIDs {
+	for label := range defaultLabelIDs {
 		labels = append(labels, label)
 	}
 	return labels
 }
+
+// getUserLocation returns the time zone set by the user in Mattermost, UTC if none can be found
+func (p *Plugin) getUserLocation(userID string) *time.Location {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(model.GetPreferredTimezone(user.Timezone))
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
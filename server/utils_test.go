@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffboardUser(t *testing.T) {
+	const (
+		userID       = "abcdefghijklmnopqrstuvwxyz"
+		otherUserID  = "zyxwvutsrqponmlkjihgfedcba"
+		channelID    = "channelchannelchannelchann"
+		otherChannel = "otherchannelotherchannelot"
+		threadID     = "17da1e9dae1dc6d9"
+	)
+
+	for name, test := range map[string]struct {
+		ownerID string
+		// expectKept are the keys left, besides those of the other mailbox and channel
+		expectKept []string
+	}{
+		"personal mailbox": {
+			ownerID: userID,
+			// The thread roots of the channel may be shared with the other mailboxes delivering to it
+			expectKept: []string{threadRootKey(channelID, threadID)},
+		},
+		"shared mailbox": {
+			ownerID: channelMailboxOwnerID(channelID),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			store := mockKVStore(api)
+			mockLogs(api)
+
+			p := &Plugin{}
+			p.SetAPI(api)
+
+			ownerKeys := []string{
+				test.ownerID + "gmailID",
+				test.ownerID + tokenKeySuffix,
+				test.ownerID + "deliveryLedger",
+				test.ownerID + "channelMailbox",
+				mailPostsKey(test.ownerID, "18c2f1a6b3e4d5f6"),
+				mailPostsKey(test.ownerID, "18c2f1a6b3e4d5f7"),
+				threadRootKey(channelID, threadID),
+			}
+			otherKeys := []string{
+				otherUserID + tokenKeySuffix,
+				mailPostsKey(otherUserID, "18c2f1a6b3e4d5f6"),
+				mailPostsKey(channelMailboxOwnerID(otherChannel), "18c2f1a6b3e4d5f6"),
+				threadRootKey(otherChannel, threadID),
+				"me@example.comusers",
+			}
+			for _, key := range append(ownerKeys, otherKeys...) {
+				store.set(key, []byte("value"))
+			}
+			store.set(test.ownerID+"gmailID", []byte("me@example.com"))
+			store.set("me@example.comusers", []byte(test.ownerID+","+otherUserID))
+
+			require.NoError(t, p.offboardUser(test.ownerID))
+
+			keys := []string{}
+			for key := range store.values {
+				keys = append(keys, key)
+			}
+			expectKeys := append(otherKeys, test.expectKept...)
+			sort.Strings(keys)
+			sort.Strings(expectKeys)
+			assert.Equal(t, expectKeys, keys)
+			assert.Equal(t, otherUserID, string(store.get("me@example.comusers")))
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// watchRenewalInterval is how often the watches of all the users are checked for renewal
+	watchRenewalInterval = time.Hour
+
+	// watchRenewBefore is how long before its expiry a watch is renewed
+	watchRenewBefore = 24 * time.Hour
+
+	// watchRetryBaseDelay is the delay before retrying a failed renewal, doubled on every failure
+	watchRetryBaseDelay = 5 * time.Minute
+
+	// watchRetryMaxDelay caps the delay between retries of a failed renewal
+	watchRetryMaxDelay = 6 * time.Hour
+
+	// watchMaxFailures is the number of failed renewals after which the user is notified
+	watchMaxFailures = 5
+
+	// watchLockExpiry frees the lock of a renewal whose server stopped while renewing the watch
+	watchLockExpiry = 5 * time.Minute
+)
+
+// watchState captures the Gmail watch registered for a user and the state of its renewal
+type watchState struct {
+	// Expiration of the watch in milliseconds since epoch
+	Expiration int64
+	// Failures counts the consecutive failed renewals
+	Failures int
+	// NextAttempt is when the renewal may be retried, in milliseconds since epoch
+	NextAttempt int64
+}
+
+// getWatchStateForUser returns the state of the Gmail watch of the user
+func (p *Plugin) getWatchStateForUser(userID string) (*watchState, error) {
+	state := &watchState{}
+	stateJSON, appErr := p.API.KVGet(userID + "watchState")
+	if appErr != nil {
+		return nil, appErr
+	}
+	if stateJSON == nil {
+		return state, nil
+	}
+	if err := json.Unmarshal(stateJSON, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// updateWatchStateForUser stores the state of the Gmail watch of the user
+func (p *Plugin) updateWatchStateForUser(userID string, state *watchState) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(userID+"watchState", stateJSON); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// watchMailbox registers a Gmail watch on the labels for the user and stores its expiration
+func (p *Plugin) watchMailbox(userID string, gmailID string, labelIDs []string) (*gmail.WatchResponse, error) {
+	gmailService, err := p.getGmailService(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	watchRequest := &gmail.WatchRequest{
+		LabelFilterAction: "include",
+		LabelIds:          labelIDs,
+		TopicName:         p.getConfiguration().TopicName,
+	}
+	watchResponse, err := gmailService.Users.Watch(gmailID, watchRequest).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	if stateErr := p.updateWatchStateForUser(userID, &watchState{Expiration: watchResponse.Expiration}); stateErr != nil {
+		p.API.LogError("Could not store watch expiration for user with user ID: "+userID, "err", stateErr.Error())
+	}
+	return watchResponse, nil
+}
+
+// renewWatchForUser registers the Gmail watch of the user again, keeping the subscriptions and the history ID
+func (p *Plugin) renewWatchForUser(userID string) error {
+	gmailID, err := p.getGmailID(userID)
+	if err != nil {
+		return errors.Wrap(err, "Could not get gmail ID")
+	}
+
+	_, err = p.watchMailbox(userID, gmailID, p.getWatchedLabelsOfMailbox(gmailID))
+	return err
+}
+
+// getWatchedLabelsOfMailbox returns the labels subscribed to by any of the users connected to the mailbox.
+// A mailbox has a single watch, so it must cover the subscriptions of all its users. No label is returned,
+// which watches the whole mailbox, if a user has a query subscription as it can match messages of any label.
+func (p *Plugin) getWatchedLabelsOfMailbox(gmailID string) []string {
+	userIDs, err := p.getUsersForGmail(gmailID)
+	if err != nil {
+		p.API.LogError("Could not get the users connected to gmail ID: "+gmailID, "err", err.Error())
+	}
+
+	labelIDs := []string{}
+	watched := map[string]bool{}
+	for _, userID := range userIDs {
+		if querySubscriptions, _ := p.getQuerySubscriptionsOfUser(userID); len(querySubscriptions) > 0 {
+			return []string{}
+		}
+		subscriptions, _ := p.getSubscriptionsOfUser(userID)
+		for _, labelID := range subscriptions {
+			if !watched[labelID] {
+				watched[labelID] = true
+				labelIDs = append(labelIDs, labelID)
+			}
+		}
+	}
+	return labelIDs
+}
+
+// applySubscriptionsOfUser registers the Gmail watch again so that changed subscriptions take effect immediately
+func (p *Plugin) applySubscriptionsOfUser(userID string) {
+	// The polled history is not filtered by Gmail
+	if p.getConfiguration().getDeliveryMode() == deliveryModePoll {
+		return
+	}
+
+	if err := p.renewWatchForUser(userID); err != nil {
+		p.API.LogError("Could not update the Gmail watch of user with user ID: "+userID, "err", err.Error())
+	}
+}
+
+// startWatchRenewal starts the background job renewing the Gmail watches before they expire
+func (p *Plugin) startWatchRenewal() {
+	p.watchRenewalStop = make(chan struct{})
+	p.watchRenewalDone = make(chan struct{})
+
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(watchRenewalInterval)
+		defer ticker.Stop()
+
+		for {
+			p.renewExpiringWatches(stop)
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(p.watchRenewalStop, p.watchRenewalDone)
+}
+
+// stopWatchRenewal stops the background job renewing the Gmail watches and waits for it to finish
+func (p *Plugin) stopWatchRenewal() {
+	if p.watchRenewalStop == nil {
+		return
+	}
+	close(p.watchRenewalStop)
+	<-p.watchRenewalDone
+	p.watchRenewalStop = nil
+}
+
+// renewExpiringWatches renews the watches of all the users that are about to expire
+func (p *Plugin) renewExpiringWatches(stop <-chan struct{}) {
+	userIDs, err := p.getConnectedUserIDs()
+	if err != nil {
+		p.API.LogError("Could not list connected users for watch renewal", "err", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, userID := range userIDs {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if p.isConnectionBroken(userID) {
+			continue
+		}
+
+		p.renewExpiringWatchForUser(userID, now)
+	}
+}
+
+// renewExpiringWatchForUser renews the watch of the user if it is about to expire, unless another server of the
+// cluster is renewing it
+func (p *Plugin) renewExpiringWatchForUser(userID string, now time.Time) {
+	unlock, err := p.tryLock("watch_"+userID, watchLockExpiry)
+	if err != nil {
+		p.API.LogError("Could not lock the watch renewal for user with user ID: "+userID, "err", err.Error())
+		return
+	}
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	// Read under the lock, as another server may just have renewed the watch
+	state, err := p.getWatchStateForUser(userID)
+	if err != nil {
+		p.API.LogError("Could not get watch state for user with user ID: "+userID, "err", err.Error())
+		return
+	}
+
+	// Watches registered by earlier versions of the plugin have no expiration stored and are renewed right away
+	expiresAt := time.Unix(0, state.Expiration*int64(time.Millisecond))
+	if expiresAt.Sub(now) > watchRenewBefore {
+		return
+	}
+	if now.Before(time.Unix(0, state.NextAttempt*int64(time.Millisecond))) {
+		return
+	}
+
+	p.API.LogInfo("Renewing Gmail watch for user with user ID: " + userID)
+	renewErr := p.renewWatchForUser(userID)
+	if renewErr == nil {
+		return
+	}
+
+	p.API.LogError("Could not renew Gmail watch for user with user ID: "+userID, "err", renewErr.Error())
+	state.Failures++
+	delay := watchRetryBaseDelay << uint(state.Failures-1)
+	if delay > watchRetryMaxDelay || delay <= 0 {
+		delay = watchRetryMaxDelay
+	}
+	state.NextAttempt = model.GetMillisForTime(now.Add(delay))
+	if stateErr := p.updateWatchStateForUser(userID, state); stateErr != nil {
+		p.API.LogError("Could not store watch state for user with user ID: "+userID, "err", stateErr.Error())
+	}
+
+	if state.Failures == watchMaxFailures {
+		p.notifyWatchRenewalFailure(userID)
+	}
+}
+
+// notifyWatchRenewalFailure warns the owner of the mailbox, in the channel of the mailbox, that its watch could not be renewed
+func (p *Plugin) notifyWatchRenewalFailure(ownerID string) {
+	mailboxChannelID, err := p.getMailboxChannelID(ownerID)
+	if err != nil {
+		p.API.LogError("Could not fetch the channel of the mailbox to warn about the watch renewal", "err", err.Error())
+		return
+	}
+
+	reconnect := "Please try `/gmail disconnect` and `/gmail connect` to connect again."
+	if isChannelMailbox(ownerID) {
+		reconnect = "A channel admin can use `/gmail disconnect --channel` and `/gmail connect --channel` to connect it again."
+	}
+	if _, err = p.sendMessageFromBot(mailboxChannelID, "", false, ":warning: The Gmail notifications could not be renewed and will stop arriving soon. "+reconnect); err != nil {
+		p.API.LogError("Could not warn about the watch renewal", "err", err.Error())
+	}
+}
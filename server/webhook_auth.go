@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/dvsekhvalnov/jose2go"
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultPushAuthJWKSURL is where Google publishes the keys used to sign Pub/Sub push tokens
+	defaultPushAuthJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+	// keySetCacheDuration is how long a fetched key set is used before fetching it again
+	keySetCacheDuration = time.Hour
+
+	// pushMessageMaxAge is the age after which a push message is considered stale and ignored
+	pushMessageMaxAge = 30 * time.Minute
+
+	// tokenClockSkew is the leeway allowed while checking the expiry of push tokens
+	tokenClockSkew = time.Minute
+
+	// pushMessageKeyPrefix is prepended to the Pub/Sub message ID to record messages already received
+	pushMessageKeyPrefix = "pubsubMessage_"
+)
+
+// googleIssuers are the accepted issuers of the push tokens
+var googleIssuers = map[string]bool{
+	"accounts.google.com":         true,
+	"https://accounts.google.com": true,
+}
+
+// keySource provides the public keys used to verify the tokens of push requests.
+// It can be replaced by a local key set to test the verification.
+type keySource interface {
+	getPublicKey(keyID string) (*rsa.PublicKey, error)
+}
+
+// staticKeySet is a fixed set of public keys indexed by key ID
+type staticKeySet map[string]*rsa.PublicKey
+
+func (s staticKeySet) getPublicKey(keyID string) (*rsa.PublicKey, error) {
+	key, ok := s[keyID]
+	if !ok {
+		return nil, errors.New("Unknown key ID: " + keyID)
+	}
+	return key, nil
+}
+
+// remoteKeySet fetches and caches a JSON Web Key Set published at a URL
+type remoteKeySet struct {
+	url    string
+	client *http.Client
+
+	// mutex guards keys and expiry
+	mutex  sync.Mutex
+	keys   staticKeySet
+	expiry time.Time
+}
+
+func newRemoteKeySet(url string) *remoteKeySet {
+	return &remoteKeySet{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *remoteKeySet) getPublicKey(keyID string) (*rsa.PublicKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if key, ok := s.keys[keyID]; ok && time.Now().Before(s.expiry) {
+		return key, nil
+	}
+
+	// Keys are rotated by Google, so fetch again if the key is unknown or the cache expired
+	response, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not fetch the key set")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not fetch the key set, status: %d", response.StatusCode)
+	}
+
+	var keySet jsonWebKeySet
+	if err = json.NewDecoder(response.Body).Decode(&keySet); err != nil {
+		return nil, errors.Wrap(err, "Could not decode the key set")
+	}
+
+	keys, err := keySet.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+	s.expiry = time.Now().Add(keySetCacheDuration)
+
+	return s.keys.getPublicKey(keyID)
+}
+
+// jsonWebKeySet is the JSON representation of a set of RSA keys
+type jsonWebKeySet struct {
+	Keys []struct {
+		KeyID     string `json:"kid"`
+		KeyType   string `json:"kty"`
+		Algorithm string `json:"alg"`
+		Modulus   string `json:"n"`
+		Exponent  string `json:"e"`
+	} `json:"keys"`
+}
+
+// publicKeys converts the RSA keys of the set to public keys indexed by key ID
+func (k *jsonWebKeySet) publicKeys() (staticKeySet, error) {
+	keys := staticKeySet{}
+	for _, key := range k.Keys {
+		if key.KeyType != "RSA" {
+			continue
+		}
+
+		modulus, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.Modulus, "="))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid modulus of key "+key.KeyID)
+		}
+		exponent, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.Exponent, "="))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid exponent of key "+key.KeyID)
+		}
+
+		keys[key.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// parseKeySet creates a local key set from a JSON Web Key Set document
+func parseKeySet(data []byte) (staticKeySet, error) {
+	var keySet jsonWebKeySet
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return nil, err
+	}
+	return keySet.publicKeys()
+}
+
+// pushTokenClaims are the claims of the OIDC token sent by Pub/Sub with push requests
+type pushTokenClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	ExpiresAt     int64  `json:"exp"`
+	IssuedAt      int64  `json:"iat"`
+}
+
+// getPushKeySource returns the key source used to verify push tokens, creating it from the configuration if needed
+func (p *Plugin) getPushKeySource() keySource {
+	p.pushKeySourceLock.Lock()
+	defer p.pushKeySourceLock.Unlock()
+
+	url := p.getConfiguration().PushAuthJWKSURL
+	if url == "" {
+		url = defaultPushAuthJWKSURL
+	}
+
+	remoteKeys, isRemote := p.pushKeySource.(*remoteKeySet)
+	if p.pushKeySource == nil || (isRemote && remoteKeys.url != url) {
+		p.pushKeySource = newRemoteKeySet(url)
+	}
+	return p.pushKeySource
+}
+
+// getPushEndpointURL returns the URL Pub/Sub pushes Gmail notifications to
+func (p *Plugin) getPushEndpointURL() string {
+	siteURL := ""
+	if p.API.GetConfig().ServiceSettings.SiteURL != nil {
+		siteURL = *p.API.GetConfig().ServiceSettings.SiteURL
+	}
+	return fmt.Sprintf("%s/plugins/%s/webhook/gmail", siteURL, manifest.Id)
+}
+
+// authenticatePushRequest checks that a request to the webhook was sent by the configured Pub/Sub subscription.
+// The OIDC token is verified if a service account is configured, otherwise the shared verification token.
+// Requests are rejected if neither is configured, unless unauthenticated requests are explicitly allowed.
+func (p *Plugin) authenticatePushRequest(r *http.Request) error {
+	config := p.getConfiguration()
+
+	if config.PushAuthServiceAccount != "" {
+		authHeader := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			return errors.New("Missing bearer token")
+		}
+		return p.verifyPushToken(strings.TrimPrefix(authHeader, "Bearer "), time.Now())
+	}
+
+	if config.PushVerificationToken != "" {
+		token := r.URL.Query().Get("token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.PushVerificationToken)) != 1 {
+			return errors.New("Invalid verification token")
+		}
+		return nil
+	}
+
+	if config.AllowUnauthenticatedPush {
+		p.API.LogWarn("Gmail webhook is not authenticated. Please configure push authentication in the plugin settings.")
+		return nil
+	}
+	return errors.New("Push authentication is not configured")
+}
+
+// verifyPushToken verifies the signature and the claims of an OIDC token sent by Pub/Sub
+func (p *Plugin) verifyPushToken(token string, now time.Time) error {
+	config := p.getConfiguration()
+	keys := p.getPushKeySource()
+
+	payload, _, err := jose.Decode(token, func(headers map[string]interface{}, payload string) interface{} {
+		if alg, _ := headers["alg"].(string); alg != jose.RS256 {
+			return errors.New("Unexpected signing algorithm: " + alg)
+		}
+		keyID, _ := headers["kid"].(string)
+		key, err := keys.getPublicKey(keyID)
+		if err != nil {
+			return err
+		}
+		return key
+	})
+	if err != nil {
+		return errors.Wrap(err, "Invalid token signature")
+	}
+
+	var claims pushTokenClaims
+	if err = json.Unmarshal([]byte(payload), &claims); err != nil {
+		return errors.Wrap(err, "Invalid token claims")
+	}
+
+	if !googleIssuers[claims.Issuer] {
+		return errors.New("Unexpected token issuer: " + claims.Issuer)
+	}
+
+	audience := config.PushAuthAudience
+	if audience == "" {
+		audience = p.getPushEndpointURL()
+	}
+	if claims.Audience != audience {
+		return errors.New("Unexpected token audience: " + claims.Audience)
+	}
+
+	if claims.Email != config.PushAuthServiceAccount || !claims.EmailVerified {
+		return errors.New("Unexpected token service account: " + claims.Email)
+	}
+
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(tokenClockSkew)) {
+		return errors.New("Token has expired")
+	}
+	if now.Add(tokenClockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return errors.New("Token is issued in the future")
+	}
+
+	return nil
+}
+
+// checkPubsubMessageIsFresh reports whether a Pub/Sub message should be processed, rejecting messages
+// published too long ago or received before. An error is returned if the check could not be made.
+func (p *Plugin) checkPubsubMessageIsFresh(messageID string, publishTime time.Time) (bool, error) {
+	if messageID == "" {
+		p.API.LogWarn("Ignoring Gmail notification without message ID")
+		return false, nil
+	}
+
+	if !publishTime.IsZero() && time.Since(publishTime) > pushMessageMaxAge {
+		p.API.LogWarn("Ignoring stale Gmail notification", "messageId", messageID, "publishTime", publishTime.String())
+		return false, nil
+	}
+
+	// Record the message ID, failing if it was already recorded
+	recorded, appErr := p.API.KVSetWithOptions(pushMessageKeyPrefix+messageID, []byte("1"), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(2 * pushMessageMaxAge / time.Second),
+	})
+	if appErr != nil {
+		return false, appErr
+	}
+	if !recorded {
+		p.API.LogWarn("Ignoring replayed Gmail notification", "messageId", messageID)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// forgetPubsubMessage removes the record of a Pub/Sub message that could not be handled, so that it is accepted when delivered again
+func (p *Plugin) forgetPubsubMessage(messageID string) {
+	p.API.KVDelete(pushMessageKeyPrefix + messageID)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jose "github.com/dvsekhvalnov/jose2go"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testServiceAccount = "pubsub-push@project.iam.gserviceaccount.com"
+	testAudience       = "https://mattermost.example.com/plugins/mattermost-plugin-gmail/webhook/gmail"
+	testKeyID          = "test-key"
+)
+
+func newPushAuthTestPlugin(t *testing.T, publicKey *rsa.PublicKey, config *configuration) *Plugin {
+	t.Helper()
+
+	api := &plugintest.API{}
+	api.On("LogWarn", mock.Anything).Maybe()
+
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.setConfiguration(config)
+	p.pushKeySource = staticKeySet{testKeyID: publicKey}
+	return p
+}
+
+func signPushToken(t *testing.T, key *rsa.PrivateKey, keyID string, claims pushTokenClaims) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	token, err := jose.Sign(string(payload), jose.RS256, key, jose.Header("kid", keyID))
+	require.NoError(t, err)
+	return token
+}
+
+func TestVerifyPushToken(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	now := time.Now()
+	validClaims := pushTokenClaims{
+		Issuer:        "https://accounts.google.com",
+		Audience:      testAudience,
+		Email:         testServiceAccount,
+		EmailVerified: true,
+		IssuedAt:      now.Add(-time.Minute).Unix(),
+		ExpiresAt:     now.Add(time.Hour).Unix(),
+	}
+
+	for name, test := range map[string]struct {
+		key         *rsa.PrivateKey
+		keyID       string
+		claims      func(claims pushTokenClaims) pushTokenClaims
+		expectError string
+	}{
+		"valid token": {
+			key:    signingKey,
+			keyID:  testKeyID,
+			claims: func(claims pushTokenClaims) pushTokenClaims { return claims },
+		},
+		"wrong issuer": {
+			key:   signingKey,
+			keyID: testKeyID,
+			claims: func(claims pushTokenClaims) pushTokenClaims {
+				claims.Issuer = "https://attacker.example.com"
+				return claims
+			},
+			expectError: "Unexpected token issuer",
+		},
+		"wrong audience": {
+			key:   signingKey,
+			keyID: testKeyID,
+			claims: func(claims pushTokenClaims) pushTokenClaims {
+				claims.Audience = "https://other.example.com/webhook"
+				return claims
+			},
+			expectError: "Unexpected token audience",
+		},
+		"wrong email": {
+			key:   signingKey,
+			keyID: testKeyID,
+			claims: func(claims pushTokenClaims) pushTokenClaims {
+				claims.Email = "someone@project.iam.gserviceaccount.com"
+				return claims
+			},
+			expectError: "Unexpected token service account",
+		},
+		"unverified email": {
+			key:   signingKey,
+			keyID: testKeyID,
+			claims: func(claims pushTokenClaims) pushTokenClaims {
+				claims.EmailVerified = false
+				return claims
+			},
+			expectError: "Unexpected token service account",
+		},
+		"expired token": {
+			key:   signingKey,
+			keyID: testKeyID,
+			claims: func(claims pushTokenClaims) pushTokenClaims {
+				claims.IssuedAt = now.Add(-2 * time.Hour).Unix()
+				claims.ExpiresAt = now.Add(-time.Hour).Unix()
+				return claims
+			},
+			expectError: "Token has expired",
+		},
+		"token issued in the future": {
+			key:   signingKey,
+			keyID: testKeyID,
+			claims: func(claims pushTokenClaims) pushTokenClaims {
+				claims.IssuedAt = now.Add(time.Hour).Unix()
+				return claims
+			},
+			expectError: "Token is issued in the future",
+		},
+		"wrong signature": {
+			key:         otherKey,
+			keyID:       testKeyID,
+			claims:      func(claims pushTokenClaims) pushTokenClaims { return claims },
+			expectError: "Invalid token signature",
+		},
+		"unknown key": {
+			key:         signingKey,
+			keyID:       "unknown-key",
+			claims:      func(claims pushTokenClaims) pushTokenClaims { return claims },
+			expectError: "Invalid token signature",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newPushAuthTestPlugin(t, &signingKey.PublicKey, &configuration{
+				PushAuthServiceAccount: testServiceAccount,
+				PushAuthAudience:       testAudience,
+			})
+
+			err := p.verifyPushToken(signPushToken(t, test.key, test.keyID, test.claims(validClaims)), now)
+			if test.expectError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.expectError)
+		})
+	}
+}
+
+func TestAuthenticatePushRequest(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	now := time.Now()
+	validToken := signPushToken(t, signingKey, testKeyID, pushTokenClaims{
+		Issuer:        "accounts.google.com",
+		Audience:      testAudience,
+		Email:         testServiceAccount,
+		EmailVerified: true,
+		IssuedAt:      now.Add(-time.Minute).Unix(),
+		ExpiresAt:     now.Add(time.Hour).Unix(),
+	})
+
+	for name, test := range map[string]struct {
+		config        *configuration
+		url           string
+		authorization string
+		expectError   bool
+	}{
+		"valid bearer token": {
+			config:        &configuration{PushAuthServiceAccount: testServiceAccount, PushAuthAudience: testAudience},
+			url:           "/webhook/gmail",
+			authorization: "Bearer " + validToken,
+		},
+		"missing bearer token": {
+			config:      &configuration{PushAuthServiceAccount: testServiceAccount, PushAuthAudience: testAudience},
+			url:         "/webhook/gmail?token=secret",
+			expectError: true,
+		},
+		"valid verification token": {
+			config: &configuration{PushVerificationToken: "secret"},
+			url:    "/webhook/gmail?token=secret",
+		},
+		"wrong verification token": {
+			config:      &configuration{PushVerificationToken: "secret"},
+			url:         "/webhook/gmail?token=guess",
+			expectError: true,
+		},
+		"missing verification token": {
+			config:      &configuration{PushVerificationToken: "secret"},
+			url:         "/webhook/gmail",
+			expectError: true,
+		},
+		"service account preferred over verification token": {
+			config:      &configuration{PushAuthServiceAccount: testServiceAccount, PushAuthAudience: testAudience, PushVerificationToken: "secret"},
+			url:         "/webhook/gmail?token=secret",
+			expectError: true,
+		},
+		"nothing configured": {
+			config:      &configuration{},
+			url:         "/webhook/gmail",
+			expectError: true,
+		},
+		"unauthenticated push explicitly allowed": {
+			config: &configuration{AllowUnauthenticatedPush: true},
+			url:    "/webhook/gmail",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newPushAuthTestPlugin(t, &signingKey.PublicKey, test.config)
+
+			request := httptest.NewRequest("POST", test.url, nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+
+			err := p.authenticatePushRequest(request)
+			if test.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}